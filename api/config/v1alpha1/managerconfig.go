@@ -0,0 +1,297 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultMetricsBindAddress    = ":8080"
+	defaultLivenessEndpointName  = "/healthz"
+	defaultReadinessEndpointName = "/readyz"
+	defaultWebhookPort           = 9443
+	defaultLeaderElectionID      = "2c007cad.dysproz.io"
+	defaultLeaseDuration         = 15 * time.Second
+	defaultRenewDeadline         = 10 * time.Second
+	defaultRetryPeriod           = 2 * time.Second
+	defaultShardLeaseDuration    = 15 * time.Second
+	defaultShardRenewPeriod      = 5 * time.Second
+)
+
+// Load reads the manager configuration from a YAML file and fills in defaults.
+// No path means the default configuration. Unknown fields are rejected.
+func Load(path string) (*ManagerConfig, error) {
+	config := &ManagerConfig{TypeMeta: metav1.TypeMeta{APIVersion: GroupVersion.String(), Kind: ManagerConfigKind}}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		config = &ManagerConfig{}
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	}
+	config.Default()
+	return config, nil
+}
+
+// Default fills in unset fields.
+func (c *ManagerConfig) Default() {
+	if c.Metrics.BindAddress == "" {
+		c.Metrics.BindAddress = defaultMetricsBindAddress
+	}
+	if c.Health.LivenessEndpointName == "" {
+		c.Health.LivenessEndpointName = defaultLivenessEndpointName
+	}
+	if c.Health.ReadinessEndpointName == "" {
+		c.Health.ReadinessEndpointName = defaultReadinessEndpointName
+	}
+	if c.Webhook.Port == 0 {
+		c.Webhook.Port = defaultWebhookPort
+	}
+	if c.LeaderElection.ResourceName == "" {
+		c.LeaderElection.ResourceName = defaultLeaderElectionID
+	}
+	if c.LeaderElection.LeaseDuration == nil {
+		c.LeaderElection.LeaseDuration = &metav1.Duration{Duration: defaultLeaseDuration}
+	}
+	if c.LeaderElection.RenewDeadline == nil {
+		c.LeaderElection.RenewDeadline = &metav1.Duration{Duration: defaultRenewDeadline}
+	}
+	if c.LeaderElection.RetryPeriod == nil {
+		c.LeaderElection.RetryPeriod = &metav1.Duration{Duration: defaultRetryPeriod}
+	}
+	if c.Sharding.LeaseDuration == nil {
+		c.Sharding.LeaseDuration = &metav1.Duration{Duration: defaultShardLeaseDuration}
+	}
+	if c.Sharding.RenewPeriod == nil {
+		c.Sharding.RenewPeriod = &metav1.Duration{Duration: defaultShardRenewPeriod}
+	}
+	if c.Logging.Development == nil {
+		development := true
+		c.Logging.Development = &development
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = JSONLogFormat
+		if *c.Logging.Development {
+			c.Logging.Format = ConsoleLogFormat
+		}
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = "info"
+		if *c.Logging.Development {
+			c.Logging.Level = "debug"
+		}
+	}
+}
+
+// Validate checks a defaulted configuration.
+func (c *ManagerConfig) Validate() error {
+	var allErrs field.ErrorList
+	if c.APIVersion != GroupVersion.String() {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{GroupVersion.String()}))
+	}
+	if c.Kind != ManagerConfigKind {
+		allErrs = append(allErrs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{ManagerConfigKind}))
+	}
+	if c.Metrics.BindAddress != "0" {
+		allErrs = append(allErrs, validateBindAddress(c.Metrics.BindAddress, field.NewPath("metrics", "bindAddress"))...)
+	}
+	allErrs = append(allErrs, c.Health.validate(field.NewPath("health"))...)
+	if c.Webhook.Port < 1 || c.Webhook.Port > 65535 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("webhook", "port"), c.Webhook.Port, "must be between 1 and 65535"))
+	}
+	allErrs = append(allErrs, c.LeaderElection.validate(field.NewPath("leaderElection"))...)
+	if c.Sharding.Enabled {
+		allErrs = append(allErrs, c.Sharding.validate(field.NewPath("sharding"))...)
+		if c.LeaderElection.LeaderElect {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("leaderElection", "leaderElect"), true, "must be disabled when sharding is enabled"))
+		}
+	}
+	allErrs = append(allErrs, c.Logging.validate(field.NewPath("logging"))...)
+	namespacesPath := field.NewPath("namespaces")
+	namespaces := sets.NewString()
+	for i, namespace := range c.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			allErrs = append(allErrs, field.Invalid(namespacesPath.Index(i), namespace, msg))
+		}
+		if namespaces.Has(namespace) {
+			allErrs = append(allErrs, field.Duplicate(namespacesPath.Index(i), namespace))
+		}
+		namespaces.Insert(namespace)
+	}
+	tolerationsPath := field.NewPath("daemonJobDefaults", "tolerations")
+	for i, toleration := range c.DaemonJobDefaults.Tolerations {
+		allErrs = append(allErrs, validateToleration(toleration, tolerationsPath.Index(i))...)
+	}
+	return allErrs.ToAggregate()
+}
+
+func (h *HealthConfig) validate(fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if h.BindAddress != "" {
+		allErrs = append(allErrs, validateBindAddress(h.BindAddress, fldPath.Child("bindAddress"))...)
+	}
+	for _, endpoint := range []struct {
+		name  string
+		value string
+	}{{"livenessEndpointName", h.LivenessEndpointName}, {"readinessEndpointName", h.ReadinessEndpointName}} {
+		if !strings.HasPrefix(endpoint.value, "/") {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(endpoint.name), endpoint.value, "must start with /"))
+		}
+	}
+	if h.LivenessEndpointName == h.ReadinessEndpointName {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("readinessEndpointName"), h.ReadinessEndpointName, "must differ from livenessEndpointName"))
+	}
+	return allErrs
+}
+
+func (l *LeaderElectionConfig) validate(fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for _, msg := range validation.IsDNS1123Subdomain(l.ResourceName) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("resourceName"), l.ResourceName, msg))
+	}
+	if l.ResourceNamespace != "" {
+		for _, msg := range validation.IsDNS1123Label(l.ResourceNamespace) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("resourceNamespace"), l.ResourceNamespace, msg))
+		}
+	}
+	for _, duration := range []struct {
+		name  string
+		value time.Duration
+	}{{"leaseDuration", l.LeaseDuration.Duration}, {"renewDeadline", l.RenewDeadline.Duration}, {"retryPeriod", l.RetryPeriod.Duration}} {
+		if duration.value <= 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child(duration.name), duration.value.String(), "must be positive"))
+		}
+	}
+	if l.RenewDeadline.Duration >= l.LeaseDuration.Duration {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("renewDeadline"), l.RenewDeadline.Duration.String(), "must be shorter than leaseDuration"))
+	}
+	if l.RetryPeriod.Duration >= l.RenewDeadline.Duration {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("retryPeriod"), l.RetryPeriod.Duration.String(), "must be shorter than renewDeadline"))
+	}
+	return allErrs
+}
+
+func (s *ShardingConfig) validate(fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if s.Identity == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("identity"), ""))
+	} else {
+		for _, msg := range validation.IsDNS1123Subdomain(s.Identity) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("identity"), s.Identity, msg))
+		}
+	}
+	if s.Namespace == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("namespace"), ""))
+	} else {
+		for _, msg := range validation.IsDNS1123Label(s.Namespace) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("namespace"), s.Namespace, msg))
+		}
+	}
+	if s.LeaseDuration.Duration < time.Second {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("leaseDuration"), s.LeaseDuration.Duration.String(), "must be at least 1s"))
+	}
+	if s.RenewPeriod.Duration <= 0 || s.RenewPeriod.Duration >= s.LeaseDuration.Duration {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("renewPeriod"), s.RenewPeriod.Duration.String(), "must be positive and shorter than leaseDuration"))
+	}
+	return allErrs
+}
+
+func (l *LoggingConfig) validate(fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if l.Format != JSONLogFormat && l.Format != ConsoleLogFormat {
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("format"), l.Format, []string{string(JSONLogFormat), string(ConsoleLogFormat)}))
+	}
+	if _, err := ParseLogLevel(l.Level); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("level"), l.Level, err.Error()))
+	}
+	return allErrs
+}
+
+// ParseLogLevel translates a log level into a zap level.
+// Verbosity levels above info are negative zap levels, as logr V(n) logs at zap level -n.
+func ParseLogLevel(level string) (zapcore.Level, error) {
+	switch level {
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "info":
+		return zapcore.InfoLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	}
+	verbosity, err := strconv.Atoi(level)
+	if err != nil || verbosity < 0 {
+		return 0, fmt.Errorf("must be debug, info, error or a non-negative number")
+	}
+	return zapcore.Level(-verbosity), nil
+}
+
+func validateBindAddress(address string, fldPath *field.Path) field.ErrorList {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, address, err.Error())}
+	}
+	if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+		return field.ErrorList{field.Invalid(fldPath, address, "port must be between 0 and 65535")}
+	}
+	return nil
+}
+
+func validateToleration(toleration corev1.Toleration, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if toleration.Key != "" {
+		for _, msg := range validation.IsQualifiedName(toleration.Key) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("key"), toleration.Key, msg))
+		}
+	}
+	switch toleration.Operator {
+	case corev1.TolerationOpEqual, "":
+		if toleration.Key == "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("operator"), toleration.Operator, "operator must be Exists when key is empty"))
+		}
+	case corev1.TolerationOpExists:
+		if toleration.Value != "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("value"), toleration.Value, "value must be empty when operator is Exists"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("operator"), toleration.Operator,
+			[]string{string(corev1.TolerationOpEqual), string(corev1.TolerationOpExists)}))
+	}
+	switch toleration.Effect {
+	case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("effect"), toleration.Effect,
+			[]string{string(corev1.TaintEffectNoSchedule), string(corev1.TaintEffectPreferNoSchedule), string(corev1.TaintEffectNoExecute)}))
+	}
+	return allErrs
+}
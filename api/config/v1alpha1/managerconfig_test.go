@@ -0,0 +1,165 @@
+package v1alpha1
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.uber.org/zap/zapcore"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func writeConfig(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "managerconfig")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	t.Run("should default configuration without file", func(t *testing.T) {
+		config, err := Load("")
+		require.NoError(t, err)
+		assert.NoError(t, config.Validate())
+		assert.Equal(t, ":8080", config.Metrics.BindAddress)
+		assert.Equal(t, 9443, config.Webhook.Port)
+		assert.Equal(t, "2c007cad.dysproz.io", config.LeaderElection.ResourceName)
+		assert.Equal(t, 15*time.Second, config.LeaderElection.LeaseDuration.Duration)
+		assert.True(t, *config.Logging.Development)
+		assert.Equal(t, ConsoleLogFormat, config.Logging.Format)
+		assert.Equal(t, "debug", config.Logging.Level)
+	})
+
+	t.Run("should load configuration file", func(t *testing.T) {
+		config, err := Load(writeConfig(t, dir, `
+apiVersion: config.dj.dysproz.io/v1alpha1
+kind: ManagerConfig
+metrics:
+  bindAddress: 127.0.0.1:8080
+health:
+  bindAddress: :8081
+webhook:
+  port: 9444
+leaderElection:
+  leaderElect: true
+  leaseDuration: 30s
+namespaces: [team-a, team-b]
+logging:
+  development: false
+  level: "2"
+daemonJobDefaults:
+  tolerations:
+  - {key: node-role.kubernetes.io/master, operator: Exists, effect: NoSchedule}
+`))
+		require.NoError(t, err)
+		require.NoError(t, config.Validate())
+		assert.Equal(t, "127.0.0.1:8080", config.Metrics.BindAddress)
+		assert.Equal(t, ":8081", config.Health.BindAddress)
+		assert.Equal(t, "/healthz", config.Health.LivenessEndpointName)
+		assert.Equal(t, 9444, config.Webhook.Port)
+		assert.True(t, config.LeaderElection.LeaderElect)
+		assert.Equal(t, 30*time.Second, config.LeaderElection.LeaseDuration.Duration)
+		assert.Equal(t, 10*time.Second, config.LeaderElection.RenewDeadline.Duration)
+		assert.Equal(t, []string{"team-a", "team-b"}, config.Namespaces)
+		assert.False(t, *config.Logging.Development)
+		assert.Equal(t, JSONLogFormat, config.Logging.Format)
+		assert.Equal(t, "2", config.Logging.Level)
+		assert.Len(t, config.DaemonJobDefaults.Tolerations, 1)
+	})
+
+	t.Run("should load sharding configuration", func(t *testing.T) {
+		config, err := Load(writeConfig(t, dir, `
+apiVersion: config.dj.dysproz.io/v1alpha1
+kind: ManagerConfig
+sharding:
+  enabled: true
+  identity: manager-a
+  namespace: daemonjob-system
+`))
+		require.NoError(t, err)
+		require.NoError(t, config.Validate())
+		assert.Equal(t, 15*time.Second, config.Sharding.LeaseDuration.Duration)
+		assert.Equal(t, 5*time.Second, config.Sharding.RenewPeriod.Duration)
+	})
+
+	t.Run("should reject unknown fields", func(t *testing.T) {
+		_, err := Load(writeConfig(t, dir, "apiVersion: config.dj.dysproz.io/v1alpha1\nkind: ManagerConfig\nmetricsAddr: :8080\n"))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "metricsAddr")
+	})
+
+	t.Run("should fail on missing file", func(t *testing.T) {
+		_, err := Load(filepath.Join(dir, "missing.yaml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	for name, test := range map[string]struct {
+		update func(*ManagerConfig)
+		field  string
+	}{
+		"apiVersion":    {func(c *ManagerConfig) { c.APIVersion = "v1" }, "apiVersion"},
+		"kind":          {func(c *ManagerConfig) { c.Kind = "Config" }, "kind"},
+		"metrics":       {func(c *ManagerConfig) { c.Metrics.BindAddress = "8080" }, "metrics.bindAddress"},
+		"health":        {func(c *ManagerConfig) { c.Health.BindAddress = ":99999" }, "health.bindAddress"},
+		"endpoints":     {func(c *ManagerConfig) { c.Health.ReadinessEndpointName = "/healthz" }, "health.readinessEndpointName"},
+		"webhook port":  {func(c *ManagerConfig) { c.Webhook.Port = 70000 }, "webhook.port"},
+		"lock name":     {func(c *ManagerConfig) { c.LeaderElection.ResourceName = "Lock" }, "leaderElection.resourceName"},
+		"renewDeadline": {func(c *ManagerConfig) { c.LeaderElection.RenewDeadline = &metav1.Duration{Duration: time.Minute} }, "leaderElection.renewDeadline"},
+		"namespace":     {func(c *ManagerConfig) { c.Namespaces = []string{"Team_A"} }, "namespaces[0]"},
+		"duplicate":     {func(c *ManagerConfig) { c.Namespaces = []string{"team-a", "team-a"} }, "namespaces[1]"},
+		"sharding with leader election": {func(c *ManagerConfig) {
+			c.Sharding = ShardingConfig{Enabled: true, Identity: "manager-a", Namespace: "daemonjob-system",
+				LeaseDuration: c.Sharding.LeaseDuration, RenewPeriod: c.Sharding.RenewPeriod}
+			c.LeaderElection.LeaderElect = true
+		}, "leaderElection.leaderElect"},
+		"sharding identity": {func(c *ManagerConfig) {
+			c.Sharding.Enabled = true
+			c.Sharding.Namespace = "daemonjob-system"
+		}, "sharding.identity"},
+		"sharding renewPeriod": {func(c *ManagerConfig) {
+			c.Sharding = ShardingConfig{Enabled: true, Identity: "manager-a", Namespace: "daemonjob-system",
+				LeaseDuration: c.Sharding.LeaseDuration, RenewPeriod: &metav1.Duration{Duration: time.Minute}}
+		}, "sharding.renewPeriod"},
+		"log format": {func(c *ManagerConfig) { c.Logging.Format = "text" }, "logging.format"},
+		"log level":  {func(c *ManagerConfig) { c.Logging.Level = "warn" }, "logging.level"},
+		"toleration": {func(c *ManagerConfig) {
+			c.DaemonJobDefaults.Tolerations = []corev1.Toleration{{Key: "gpu", Operator: corev1.TolerationOpExists, Value: "true"}}
+		}, "daemonJobDefaults.tolerations[0].value"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			config, err := Load("")
+			require.NoError(t, err)
+			test.update(config)
+			err = config.Validate()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.field)
+		})
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for level, expected := range map[string]zapcore.Level{
+		"debug": zapcore.DebugLevel,
+		"info":  zapcore.InfoLevel,
+		"error": zapcore.ErrorLevel,
+		"0":     zapcore.InfoLevel,
+		"3":     zapcore.Level(-3),
+	} {
+		parsed, err := ParseLogLevel(level)
+		require.NoError(t, err, level)
+		assert.Equal(t, expected, parsed, level)
+	}
+	_, err := ParseLogLevel("-1")
+	assert.Error(t, err)
+}
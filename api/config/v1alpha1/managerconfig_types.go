@@ -0,0 +1,183 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package v1alpha1 contains the configuration file of the DaemonJob manager.
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+var (
+	// GroupVersion is group version of the manager configuration file
+	GroupVersion = schema.GroupVersion{Group: "config.dj.dysproz.io", Version: "v1alpha1"}
+)
+
+// ManagerConfigKind is the kind of the manager configuration file.
+const ManagerConfigKind = "ManagerConfig"
+
+// ManagerConfig configures the DaemonJob manager.
+type ManagerConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Metrics configures the metrics endpoint.
+	// +optional
+	Metrics MetricsConfig `json:"metrics,omitempty"`
+
+	// Health configures the liveness and readiness probe endpoints.
+	// +optional
+	Health HealthConfig `json:"health,omitempty"`
+
+	// Webhook configures the webhook server.
+	// +optional
+	Webhook WebhookConfig `json:"webhook,omitempty"`
+
+	// LeaderElection configures leader election between replicas of the manager.
+	// +optional
+	LeaderElection LeaderElectionConfig `json:"leaderElection,omitempty"`
+
+	// Sharding spreads DaemonJobs over all replicas of the manager instead of electing a single leader.
+	// +optional
+	Sharding ShardingConfig `json:"sharding,omitempty"`
+
+	// Namespaces the manager handles DaemonJobs in. All namespaces are handled if empty.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Logging configures the logger of the manager.
+	// +optional
+	Logging LoggingConfig `json:"logging,omitempty"`
+
+	// DaemonJobDefaults are applied to every DaemonJob by the defaulting webhook.
+	// +optional
+	DaemonJobDefaults djv2.DaemonJobDefaults `json:"daemonJobDefaults,omitempty"`
+}
+
+// MetricsConfig configures the metrics endpoint.
+type MetricsConfig struct {
+	// BindAddress is the address the metrics endpoint binds to. "0" disables the endpoint.
+	// Defaults to ":8080".
+	// +optional
+	BindAddress string `json:"bindAddress,omitempty"`
+}
+
+// HealthConfig configures the liveness and readiness probe endpoints.
+type HealthConfig struct {
+	// BindAddress is the address the probe endpoints bind to. Probes are disabled if empty.
+	// +optional
+	BindAddress string `json:"bindAddress,omitempty"`
+
+	// LivenessEndpointName is the path of the liveness probe. Defaults to "/healthz".
+	// +optional
+	LivenessEndpointName string `json:"livenessEndpointName,omitempty"`
+
+	// ReadinessEndpointName is the path of the readiness probe. Defaults to "/readyz".
+	// +optional
+	ReadinessEndpointName string `json:"readinessEndpointName,omitempty"`
+}
+
+// WebhookConfig configures the webhook server.
+type WebhookConfig struct {
+	// Port the webhook server listens on. Defaults to 9443.
+	// +optional
+	Port int `json:"port,omitempty"`
+
+	// CertDir is the directory with the tls.crt and tls.key serving certificate.
+	// Defaults to the directory used by controller-runtime.
+	// +optional
+	CertDir string `json:"certDir,omitempty"`
+}
+
+// LeaderElectionConfig configures leader election between replicas of the manager.
+type LeaderElectionConfig struct {
+	// LeaderElect enables leader election, so that only one replica manages DaemonJobs at a time.
+	// +optional
+	LeaderElect bool `json:"leaderElect,omitempty"`
+
+	// ResourceName is the name of the lock. Defaults to "2c007cad.dysproz.io".
+	// +optional
+	ResourceName string `json:"resourceName,omitempty"`
+
+	// ResourceNamespace is the namespace of the lock. Defaults to the namespace of the manager.
+	// +optional
+	ResourceNamespace string `json:"resourceNamespace,omitempty"`
+
+	// LeaseDuration is how long replicas wait before taking over the lock. Defaults to 15s.
+	// +optional
+	LeaseDuration *metav1.Duration `json:"leaseDuration,omitempty"`
+
+	// RenewDeadline is how long the leader retries renewing the lock before giving up. Defaults to 10s.
+	// +optional
+	RenewDeadline *metav1.Duration `json:"renewDeadline,omitempty"`
+
+	// RetryPeriod is how long replicas wait between attempts to act on the lock. Defaults to 2s.
+	// +optional
+	RetryPeriod *metav1.Duration `json:"retryPeriod,omitempty"`
+}
+
+// ShardingConfig configures sharding of DaemonJobs between replicas of the manager.
+type ShardingConfig struct {
+	// Enabled makes every replica reconcile its own share of DaemonJobs. Leader election has to be disabled.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// Identity of the replica, unique among replicas. Defaults to the hostname, which is the pod name.
+	// +optional
+	Identity string `json:"identity,omitempty"`
+
+	// Namespace of the membership Leases. Defaults to the namespace of the manager.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// LeaseDuration is how long DaemonJobs of a replica that stopped renewing its Lease wait
+	// before other replicas take them over. Defaults to 15s.
+	// +optional
+	LeaseDuration *metav1.Duration `json:"leaseDuration,omitempty"`
+
+	// RenewPeriod is how often replicas renew their Leases and check membership. Defaults to 5s.
+	// +optional
+	RenewPeriod *metav1.Duration `json:"renewPeriod,omitempty"`
+}
+
+// LogFormat is the encoding of log entries.
+type LogFormat string
+
+const (
+	// JSONLogFormat writes every entry as a JSON object.
+	JSONLogFormat LogFormat = "json"
+
+	// ConsoleLogFormat writes human-readable entries.
+	ConsoleLogFormat LogFormat = "console"
+)
+
+// LoggingConfig configures the logger of the manager.
+type LoggingConfig struct {
+	// Development enables stack traces on warnings, console format and debug level by default. Defaults to true.
+	// +optional
+	Development *bool `json:"development,omitempty"`
+
+	// Format of log entries, json or console. Defaults to console in development mode and json otherwise.
+	// +optional
+	Format LogFormat `json:"format,omitempty"`
+
+	// Level is the lowest level logged: debug, info, error, or a number of verbosity levels above info.
+	// Defaults to debug in development mode and info otherwise.
+	// +optional
+	Level string `json:"level,omitempty"`
+}
@@ -0,0 +1,403 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"encoding/json"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	v2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// Fields of v2 without a v1 counterpart are kept in annotations of v1 DaemonJobs,
+// so that they survive a round trip through v1.
+const (
+	// TemplateRefAnnotation keeps spec.templateRef of v2.
+	TemplateRefAnnotation = "dj.dysproz.io/v2-template-ref"
+
+	// OverridesAnnotation keeps spec.overrides of v2.
+	OverridesAnnotation = "dj.dysproz.io/v2-overrides"
+
+	// JobMetadataAnnotation keeps spec.jobTemplate.metadata of v2.
+	JobMetadataAnnotation = "dj.dysproz.io/v2-job-metadata"
+
+	// MetadataPropagationAnnotation keeps spec.metadataPropagation of v2.
+	MetadataPropagationAnnotation = "dj.dysproz.io/v2-metadata-propagation"
+
+	// JobOptionsAnnotation keeps spec.jobTemplate.spec.podReplacementPolicy and completionMode of v2.
+	JobOptionsAnnotation = "dj.dysproz.io/v2-job-options"
+
+	// FleetLimitsAnnotation keeps spec.rollout.activeDeadlineSeconds and backoffLimit of v2.
+	FleetLimitsAnnotation = "dj.dysproz.io/v2-fleet-limits"
+
+	// StaleJobsPolicyAnnotation keeps spec.staleJobsPolicy of v2.
+	StaleJobsPolicyAnnotation = "dj.dysproz.io/v2-stale-jobs-policy"
+)
+
+// jobOptions holds fields of the v2 Job spec without a v1 counterpart.
+type jobOptions struct {
+	PodReplacementPolicy *v2.PodReplacementPolicy `json:"podReplacementPolicy,omitempty"`
+	CompletionMode       *v2.CompletionMode       `json:"completionMode,omitempty"`
+}
+
+// fleetLimits holds fields of the v2 rollout without a v1 counterpart.
+type fleetLimits struct {
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+	BackoffLimit          *int32 `json:"backoffLimit,omitempty"`
+}
+
+var _ conversion.Convertible = &DaemonJob{}
+
+// ConvertTo converts this DaemonJob to the Hub version (v2).
+// The node selector of the pod template becomes the node targeting block of v2.
+func (src *DaemonJob) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*v2.DaemonJob)
+	dst.ObjectMeta = src.ObjectMeta
+
+	dst.Spec.TemplateRef = nil
+	if err := restoreFromAnnotation(&dst.ObjectMeta, TemplateRefAnnotation, &dst.Spec.TemplateRef); err != nil {
+		return err
+	}
+	dst.Spec.Overrides = nil
+	if err := restoreFromAnnotation(&dst.ObjectMeta, OverridesAnnotation, &dst.Spec.Overrides); err != nil {
+		return err
+	}
+	dst.Spec.JobTemplate.Metadata = v2.JobMetadata{}
+	if err := restoreFromAnnotation(&dst.ObjectMeta, JobMetadataAnnotation, &dst.Spec.JobTemplate.Metadata); err != nil {
+		return err
+	}
+	dst.Spec.MetadataPropagation = nil
+	if err := restoreFromAnnotation(&dst.ObjectMeta, MetadataPropagationAnnotation, &dst.Spec.MetadataPropagation); err != nil {
+		return err
+	}
+	dst.Spec.StaleJobsPolicy = nil
+	if err := restoreFromAnnotation(&dst.ObjectMeta, StaleJobsPolicyAnnotation, &dst.Spec.StaleJobsPolicy); err != nil {
+		return err
+	}
+
+	template := src.Spec.Template.DeepCopy()
+	dst.Spec.Nodes = v2.NodeTargeting{
+		NodeSelector: template.Spec.NodeSelector,
+		Selector:     src.Spec.NodeSelector,
+	}
+	template.Spec.NodeSelector = nil
+	dst.Spec.JobTemplate.Spec = v2.JobSpec{
+		ActiveDeadlineSeconds:   src.Spec.ActiveDeadlineSeconds,
+		BackoffLimit:            src.Spec.BackoffLimit,
+		TTLSecondsAfterFinished: src.Spec.TTLSecondsAfterFinished,
+		Selector:                src.Spec.Selector,
+		ManualSelector:          src.Spec.ManualSelector,
+		Template:                *template,
+	}
+
+	dst.Spec.Rollout = nil
+	if src.Spec.MaxParallel != nil || src.Spec.Rollout != nil || src.Spec.FailurePolicy != nil || src.Spec.RetryFailedNodes != "" {
+		rollout := &v2.Rollout{
+			MaxParallel:      src.Spec.MaxParallel,
+			RetryFailedNodes: src.Spec.RetryFailedNodes,
+		}
+		if src.Spec.Rollout != nil {
+			if src.Spec.Rollout.Canary != nil {
+				rollout.Canary = &v2.Canary{
+					Nodes:    src.Spec.Rollout.Canary.Nodes,
+					Selector: src.Spec.Rollout.Canary.Selector,
+				}
+			}
+			rollout.Waves = src.Spec.Rollout.Waves
+		}
+		if src.Spec.FailurePolicy != nil {
+			rollout.MaxFailedNodes = src.Spec.FailurePolicy.MaxFailedNodes
+		}
+		dst.Spec.Rollout = rollout
+	}
+
+	options := jobOptions{}
+	if err := restoreFromAnnotation(&dst.ObjectMeta, JobOptionsAnnotation, &options); err != nil {
+		return err
+	}
+	dst.Spec.JobTemplate.Spec.PodReplacementPolicy = options.PodReplacementPolicy
+	dst.Spec.JobTemplate.Spec.CompletionMode = options.CompletionMode
+
+	limits := fleetLimits{}
+	if err := restoreFromAnnotation(&dst.ObjectMeta, FleetLimitsAnnotation, &limits); err != nil {
+		return err
+	}
+	if limits != (fleetLimits{}) {
+		if dst.Spec.Rollout == nil {
+			dst.Spec.Rollout = &v2.Rollout{}
+		}
+		dst.Spec.Rollout.ActiveDeadlineSeconds = limits.ActiveDeadlineSeconds
+		dst.Spec.Rollout.BackoffLimit = limits.BackoffLimit
+	}
+
+	dst.Spec.Teardown = nil
+	if src.Spec.TeardownTemplate != nil {
+		dst.Spec.Teardown = &v2.Teardown{
+			Template:       *src.Spec.TeardownTemplate,
+			TimeoutSeconds: src.Spec.TeardownTimeoutSeconds,
+		}
+	}
+
+	dst.Status = v2.DaemonJobStatus{}
+	if src.Status != nil {
+		dst.Status = convertStatusTo(src.Status)
+	}
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v2) to this version.
+func (dst *DaemonJob) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*v2.DaemonJob)
+	dst.ObjectMeta = src.ObjectMeta
+
+	if src.Spec.TemplateRef != nil {
+		if err := saveToAnnotation(&dst.ObjectMeta, TemplateRefAnnotation, src.Spec.TemplateRef); err != nil {
+			return err
+		}
+	}
+	if src.Spec.Overrides != nil {
+		if err := saveToAnnotation(&dst.ObjectMeta, OverridesAnnotation, src.Spec.Overrides); err != nil {
+			return err
+		}
+	}
+	if metadata := src.Spec.JobTemplate.Metadata; metadata.Labels != nil || metadata.Annotations != nil {
+		if err := saveToAnnotation(&dst.ObjectMeta, JobMetadataAnnotation, metadata); err != nil {
+			return err
+		}
+	}
+	if src.Spec.MetadataPropagation != nil {
+		if err := saveToAnnotation(&dst.ObjectMeta, MetadataPropagationAnnotation, src.Spec.MetadataPropagation); err != nil {
+			return err
+		}
+	}
+	if src.Spec.StaleJobsPolicy != nil {
+		if err := saveToAnnotation(&dst.ObjectMeta, StaleJobsPolicyAnnotation, src.Spec.StaleJobsPolicy); err != nil {
+			return err
+		}
+	}
+	options := jobOptions{
+		PodReplacementPolicy: src.Spec.JobTemplate.Spec.PodReplacementPolicy,
+		CompletionMode:       src.Spec.JobTemplate.Spec.CompletionMode,
+	}
+	if options != (jobOptions{}) {
+		if err := saveToAnnotation(&dst.ObjectMeta, JobOptionsAnnotation, options); err != nil {
+			return err
+		}
+	}
+	if rollout := src.Spec.Rollout; rollout != nil && (rollout.ActiveDeadlineSeconds != nil || rollout.BackoffLimit != nil) {
+		limits := fleetLimits{ActiveDeadlineSeconds: rollout.ActiveDeadlineSeconds, BackoffLimit: rollout.BackoffLimit}
+		if err := saveToAnnotation(&dst.ObjectMeta, FleetLimitsAnnotation, limits); err != nil {
+			return err
+		}
+	}
+
+	jobSpec := &src.Spec.JobTemplate.Spec
+	template := jobSpec.Template.DeepCopy()
+	template.Spec.NodeSelector = src.Spec.Nodes.NodeSelector
+	dst.Spec = DaemonJobSpec{
+		ActiveDeadlineSeconds:   jobSpec.ActiveDeadlineSeconds,
+		BackoffLimit:            jobSpec.BackoffLimit,
+		TTLSecondsAfterFinished: jobSpec.TTLSecondsAfterFinished,
+		Selector:                jobSpec.Selector,
+		ManualSelector:          jobSpec.ManualSelector,
+		Template:                *template,
+		NodeSelector:            src.Spec.Nodes.Selector,
+	}
+
+	if rollout := src.Spec.Rollout; rollout != nil {
+		dst.Spec.MaxParallel = rollout.MaxParallel
+		dst.Spec.RetryFailedNodes = rollout.RetryFailedNodes
+		if rollout.Canary != nil || rollout.Waves != nil {
+			dst.Spec.Rollout = &Rollout{Waves: rollout.Waves}
+			if rollout.Canary != nil {
+				dst.Spec.Rollout.Canary = &Canary{
+					Nodes:    rollout.Canary.Nodes,
+					Selector: rollout.Canary.Selector,
+				}
+			}
+		}
+		if rollout.MaxFailedNodes != nil {
+			dst.Spec.FailurePolicy = &FailurePolicy{MaxFailedNodes: rollout.MaxFailedNodes}
+		}
+	}
+
+	if src.Spec.Teardown != nil {
+		teardownTemplate := src.Spec.Teardown.Template
+		dst.Spec.TeardownTemplate = &teardownTemplate
+		dst.Spec.TeardownTimeoutSeconds = src.Spec.Teardown.TimeoutSeconds
+	}
+
+	dst.Status = nil
+	if !equality.Semantic.DeepEqual(src.Status, v2.DaemonJobStatus{}) {
+		dst.Status = convertStatusFrom(&src.Status)
+	}
+	return nil
+}
+
+// saveToAnnotation stores the JSON encoded value in the annotation.
+func saveToAnnotation(meta *metav1.ObjectMeta, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	// Annotations are shared with the converted object, so they are copied before being modified.
+	meta.Annotations = withoutAnnotation(meta.Annotations, key)
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[key] = string(data)
+	return nil
+}
+
+// restoreFromAnnotation decodes the value stored in the annotation, if any, and removes the annotation.
+func restoreFromAnnotation(meta *metav1.ObjectMeta, key string, value interface{}) error {
+	data, ok := meta.Annotations[key]
+	if !ok {
+		return nil
+	}
+	meta.Annotations = withoutAnnotation(meta.Annotations, key)
+	return json.Unmarshal([]byte(data), value)
+}
+
+// withoutAnnotation returns a copy of annotations without the given key, or nil when no annotation is left.
+func withoutAnnotation(annotations map[string]string, key string) map[string]string {
+	var copied map[string]string
+	for k, v := range annotations {
+		if k == key {
+			continue
+		}
+		if copied == nil {
+			copied = map[string]string{}
+		}
+		copied[k] = v
+	}
+	return copied
+}
+
+func convertStatusTo(src *DaemonJobStatus) v2.DaemonJobStatus {
+	dst := v2.DaemonJobStatus{
+		StartTime:       src.StartTime,
+		CompletionTime:  src.CompletionTime,
+		DesiredNodes:    src.DesiredNodes,
+		PendingNodes:    src.PendingNodes,
+		ActiveNodes:     src.Active,
+		SucceededNodes:  src.Succeeded,
+		FailedNodes:     src.Failed,
+		FailedNodeNames: src.FailedNodes,
+	}
+	for _, c := range src.Conditions {
+		dst.Conditions = append(dst.Conditions, v2.DaemonJobCondition{
+			Type:               v2.DaemonJobConditionType(c.Type),
+			Status:             c.Status,
+			LastProbeTime:      c.LastProbeTime,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		})
+	}
+	for _, n := range src.Nodes {
+		dst.Nodes = append(dst.Nodes, v2.NodeStatus{
+			Name:      n.Name,
+			Phase:     v2.NodePhase(n.Phase),
+			Job:       n.Job,
+			Retries:   n.Retries,
+			Overrides: n.Overrides,
+			Pod:       n.Pod,
+			Restarts:  n.Restarts,
+			Reason:    n.Reason,
+			Message:   n.Message,
+		})
+	}
+	if src.Rollout != nil {
+		dst.Rollout = &v2.RolloutStatus{
+			CurrentWave: src.Rollout.CurrentWave,
+			Halted:      src.Rollout.Halted,
+		}
+		for _, w := range src.Rollout.Waves {
+			dst.Rollout.Waves = append(dst.Rollout.Waves, v2.WaveStatus{
+				Name:        w.Name,
+				Phase:       v2.WavePhase(w.Phase),
+				Nodes:       w.Nodes,
+				Active:      w.Active,
+				Succeeded:   w.Succeeded,
+				Failed:      w.Failed,
+				Unavailable: w.Unavailable,
+			})
+		}
+	}
+	return dst
+}
+
+func convertStatusFrom(src *v2.DaemonJobStatus) *DaemonJobStatus {
+	dst := &DaemonJobStatus{
+		JobStatus: batchv1.JobStatus{
+			StartTime:      src.StartTime,
+			CompletionTime: src.CompletionTime,
+			Active:         src.ActiveNodes,
+			Succeeded:      src.SucceededNodes,
+			Failed:         src.FailedNodes,
+		},
+		DesiredNodes: src.DesiredNodes,
+		PendingNodes: src.PendingNodes,
+		FailedNodes:  src.FailedNodeNames,
+	}
+	for _, c := range src.Conditions {
+		dst.Conditions = append(dst.Conditions, batchv1.JobCondition{
+			Type:               batchv1.JobConditionType(c.Type),
+			Status:             c.Status,
+			LastProbeTime:      c.LastProbeTime,
+			LastTransitionTime: c.LastTransitionTime,
+			Reason:             c.Reason,
+			Message:            c.Message,
+		})
+	}
+	for _, n := range src.Nodes {
+		dst.Nodes = append(dst.Nodes, NodeStatus{
+			Name:      n.Name,
+			Phase:     NodePhase(n.Phase),
+			Job:       n.Job,
+			Retries:   n.Retries,
+			Overrides: n.Overrides,
+			Pod:       n.Pod,
+			Restarts:  n.Restarts,
+			Reason:    n.Reason,
+			Message:   n.Message,
+		})
+	}
+	if src.Rollout != nil {
+		dst.Rollout = &RolloutStatus{
+			CurrentWave: src.Rollout.CurrentWave,
+			Halted:      src.Rollout.Halted,
+		}
+		for _, w := range src.Rollout.Waves {
+			dst.Rollout.Waves = append(dst.Rollout.Waves, WaveStatus{
+				Name:        w.Name,
+				Phase:       WavePhase(w.Phase),
+				Nodes:       w.Nodes,
+				Active:      w.Active,
+				Succeeded:   w.Succeeded,
+				Failed:      w.Failed,
+				Unavailable: w.Unavailable,
+			})
+		}
+	}
+	return dst
+}
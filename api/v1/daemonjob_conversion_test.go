@@ -0,0 +1,212 @@
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	v2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func getTestDaemonJob() *DaemonJob {
+	var deadline int64 = 100
+	var backoffLimit int32 = 2
+	var teardownTimeout int64 = 60
+	maxParallel := intstr.FromString("50%")
+	maxFailedNodes := intstr.FromInt(2)
+	canaryNodes := intstr.FromInt(1)
+	now := metav1.Now()
+	return &DaemonJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "test-daemonjob",
+			Labels:    map[string]string{"app": "test"},
+		},
+		Spec: DaemonJobSpec{
+			ActiveDeadlineSeconds: &deadline,
+			BackoffLimit:          &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "test"},
+				},
+				Spec: corev1.PodSpec{
+					Containers:    []corev1.Container{{Name: "test-container", Image: "test-image"}},
+					NodeSelector:  map[string]string{"role": "worker"},
+					RestartPolicy: corev1.RestartPolicyOnFailure,
+				},
+			},
+			NodeSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "gpu", Operator: metav1.LabelSelectorOpDoesNotExist}},
+			},
+			MaxParallel: &maxParallel,
+			Rollout: &Rollout{
+				Canary: &Canary{Nodes: &canaryNodes},
+				Waves:  []intstr.IntOrString{intstr.FromString("25%")},
+			},
+			FailurePolicy:    &FailurePolicy{MaxFailedNodes: &maxFailedNodes},
+			RetryFailedNodes: "1",
+			TeardownTemplate: &corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers:    []corev1.Container{{Name: "teardown-container", Image: "teardown-image"}},
+					RestartPolicy: corev1.RestartPolicyNever,
+				},
+			},
+			TeardownTimeoutSeconds: &teardownTimeout,
+		},
+		Status: &DaemonJobStatus{
+			JobStatus: batchv1.JobStatus{
+				Conditions: []batchv1.JobCondition{{
+					Type: batchv1.JobFailed, Status: corev1.ConditionTrue, LastTransitionTime: now,
+					Reason: "CanaryFailed", Message: "Canary nodes failed, rollout halted",
+				}},
+				StartTime: &now,
+				Active:    1,
+				Succeeded: 2,
+				Failed:    1,
+			},
+			DesiredNodes: 5,
+			PendingNodes: 1,
+			FailedNodes:  []string{"node-c"},
+			Nodes: []NodeStatus{
+				{Name: "node-a", Phase: NodeRunning, Job: "test-daemonjob-a", Retries: 1, Pod: "test-daemonjob-a-x7k2p", Restarts: 2,
+					Reason: "ImagePullBackOff", Message: "Back-off pulling image \"busybox:missing\""},
+				{Name: "node-c", Phase: NodeFailed, Job: "test-daemonjob-c"},
+			},
+			Rollout: &RolloutStatus{
+				CurrentWave: "canary",
+				Halted:      true,
+				Waves:       []WaveStatus{{Name: "canary", Phase: WaveFailed, Nodes: 2, Failed: 1, Unavailable: 1}},
+			},
+		},
+	}
+}
+
+func TestConvertTo(t *testing.T) {
+	instance := getTestDaemonJob()
+	hub := &v2.DaemonJob{}
+	require.NoError(t, instance.ConvertTo(hub))
+
+	assert.Equal(t, instance.ObjectMeta, hub.ObjectMeta)
+	assert.Equal(t, map[string]string{"role": "worker"}, hub.Spec.Nodes.NodeSelector)
+	assert.Equal(t, instance.Spec.NodeSelector, hub.Spec.Nodes.Selector)
+	assert.Nil(t, hub.Spec.JobTemplate.Spec.Template.Spec.NodeSelector)
+	assert.Equal(t, instance.Spec.BackoffLimit, hub.Spec.JobTemplate.Spec.BackoffLimit)
+	require.NotNil(t, hub.Spec.Rollout)
+	assert.Equal(t, instance.Spec.MaxParallel, hub.Spec.Rollout.MaxParallel)
+	assert.Equal(t, instance.Spec.FailurePolicy.MaxFailedNodes, hub.Spec.Rollout.MaxFailedNodes)
+	assert.Equal(t, "1", hub.Spec.Rollout.RetryFailedNodes)
+	require.NotNil(t, hub.Spec.Teardown)
+	assert.Equal(t, *instance.Spec.TeardownTemplate, hub.Spec.Teardown.Template)
+	assert.Equal(t, int32(1), hub.Status.ActiveNodes)
+	assert.Equal(t, int32(2), hub.Status.SucceededNodes)
+	assert.Equal(t, int32(1), hub.Status.FailedNodes)
+	assert.Equal(t, []string{"node-c"}, hub.Status.FailedNodeNames)
+	assert.Equal(t, v2.DaemonJobFailed, hub.Status.Conditions[0].Type)
+
+	// The source is left untouched.
+	assert.Equal(t, getTestDaemonJob().Spec, instance.Spec)
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	t.Run("should keep v1 DaemonJob", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		hub := &v2.DaemonJob{}
+		require.NoError(t, instance.ConvertTo(hub))
+		converted := &DaemonJob{}
+		require.NoError(t, converted.ConvertFrom(hub))
+		assert.Equal(t, instance, converted)
+	})
+
+	t.Run("should keep DaemonJob without optional fields", func(t *testing.T) {
+		instance := &DaemonJob{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "test-daemonjob"},
+			Spec: DaemonJobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "test-container", Image: "test-image"}}},
+				},
+			},
+		}
+		hub := &v2.DaemonJob{}
+		require.NoError(t, instance.ConvertTo(hub))
+		assert.Nil(t, hub.Spec.Rollout)
+		assert.Nil(t, hub.Spec.Teardown)
+		converted := &DaemonJob{}
+		require.NoError(t, converted.ConvertFrom(hub))
+		assert.Equal(t, instance, converted)
+	})
+
+	t.Run("should keep v2 DaemonJob", func(t *testing.T) {
+		hub := &v2.DaemonJob{}
+		require.NoError(t, getTestDaemonJob().ConvertTo(hub))
+		spoke := &DaemonJob{}
+		require.NoError(t, spoke.ConvertFrom(hub))
+		converted := &v2.DaemonJob{}
+		require.NoError(t, spoke.ConvertTo(converted))
+		assert.Equal(t, hub, converted)
+	})
+
+	t.Run("should keep v2 only fields of v2 DaemonJob", func(t *testing.T) {
+		hub := &v2.DaemonJob{}
+		require.NoError(t, getTestDaemonJob().ConvertTo(hub))
+		hub.Spec.TemplateRef = &v2.TemplateReference{Name: "test-template", Parameters: map[string]string{"image": "test-image"}}
+		hub.Spec.Overrides = []v2.Override{{
+			Name:       "arm64",
+			Selector:   metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/arch": "arm64"}},
+			Containers: []v2.ContainerOverride{{Name: "test-container", Image: "test-image-arm64"}},
+		}}
+		hub.Spec.JobTemplate.Metadata = v2.JobMetadata{Labels: map[string]string{"team": "platform"}}
+		hub.Spec.MetadataPropagation = &v2.MetadataPropagation{Annotations: v2.PropagateToJobsAndPods}
+		replacementPolicy, completionMode := v2.ReplaceFailed, v2.IndexedCompletion
+		hub.Spec.JobTemplate.Spec.PodReplacementPolicy = &replacementPolicy
+		hub.Spec.JobTemplate.Spec.CompletionMode = &completionMode
+		var deadline int64 = 3600
+		hub.Spec.Rollout = &v2.Rollout{ActiveDeadlineSeconds: &deadline}
+		staleJobsPolicy := v2.RetainStaleJobs
+		hub.Spec.StaleJobsPolicy = &staleJobsPolicy
+		spoke := &DaemonJob{}
+		require.NoError(t, spoke.ConvertFrom(hub))
+		assert.Equal(t, `{"name":"test-template","parameters":{"image":"test-image"}}`, spoke.Annotations[TemplateRefAnnotation])
+		assert.Contains(t, spoke.Annotations, OverridesAnnotation)
+		assert.Equal(t, `{"labels":{"team":"platform"}}`, spoke.Annotations[JobMetadataAnnotation])
+		assert.Equal(t, `{"annotations":"JobsAndPods"}`, spoke.Annotations[MetadataPropagationAnnotation])
+		assert.Equal(t, `{"podReplacementPolicy":"Failed","completionMode":"Indexed"}`, spoke.Annotations[JobOptionsAnnotation])
+		assert.Equal(t, `{"activeDeadlineSeconds":3600}`, spoke.Annotations[FleetLimitsAnnotation])
+		assert.Equal(t, `"Retain"`, spoke.Annotations[StaleJobsPolicyAnnotation])
+		assert.Nil(t, hub.Annotations)
+		converted := &v2.DaemonJob{}
+		require.NoError(t, spoke.ConvertTo(converted))
+		assert.Equal(t, hub, converted)
+	})
+}
+
+func TestWebhooksUseHub(t *testing.T) {
+	t.Run("should default v1 DaemonJob", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.BackoffLimit = nil
+		instance.Spec.Template.Spec.RestartPolicy = ""
+		instance.Default()
+
+		require.NotNil(t, instance.Spec.BackoffLimit)
+		assert.Equal(t, int32(6), *instance.Spec.BackoffLimit)
+		assert.Equal(t, corev1.RestartPolicyOnFailure, instance.Spec.Template.Spec.RestartPolicy)
+		assert.Equal(t, map[string]string{"role": "worker"}, instance.Spec.Template.Spec.NodeSelector)
+	})
+
+	t.Run("should validate v1 DaemonJob", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		assert.NoError(t, instance.ValidateCreate())
+		assert.NoError(t, instance.ValidateUpdate(getTestDaemonJob()))
+
+		instance.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+		err := instance.ValidateCreate()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "restartPolicy")
+		assert.Error(t, instance.ValidateUpdate(getTestDaemonJob()))
+	})
+}
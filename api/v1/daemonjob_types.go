@@ -20,6 +20,7 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // DaemonJobSpec defines the desired state of DaemonJob
@@ -44,6 +45,7 @@ type DaemonJobSpec struct {
 	// the Job becomes eligible to be deleted immediately after it finishes.
 	// This field is alpha-level and is only honored by servers that enable the
 	// TTLAfterFinished feature.
+	// Not applied to Jobs of nodes, as removing a finished Job would run its node again.
 	// +optional
 	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty" protobuf:"varint,8,opt,name=ttlSecondsAfterFinished"`
 
@@ -67,20 +69,244 @@ type DaemonJobSpec struct {
 	// `manualSelector=true` in jobs that were created with the old `extensions/v1beta1`
 	// API.
 	// More info: https://kubernetes.io/docs/concepts/workloads/controllers/jobs-run-to-completion/#specifying-your-own-pod-selector
+	// Neither selector nor manualSelector are applied to Jobs of nodes, as one selector would match pods of every node.
 	// +optional
 	ManualSelector *bool `json:"manualSelector,omitempty" protobuf:"varint,5,opt,name=manualSelector"`
+
+	// A label query over nodes that run the job, e.g. "role in (worker, edge), !gpu".
+	// When the pod template sets nodeSelector as well, nodes have to match both.
+	// Pods are constrained to matching nodes as well.
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+
+	// The maximum number of nodes that can run the job at the same time.
+	// Value can be an absolute number (ex: 5) or a percentage of targeted nodes (ex: 10%).
+	// Absolute number is calculated from percentage by rounding up, but is never lower than 1.
+	// Every targeted node still runs exactly one pod; remaining nodes wait until
+	// a running node finishes.
+	// Defaults to all targeted nodes at once.
+	// +optional
+	MaxParallel *intstr.IntOrString `json:"maxParallel,omitempty"`
+
+	// Rollout describes how the job is rolled out across targeted nodes.
+	// When unset, all targeted nodes are treated as a single wave.
+	// +optional
+	Rollout *Rollout `json:"rollout,omitempty"`
+
+	// FailurePolicy describes when the run across targeted nodes is considered failed.
+	// +optional
+	FailurePolicy *FailurePolicy `json:"failurePolicy,omitempty"`
+
+	// Changing this value starts a follow-up run on nodes where the job failed, using the same template.
+	// Nodes that succeeded are not run again. Any unique value works, e.g. the current timestamp.
+	// +optional
+	RetryFailedNodes string `json:"retryFailedNodes,omitempty"`
+
+	// Describes the pod that runs once on every node the job ran on when the DaemonJob is deleted.
+	// Deletion waits for teardown to finish, up to teardownTimeoutSeconds,
+	// unless the DaemonJob is annotated with dj.dysproz.io/force-remove.
+	// +optional
+	TeardownTemplate *corev1.PodTemplateSpec `json:"teardownTemplate,omitempty"`
+
+	// Specifies how long, in seconds since the deletion of the DaemonJob was requested,
+	// deletion waits for teardown before giving up. Defaults to 600 seconds.
+	// +optional
+	TeardownTimeoutSeconds *int64 `json:"teardownTimeoutSeconds,omitempty"`
+}
+
+// FailurePolicy describes the failure budget of a DaemonJob.
+type FailurePolicy struct {
+	// The number of failed nodes after which no more nodes are started and the DaemonJob is marked failed.
+	// Value can be an absolute number (ex: 5) or a percentage of targeted nodes (ex: 10%),
+	// calculated by rounding up, but is never lower than 1.
+	// Nodes that are already running are left to finish and nodes that have not started are left untouched.
+	// Defaults to no limit.
+	// +optional
+	MaxFailedNodes *intstr.IntOrString `json:"maxFailedNodes,omitempty"`
+}
+
+// Rollout splits targeted nodes into consecutive waves.
+// A wave starts only after every node of the previous wave has finished.
+type Rollout struct {
+	// Canary nodes run the job before the rest of the fleet.
+	// The rest of the fleet starts only after every canary node succeeded,
+	// and the rollout halts if any canary node fails.
+	// +optional
+	Canary *Canary `json:"canary,omitempty"`
+
+	// Sizes of consecutive waves the remaining nodes are rolled out in.
+	// Each size can be an absolute number (ex: 5) or a percentage of non-canary nodes (ex: 10%),
+	// calculated by rounding up. Nodes not covered by listed waves form the last wave.
+	// +optional
+	Waves []intstr.IntOrString `json:"waves,omitempty"`
+}
+
+// Canary selects nodes that run the job first.
+type Canary struct {
+	// Number of canary nodes. Value can be an absolute number (ex: 1) or a percentage of
+	// targeted nodes (ex: 5%), calculated by rounding up.
+	// When selector is set as well, it limits the number of matching nodes used as canaries.
+	// Defaults to all matching nodes when selector is set, and to 1 otherwise.
+	// +optional
+	Nodes *intstr.IntOrString `json:"nodes,omitempty"`
+
+	// A label query over targeted nodes that selects canary nodes.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// NodePhase is the phase of the job on a single node.
+type NodePhase string
+
+const (
+	// NodePending means the node cannot start a pod of the job yet, the reason tells why.
+	NodePending NodePhase = "Pending"
+	// NodeRunning means the Job of the node has not finished yet.
+	NodeRunning NodePhase = "Running"
+	// NodeSucceeded means the Job of the node succeeded.
+	NodeSucceeded NodePhase = "Succeeded"
+	// NodeFailed means the Job of the node failed.
+	NodeFailed NodePhase = "Failed"
+)
+
+// NodeStatus describes the progress of the job on a single node.
+type NodeStatus struct {
+	// Name of the node.
+	Name string `json:"name"`
+
+	// Phase of the job on the node.
+	Phase NodePhase `json:"phase"`
+
+	// Name of the latest Job created for the node, empty while the node is pending.
+	Job string `json:"job"`
+
+	// The number of times the node was retried after failing.
+	// +optional
+	Retries int32 `json:"retries,omitempty"`
+
+	// Names of overrides applied to the pod of the node. Overrides are set in dj.dysproz.io/v2.
+	// +optional
+	Overrides []string `json:"overrides,omitempty"`
+
+	// Name of the latest pod of the Job.
+	// +optional
+	Pod string `json:"pod,omitempty"`
+
+	// The number of times containers of the pod restarted.
+	// +optional
+	Restarts int32 `json:"restarts,omitempty"`
+
+	// A brief CamelCase reason why the node or its pod does not make progress,
+	// e.g. NotReady, UntoleratedTaint, ImagePullBackOff or CrashLoopBackOff.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// A human readable message with details about the reason.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// WavePhase is the phase of a rollout wave.
+type WavePhase string
+
+const (
+	// WavePending means no node of the wave has started yet.
+	WavePending WavePhase = "Pending"
+	// WaveRunning means some nodes of the wave have started and not every node has finished.
+	WaveRunning WavePhase = "Running"
+	// WaveSucceeded means every node of the wave succeeded.
+	WaveSucceeded WavePhase = "Succeeded"
+	// WaveFailed means every node of the wave finished and at least one of them failed.
+	WaveFailed WavePhase = "Failed"
+)
+
+// WaveStatus describes the progress of a single rollout wave.
+type WaveStatus struct {
+	// Name of the wave: "canary" or "wave-<n>".
+	Name string `json:"name"`
+
+	// Phase of the wave.
+	Phase WavePhase `json:"phase"`
+
+	// The number of nodes in the wave.
+	Nodes int32 `json:"nodes"`
+
+	// The number of nodes of the wave currently running.
+	// +optional
+	Active int32 `json:"active,omitempty"`
+
+	// The number of nodes of the wave that succeeded.
+	// +optional
+	Succeeded int32 `json:"succeeded,omitempty"`
+
+	// The number of nodes of the wave that failed.
+	// +optional
+	Failed int32 `json:"failed,omitempty"`
+
+	// The number of nodes of the wave that cannot start a pod, e.g. NotReady or cordoned nodes.
+	// They do not hold back later waves.
+	// +optional
+	Unavailable int32 `json:"unavailable,omitempty"`
+}
+
+// RolloutStatus describes the progress of the rollout.
+type RolloutStatus struct {
+	// Name of the wave currently rolled out.
+	// +optional
+	CurrentWave string `json:"currentWave,omitempty"`
+
+	// Halted is true when the rollout stopped because a canary node failed
+	// or the failure budget was exceeded.
+	// +optional
+	Halted bool `json:"halted,omitempty"`
+
+	// Progress of every wave in rollout order.
+	// +optional
+	Waves []WaveStatus `json:"waves,omitempty"`
+}
+
+// DaemonJobStatus defines the observed state of DaemonJob.
+// Active, Succeeded and Failed count nodes rather than pods.
+type DaemonJobStatus struct {
+	batchv1.JobStatus `json:",inline"`
+
+	// The number of nodes targeted by the DaemonJob.
+	// +optional
+	DesiredNodes int32 `json:"desiredNodes,omitempty"`
+
+	// The number of targeted nodes that have not started yet because of maxParallel.
+	// +optional
+	PendingNodes int32 `json:"pendingNodes,omitempty"`
+
+	// Names of nodes on which the job failed.
+	// +optional
+	FailedNodes []string `json:"failedNodes,omitempty"`
+
+	// Progress of the job on every node it has started on.
+	// +optional
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+
+	// Progress of the rollout, set when spec.rollout is used.
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Desired",type=integer,JSONPath=`.status.desiredNodes`
+// +kubebuilder:printcolumn:name="Active",type=integer,JSONPath=`.status.active`
+// +kubebuilder:printcolumn:name="Succeeded",type=integer,JSONPath=`.status.succeeded`
+// +kubebuilder:printcolumn:name="Failed",type=integer,JSONPath=`.status.failed`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
-// DaemonJob is the Schema for the daemonjobs API
+// DaemonJob is the Schema for the daemonjobs API.
+// It is served for existing clients and converted to v2, which is the storage version.
 type DaemonJob struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   DaemonJobSpec      `json:"spec,omitempty"`
-	Status *batchv1.JobStatus `json:"status,omitempty"`
+	Spec   DaemonJobSpec    `json:"spec,omitempty"`
+	Status *DaemonJobStatus `json:"status,omitempty"`
 }
 
 // +kubebuilder:object:root=true
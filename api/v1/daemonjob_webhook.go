@@ -0,0 +1,77 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+
+	v2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// SetupWebhookWithManager registers DaemonJob webhooks in the manager.
+// Defaulting and validation are done by the v2 webhooks on the converted object.
+func (r *DaemonJob) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-dj-dysproz-io-v1-daemonjob,mutating=true,failurePolicy=fail,groups=dj.dysproz.io,resources=daemonjobs,verbs=create;update,versions=v1,name=mdaemonjob.dj.dysproz.io
+
+var _ webhook.Defaulter = &DaemonJob{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *DaemonJob) Default() {
+	hub := &v2.DaemonJob{}
+	if err := r.ConvertTo(hub); err != nil {
+		return
+	}
+	hub.Default()
+	_ = r.ConvertFrom(hub)
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-dj-dysproz-io-v1-daemonjob,mutating=false,failurePolicy=fail,groups=dj.dysproz.io,resources=daemonjobs,versions=v1,name=vdaemonjob.dj.dysproz.io
+
+var _ webhook.Validator = &DaemonJob{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJob) ValidateCreate() error {
+	hub := &v2.DaemonJob{}
+	if err := r.ConvertTo(hub); err != nil {
+		return err
+	}
+	return hub.ValidateCreate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJob) ValidateUpdate(old runtime.Object) error {
+	hub, oldHub := &v2.DaemonJob{}, &v2.DaemonJob{}
+	if err := r.ConvertTo(hub); err != nil {
+		return err
+	}
+	if err := old.(*DaemonJob).ConvertTo(oldHub); err != nil {
+		return err
+	}
+	return hub.ValidateUpdate(oldHub)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJob) ValidateDelete() error {
+	return nil
+}
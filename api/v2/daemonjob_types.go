@@ -0,0 +1,620 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// DaemonJobNameLabel is set on every Job and pod created for a DaemonJob and holds the DaemonJob name.
+	DaemonJobNameLabel = "dj.dysproz.io/name"
+
+	// DaemonJobRunLabel is set on every Job and pod created for a DaemonJob, next to DaemonJobNameLabel,
+	// and holds the ID of the run the Job or pod belongs to. Pod anti-affinity on both labels keeps
+	// pods of one run apart.
+	DaemonJobRunLabel = "dj.dysproz.io/run"
+
+	// NodeNameAnnotation is set on every Job and pod created for a DaemonJob and holds the name of the node
+	// the Job runs on. Node names may be longer than a label value allows, hence an annotation.
+	NodeNameAnnotation = "dj.dysproz.io/node"
+
+	// TemplateHashAnnotation holds the hash of the Job spec generated for a node, on the Job and its pods.
+	// A Job whose hash differs from the current one is replaced.
+	TemplateHashAnnotation = "dj.dysproz.io/template-hash"
+
+	// RetryAnnotation holds the number of times the node was retried before the Job was created.
+	RetryAnnotation = "dj.dysproz.io/retry"
+
+	// RetryFailedNodesAnnotation holds the value of spec.rollout.retryFailedNodes at the time the Job was created.
+	RetryFailedNodesAnnotation = "dj.dysproz.io/retry-failed-nodes"
+
+	// OverridesAnnotation holds the comma separated names of overrides applied to the Job of a node.
+	OverridesAnnotation = "dj.dysproz.io/overrides"
+
+	// StaleAnnotation is set on stale Jobs retained by spec.staleJobsPolicy.
+	StaleAnnotation = "dj.dysproz.io/stale"
+
+	// TeardownLabel is set on Jobs running the teardown template.
+	TeardownLabel = "dj.dysproz.io/teardown"
+
+	// TeardownFinalizer keeps a DaemonJob with a teardown template until teardown has finished.
+	TeardownFinalizer = "dj.dysproz.io/teardown"
+
+	// ForceRemoveAnnotation set on a DaemonJob being deleted releases it without waiting for teardown.
+	ForceRemoveAnnotation = "dj.dysproz.io/force-remove"
+
+	// ShardLabel set on a DaemonJob assigns it to a manager replica by its value instead of its namespace and name,
+	// so DaemonJobs with the same value are reconciled by the same replica when sharding is enabled.
+	ShardLabel = "dj.dysproz.io/shard"
+)
+
+// reservedKeys are label and annotation keys set by the controller and the Job controller.
+var reservedKeys = []string{"controller-uid", "job-name"}
+
+// reservedPrefixes are prefixes of label and annotation keys set by the controller and the Job controller.
+var reservedPrefixes = []string{"dj.dysproz.io/", "batch.kubernetes.io/"}
+
+// IsReservedKey tells whether a label or annotation key is managed by the controller or the Job controller.
+// Such keys are never propagated and cannot be set in Job or pod metadata.
+func IsReservedKey(key string) bool {
+	for _, reserved := range reservedKeys {
+		if key == reserved {
+			return true
+		}
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// DaemonJobSpec defines the desired state of DaemonJob
+type DaemonJobSpec struct {
+	// Nodes selects the nodes the job runs on.
+	// +optional
+	Nodes NodeTargeting `json:"nodes,omitempty"`
+
+	// JobTemplate describes the Job created on every targeted node.
+	JobTemplate JobTemplateSpec `json:"jobTemplate"`
+
+	// TemplateRef takes the pod template from a DaemonJobTemplate in the same namespace
+	// instead of spec.jobTemplate.spec.template. The job runs again when the DaemonJobTemplate changes.
+	// +optional
+	TemplateRef *TemplateReference `json:"templateRef,omitempty"`
+
+	// Rollout describes how the job is rolled out across targeted nodes.
+	// When unset, all targeted nodes run at once.
+	// +optional
+	Rollout *Rollout `json:"rollout,omitempty"`
+
+	// Teardown describes the pod that runs once on every node the job ran on when the DaemonJob is deleted.
+	// +optional
+	Teardown *Teardown `json:"teardown,omitempty"`
+
+	// Overrides patch the pod template on groups of nodes, e.g. a different image on arm64 nodes.
+	// Every override matching a node is applied in order, so later overrides win.
+	// +optional
+	Overrides []Override `json:"overrides,omitempty"`
+
+	// MetadataPropagation describes how labels and annotations of the DaemonJob are propagated to Jobs and pods.
+	// Changing what reaches pods runs the job again, as pod templates of Jobs cannot be changed.
+	// +optional
+	MetadataPropagation *MetadataPropagation `json:"metadataPropagation,omitempty"`
+
+	// StaleJobsPolicy specifies what happens to Jobs carrying labels of the DaemonJob that it cannot adopt,
+	// e.g. the single Job of earlier versions or Jobs left behind by a previous DaemonJob of the same name.
+	// Defaults to Delete.
+	// +optional
+	StaleJobsPolicy *StaleJobsPolicy `json:"staleJobsPolicy,omitempty"`
+}
+
+// StaleJobsPolicy specifies what happens to stale Jobs of a DaemonJob.
+// +kubebuilder:validation:Enum=Delete;Retain
+type StaleJobsPolicy string
+
+const (
+	// DeleteStaleJobs deletes stale Jobs together with their pods.
+	DeleteStaleJobs StaleJobsPolicy = "Delete"
+	// RetainStaleJobs keeps stale Jobs and marks them with StaleAnnotation.
+	RetainStaleJobs StaleJobsPolicy = "Retain"
+)
+
+// Override patches containers of the pod template on nodes matching the selector.
+type Override struct {
+	// Name of the override, reported in the status of nodes it is applied to.
+	Name string `json:"name"`
+
+	// A label query over targeted nodes the override is applied to.
+	Selector metav1.LabelSelector `json:"selector"`
+
+	// Patches of containers of the pod template.
+	Containers []ContainerOverride `json:"containers"`
+}
+
+// ContainerOverride is a partial patch of a container of the pod template.
+type ContainerOverride struct {
+	// Name of the patched container or init container.
+	Name string `json:"name"`
+
+	// Image replacing the image of the container.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Resource requests and limits set on the container. Resources not listed here are kept.
+	// +optional
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Environment variables set on the container. Variables with the same name are replaced.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// Arguments replacing the arguments of the container.
+	// +optional
+	Args []string `json:"args,omitempty"`
+}
+
+// NodeTargeting selects the nodes a DaemonJob runs on.
+type NodeTargeting struct {
+	// Only nodes with all of these labels run the job. Defaults to all nodes.
+	// +optional
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+
+	// A label query over nodes, e.g. "role in (worker, edge), !gpu".
+	// When set together with nodeSelector, nodes have to match both.
+	// Pods are constrained to matching nodes as well, so a node whose labels
+	// stop matching before its pod is scheduled does not run the job.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// TemplateReference refers to a DaemonJobTemplate.
+type TemplateReference struct {
+	// Name of the DaemonJobTemplate.
+	Name string `json:"name"`
+
+	// Values of the template parameters.
+	// +optional
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// JobTemplateSpec describes the Job created on every targeted node.
+type JobTemplateSpec struct {
+	// Labels and annotations of the Job.
+	// +optional
+	Metadata JobMetadata `json:"metadata,omitempty"`
+
+	// Specification of the Job. The pod template must not set nodeSelector, use spec.nodes instead.
+	Spec JobSpec `json:"spec"`
+}
+
+// JobMetadata holds labels and annotations set on every Job created for the DaemonJob.
+// Keys with a reserved prefix, e.g. dj.dysproz.io/, are managed by the controller and cannot be set.
+type JobMetadata struct {
+	// Labels of the Job. They override labels propagated from the DaemonJob.
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Annotations of the Job. They override annotations propagated from the DaemonJob.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// PropagationPolicy tells where labels or annotations of the DaemonJob are copied to.
+// +kubebuilder:validation:Enum=None;Jobs;JobsAndPods
+type PropagationPolicy string
+
+const (
+	// PropagateNone keeps metadata on the DaemonJob only.
+	PropagateNone PropagationPolicy = "None"
+	// PropagateToJobs copies metadata to Jobs.
+	PropagateToJobs PropagationPolicy = "Jobs"
+	// PropagateToJobsAndPods copies metadata to Jobs and their pods.
+	PropagateToJobsAndPods PropagationPolicy = "JobsAndPods"
+)
+
+// MetadataPropagation describes how labels and annotations of the DaemonJob are propagated.
+// Keys with a reserved prefix and kubectl.kubernetes.io/ annotations are never propagated.
+type MetadataPropagation struct {
+	// Where labels of the DaemonJob are copied to. Defaults to Jobs.
+	// +optional
+	Labels PropagationPolicy `json:"labels,omitempty"`
+
+	// Where annotations of the DaemonJob are copied to. Defaults to None.
+	// +optional
+	Annotations PropagationPolicy `json:"annotations,omitempty"`
+}
+
+// JobSpec is the part of a batch/v1 JobSpec that applies to the Job of a single node.
+// Parallelism and completions are always 1, as every node runs exactly one pod.
+type JobSpec struct {
+	// Specifies the duration in seconds relative to the start of the Job of a node that the Job
+	// may be active before the system tries to terminate it; value must be positive integer.
+	// It applies to every node separately, see spec.rollout.activeDeadlineSeconds for the whole fleet.
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+
+	// Specifies the number of retries on a node before marking the node failed.
+	// It applies to every node separately, see spec.rollout.backoffLimit for the whole fleet.
+	// Defaults to 6
+	// +optional
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+
+	// Specifies when the Job of a node that has to run again, e.g. after a template change,
+	// is created. Defaults to TerminatingOrFailed.
+	// +optional
+	PodReplacementPolicy *PodReplacementPolicy `json:"podReplacementPolicy,omitempty"`
+
+	// Specifies how pods of nodes are told apart. With Indexed every pod gets the index of its node,
+	// which stays the same while the node is targeted. Defaults to NonIndexed.
+	// +optional
+	CompletionMode *CompletionMode `json:"completionMode,omitempty"`
+
+	// Not applied to Jobs of nodes: a finished Job records that its node ran,
+	// so removing it would run the node again. Kept for compatibility.
+	// +optional
+	TTLSecondsAfterFinished *int32 `json:"ttlSecondsAfterFinished,omitempty"`
+
+	// Not applied to Jobs of nodes: a selector shared by all of them would match pods of every node,
+	// so every Job gets the selector generated by the Job controller. Kept for compatibility.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Not applied to Jobs of nodes, see selector. Kept for compatibility.
+	// +optional
+	ManualSelector *bool `json:"manualSelector,omitempty"`
+
+	// Describes the pod that will be created when executing a job.
+	// With spec.templateRef only labels and annotations may be set, and they are added to the referenced template.
+	// More info: https://kubernetes.io/docs/concepts/workloads/controllers/jobs-run-to-completion/
+	// +optional
+	Template corev1.PodTemplateSpec `json:"template,omitempty"`
+}
+
+// PodReplacementPolicy specifies when the pod of a node that has to run again is created.
+// +kubebuilder:validation:Enum=TerminatingOrFailed;Failed
+type PodReplacementPolicy string
+
+const (
+	// ReplaceTerminatingOrFailed creates the replacement as soon as the previous Job of the node is gone,
+	// even when its pod is still terminating.
+	ReplaceTerminatingOrFailed PodReplacementPolicy = "TerminatingOrFailed"
+	// ReplaceFailed creates the replacement only once every previous pod on the node has terminated,
+	// so that pods of two runs never run on a node at the same time.
+	ReplaceFailed PodReplacementPolicy = "Failed"
+)
+
+// CompletionMode specifies how pods of nodes are told apart.
+// +kubebuilder:validation:Enum=NonIndexed;Indexed
+type CompletionMode string
+
+const (
+	// NonIndexedCompletion gives no index to pods.
+	NonIndexedCompletion CompletionMode = "NonIndexed"
+	// IndexedCompletion gives every pod the index of its node, in the JOB_COMPLETION_INDEX
+	// environment variable and the batch.kubernetes.io/job-completion-index annotation.
+	// A node keeps its index as long as it is targeted, new nodes get the lowest free indexes
+	// in order of names.
+	IndexedCompletion CompletionMode = "Indexed"
+)
+
+// Rollout describes how the job is rolled out across targeted nodes.
+type Rollout struct {
+	// The maximum number of nodes that can run the job at the same time.
+	// Value can be an absolute number (ex: 5) or a percentage of targeted nodes (ex: 10%).
+	// Absolute number is calculated from percentage by rounding up, but is never lower than 1.
+	// Defaults to all targeted nodes at once.
+	// +optional
+	MaxParallel *intstr.IntOrString `json:"maxParallel,omitempty"`
+
+	// Canary nodes run the job before the rest of the fleet.
+	// The rest of the fleet starts only after every canary node succeeded,
+	// and the rollout halts if any canary node fails.
+	// +optional
+	Canary *Canary `json:"canary,omitempty"`
+
+	// Sizes of consecutive waves the remaining nodes are rolled out in.
+	// A wave starts only after every node of the previous wave has finished.
+	// Each size can be an absolute number (ex: 5) or a percentage of non-canary nodes (ex: 10%),
+	// calculated by rounding up. Nodes not covered by listed waves form the last wave.
+	// +optional
+	Waves []intstr.IntOrString `json:"waves,omitempty"`
+
+	// Specifies the duration in seconds relative to status.startTime that the run across all nodes
+	// may be active. Once it is exceeded, no more nodes are started, running Jobs are terminated
+	// and the DaemonJob is marked failed. Follow-up runs of failed nodes count as part of the run.
+	// +optional
+	ActiveDeadlineSeconds *int64 `json:"activeDeadlineSeconds,omitempty"`
+
+	// Specifies the number of failed pods across all nodes, counted on the latest Job of every node,
+	// after which no more nodes are started, running Jobs are terminated and the DaemonJob is marked failed.
+	// Defaults to no limit.
+	// +optional
+	BackoffLimit *int32 `json:"backoffLimit,omitempty"`
+
+	// The number of failed nodes after which no more nodes are started and the DaemonJob is marked failed.
+	// Value can be an absolute number (ex: 5) or a percentage of targeted nodes (ex: 10%),
+	// calculated by rounding up, but is never lower than 1.
+	// Defaults to no limit.
+	// +optional
+	MaxFailedNodes *intstr.IntOrString `json:"maxFailedNodes,omitempty"`
+
+	// Changing this value starts a follow-up run on nodes where the job failed, using the same template.
+	// Nodes that succeeded are not run again. Any unique value works, e.g. the current timestamp.
+	// +optional
+	RetryFailedNodes string `json:"retryFailedNodes,omitempty"`
+}
+
+// Canary selects nodes that run the job first.
+type Canary struct {
+	// Number of canary nodes. Value can be an absolute number (ex: 1) or a percentage of
+	// targeted nodes (ex: 5%), calculated by rounding up.
+	// When selector is set as well, it limits the number of matching nodes used as canaries.
+	// Defaults to all matching nodes when selector is set, and to 1 otherwise.
+	// +optional
+	Nodes *intstr.IntOrString `json:"nodes,omitempty"`
+
+	// A label query over targeted nodes that selects canary nodes.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// Teardown describes the cleanup run when a DaemonJob is deleted.
+// Deletion waits for teardown to finish, up to timeoutSeconds,
+// unless the DaemonJob is annotated with dj.dysproz.io/force-remove.
+type Teardown struct {
+	// Describes the pod that runs once on every node the job ran on.
+	Template corev1.PodTemplateSpec `json:"template"`
+
+	// Specifies how long, in seconds since the deletion of the DaemonJob was requested,
+	// deletion waits for teardown before giving up. Defaults to 600 seconds.
+	// +optional
+	TimeoutSeconds *int64 `json:"timeoutSeconds,omitempty"`
+}
+
+// DaemonJobConditionType is a valid value for DaemonJobCondition.Type.
+type DaemonJobConditionType string
+
+const (
+	// DaemonJobComplete means the job succeeded on every targeted node.
+	DaemonJobComplete DaemonJobConditionType = "Complete"
+	// DaemonJobFailed means the rollout halted because canary nodes failed, the failure budget was exceeded
+	// or a fleet-wide deadline or backoff limit was exceeded.
+	DaemonJobFailed DaemonJobConditionType = "Failed"
+	// DaemonJobNodesUnavailable means some targeted nodes cannot start a pod, because they are NotReady,
+	// cordoned or have taints the pod does not tolerate. They run once they become available.
+	DaemonJobNodesUnavailable DaemonJobConditionType = "NodesUnavailable"
+)
+
+// DaemonJobCondition describes the state of a DaemonJob at a certain point.
+type DaemonJobCondition struct {
+	// Type of the condition, Complete, Failed or NodesUnavailable.
+	Type DaemonJobConditionType `json:"type"`
+
+	// Status of the condition, one of True, False, Unknown.
+	Status corev1.ConditionStatus `json:"status"`
+
+	// Last time the condition was checked.
+	// +optional
+	LastProbeTime metav1.Time `json:"lastProbeTime,omitempty"`
+
+	// Last time the condition transitioned from one status to another.
+	// +optional
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+
+	// (brief) reason for the condition's last transition.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// Human readable message indicating details about last transition.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// NodePhase is the phase of the job on a single node.
+type NodePhase string
+
+const (
+	// NodePending means the node cannot start a pod of the job yet, the reason tells why.
+	NodePending NodePhase = "Pending"
+	// NodeRunning means the Job of the node has not finished yet.
+	NodeRunning NodePhase = "Running"
+	// NodeSucceeded means the Job of the node succeeded.
+	NodeSucceeded NodePhase = "Succeeded"
+	// NodeFailed means the Job of the node failed.
+	NodeFailed NodePhase = "Failed"
+)
+
+// NodeStatus describes the progress of the job on a single node.
+type NodeStatus struct {
+	// Name of the node.
+	Name string `json:"name"`
+
+	// Phase of the job on the node.
+	Phase NodePhase `json:"phase"`
+
+	// Name of the latest Job created for the node, empty while the node is pending.
+	Job string `json:"job"`
+
+	// The number of times the node was retried after failing.
+	// +optional
+	Retries int32 `json:"retries,omitempty"`
+
+	// Names of overrides applied to the pod of the node.
+	// +optional
+	Overrides []string `json:"overrides,omitempty"`
+
+	// Name of the latest pod of the Job.
+	// +optional
+	Pod string `json:"pod,omitempty"`
+
+	// The number of times containers of the pod restarted.
+	// +optional
+	Restarts int32 `json:"restarts,omitempty"`
+
+	// A brief CamelCase reason why the node or its pod does not make progress,
+	// e.g. NotReady, UntoleratedTaint, ImagePullBackOff or CrashLoopBackOff.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// A human readable message with details about the reason.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// WavePhase is the phase of a rollout wave.
+type WavePhase string
+
+const (
+	// WavePending means no node of the wave has started yet.
+	WavePending WavePhase = "Pending"
+	// WaveRunning means some nodes of the wave have started and not every node has finished.
+	WaveRunning WavePhase = "Running"
+	// WaveSucceeded means every node of the wave succeeded.
+	WaveSucceeded WavePhase = "Succeeded"
+	// WaveFailed means every node of the wave finished and at least one of them failed.
+	WaveFailed WavePhase = "Failed"
+)
+
+// WaveStatus describes the progress of a single rollout wave.
+type WaveStatus struct {
+	// Name of the wave: "canary" or "wave-<n>".
+	Name string `json:"name"`
+
+	// Phase of the wave.
+	Phase WavePhase `json:"phase"`
+
+	// The number of nodes in the wave.
+	Nodes int32 `json:"nodes"`
+
+	// The number of nodes of the wave currently running.
+	// +optional
+	Active int32 `json:"active,omitempty"`
+
+	// The number of nodes of the wave that succeeded.
+	// +optional
+	Succeeded int32 `json:"succeeded,omitempty"`
+
+	// The number of nodes of the wave that failed.
+	// +optional
+	Failed int32 `json:"failed,omitempty"`
+
+	// The number of nodes of the wave that cannot start a pod, e.g. NotReady or cordoned nodes.
+	// They do not hold back later waves.
+	// +optional
+	Unavailable int32 `json:"unavailable,omitempty"`
+}
+
+// RolloutStatus describes the progress of the rollout.
+type RolloutStatus struct {
+	// Name of the wave currently rolled out.
+	// +optional
+	CurrentWave string `json:"currentWave,omitempty"`
+
+	// Halted is true when the rollout stopped because a canary node failed
+	// or the failure budget was exceeded.
+	// +optional
+	Halted bool `json:"halted,omitempty"`
+
+	// Progress of every wave in rollout order.
+	// +optional
+	Waves []WaveStatus `json:"waves,omitempty"`
+}
+
+// DaemonJobStatus defines the observed state of DaemonJob
+type DaemonJobStatus struct {
+	// The latest available observations of the DaemonJob's current state.
+	// +optional
+	Conditions []DaemonJobCondition `json:"conditions,omitempty"`
+
+	// Time the first Job of the DaemonJob started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// Time the last Job of the DaemonJob completed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// The number of nodes targeted by the DaemonJob.
+	// +optional
+	DesiredNodes int32 `json:"desiredNodes,omitempty"`
+
+	// The number of targeted nodes that have not started yet.
+	// +optional
+	PendingNodes int32 `json:"pendingNodes,omitempty"`
+
+	// The number of nodes currently running the job.
+	// +optional
+	ActiveNodes int32 `json:"activeNodes,omitempty"`
+
+	// The number of nodes on which the job succeeded.
+	// +optional
+	SucceededNodes int32 `json:"succeededNodes,omitempty"`
+
+	// The number of nodes on which the job failed.
+	// +optional
+	FailedNodes int32 `json:"failedNodes,omitempty"`
+
+	// Names of nodes on which the job failed.
+	// +optional
+	FailedNodeNames []string `json:"failedNodeNames,omitempty"`
+
+	// Progress of the job on every node it has started on.
+	// +optional
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+
+	// Progress of the rollout, set when canary nodes or waves are used.
+	// +optional
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:storageversion
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Desired",type=integer,JSONPath=`.status.desiredNodes`
+// +kubebuilder:printcolumn:name="Active",type=integer,JSONPath=`.status.activeNodes`
+// +kubebuilder:printcolumn:name="Succeeded",type=integer,JSONPath=`.status.succeededNodes`
+// +kubebuilder:printcolumn:name="Failed",type=integer,JSONPath=`.status.failedNodes`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// DaemonJob is the Schema for the daemonjobs API
+type DaemonJob struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DaemonJobSpec   `json:"spec,omitempty"`
+	Status DaemonJobStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DaemonJobList contains a list of DaemonJob
+type DaemonJobList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DaemonJob `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DaemonJob{}, &DaemonJobList{})
+}
@@ -0,0 +1,337 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	metav1validation "k8s.io/apimachinery/pkg/apis/meta/v1/validation"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// defaultBackoffLimit matches the default of batch/v1 Jobs.
+const defaultBackoffLimit int32 = 6
+
+// DaemonJobDefaults holds operator-wide defaults applied to every DaemonJob by the defaulting webhook.
+type DaemonJobDefaults struct {
+	// Tolerations added to the pod templates unless a toleration with the same key and effect is already set.
+	// +optional
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+// daemonJobDefaults are the operator-wide defaults used by Default.
+var daemonJobDefaults DaemonJobDefaults
+
+// SetupWebhookWithManager registers DaemonJob webhooks in the manager.
+// The given defaults are applied to every DaemonJob admitted by the defaulting webhook.
+func (r *DaemonJob) SetupWebhookWithManager(mgr ctrl.Manager, defaults DaemonJobDefaults) error {
+	daemonJobDefaults = defaults
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-dj-dysproz-io-v2-daemonjob,mutating=true,failurePolicy=fail,groups=dj.dysproz.io,resources=daemonjobs,verbs=create;update,versions=v2,name=mdaemonjob.v2.dj.dysproz.io
+
+var _ webhook.Defaulter = &DaemonJob{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *DaemonJob) Default() {
+	jobSpec := &r.Spec.JobTemplate.Spec
+	if jobSpec.BackoffLimit == nil {
+		backoffLimit := defaultBackoffLimit
+		jobSpec.BackoffLimit = &backoffLimit
+	}
+	// With a template reference the pod spec is defaulted in the DaemonJobTemplate.
+	if r.Spec.TemplateRef == nil {
+		defaultPodSpec(&jobSpec.Template.Spec)
+	}
+	if r.Spec.Teardown != nil {
+		defaultPodSpec(&r.Spec.Teardown.Template.Spec)
+	}
+}
+
+func defaultPodSpec(spec *corev1.PodSpec) {
+	// Pods default to Always, which Jobs do not accept.
+	if spec.RestartPolicy == "" {
+		spec.RestartPolicy = corev1.RestartPolicyOnFailure
+	}
+	for _, toleration := range daemonJobDefaults.Tolerations {
+		if !hasToleration(spec.Tolerations, toleration) {
+			spec.Tolerations = append(spec.Tolerations, toleration)
+		}
+	}
+}
+
+func hasToleration(tolerations []corev1.Toleration, toleration corev1.Toleration) bool {
+	for _, t := range tolerations {
+		if t.Key == toleration.Key && t.Effect == toleration.Effect {
+			return true
+		}
+	}
+	return false
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-dj-dysproz-io-v2-daemonjob,mutating=false,failurePolicy=fail,groups=dj.dysproz.io,resources=daemonjobs,versions=v2,name=vdaemonjob.v2.dj.dysproz.io
+
+var _ webhook.Validator = &DaemonJob{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJob) ValidateCreate() error {
+	return r.validateDaemonJob()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJob) ValidateUpdate(old runtime.Object) error {
+	return r.validateDaemonJob()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJob) ValidateDelete() error {
+	return nil
+}
+
+func (r *DaemonJob) validateDaemonJob() error {
+	allErrs := validateDaemonJobSpec(&r.Spec, field.NewPath("spec"))
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("DaemonJob").GroupKind(), r.Name, allErrs)
+}
+
+func validateDaemonJobSpec(spec *DaemonJobSpec, fldPath *field.Path) field.ErrorList {
+	allErrs := validateJobSpec(&spec.JobTemplate.Spec, spec.TemplateRef != nil, fldPath.Child("jobTemplate", "spec"))
+	if spec.TemplateRef != nil && spec.TemplateRef.Name == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("templateRef", "name"), ""))
+	}
+	if spec.Nodes.Selector != nil {
+		allErrs = append(allErrs, metav1validation.ValidateLabelSelector(spec.Nodes.Selector, fldPath.Child("nodes", "selector"))...)
+	}
+	if spec.Rollout != nil {
+		allErrs = append(allErrs, validateRollout(spec.Rollout, fldPath.Child("rollout"))...)
+	}
+	allErrs = append(allErrs, validateOverrides(spec, fldPath.Child("overrides"))...)
+	metadata := &spec.JobTemplate.Metadata
+	metadataPath := fldPath.Child("jobTemplate", "metadata")
+	allErrs = append(allErrs, metav1validation.ValidateLabels(metadata.Labels, metadataPath.Child("labels"))...)
+	allErrs = append(allErrs, apivalidation.ValidateAnnotations(metadata.Annotations, metadataPath.Child("annotations"))...)
+	allErrs = append(allErrs, validateUnreservedKeys(metadata.Labels, metadataPath.Child("labels"))...)
+	allErrs = append(allErrs, validateUnreservedKeys(metadata.Annotations, metadataPath.Child("annotations"))...)
+	templatePath := fldPath.Child("jobTemplate", "spec", "template", "metadata")
+	allErrs = append(allErrs, validateUnreservedKeys(spec.JobTemplate.Spec.Template.Labels, templatePath.Child("labels"))...)
+	allErrs = append(allErrs, validateUnreservedKeys(spec.JobTemplate.Spec.Template.Annotations, templatePath.Child("annotations"))...)
+	if spec.Teardown != nil {
+		allErrs = append(allErrs, validateTeardown(spec.Teardown, fldPath.Child("teardown"))...)
+	}
+	return allErrs
+}
+
+// validateTeardown validates the teardown pod template. Teardown runs on every node the job ran on,
+// so the template cannot select nodes of its own.
+func validateTeardown(teardown *Teardown, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	template := &teardown.Template
+	metadataPath := fldPath.Child("template", "metadata")
+	allErrs = append(allErrs, metav1validation.ValidateLabels(template.Labels, metadataPath.Child("labels"))...)
+	allErrs = append(allErrs, apivalidation.ValidateAnnotations(template.Annotations, metadataPath.Child("annotations"))...)
+	allErrs = append(allErrs, validateUnreservedKeys(template.Labels, metadataPath.Child("labels"))...)
+	allErrs = append(allErrs, validateUnreservedKeys(template.Annotations, metadataPath.Child("annotations"))...)
+
+	specPath := fldPath.Child("template", "spec")
+	allErrs = append(allErrs, validateRestartPolicy(template.Spec.RestartPolicy, specPath.Child("restartPolicy"))...)
+	if len(template.Spec.Containers) == 0 {
+		allErrs = append(allErrs, field.Required(specPath.Child("containers"), ""))
+	}
+	for i, container := range template.Spec.Containers {
+		if container.Name == "" {
+			allErrs = append(allErrs, field.Required(specPath.Child("containers").Index(i).Child("name"), ""))
+		}
+		if container.Image == "" {
+			allErrs = append(allErrs, field.Required(specPath.Child("containers").Index(i).Child("image"), ""))
+		}
+	}
+	if len(template.Spec.NodeSelector) > 0 {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("nodeSelector"), "teardown runs on every node the job ran on"))
+	}
+	if teardown.TimeoutSeconds != nil {
+		allErrs = append(allErrs, validateNonnegativeField(*teardown.TimeoutSeconds, fldPath.Child("timeoutSeconds"))...)
+	}
+	return allErrs
+}
+
+// validateUnreservedKeys forbids keys managed by the controller or the Job controller.
+func validateUnreservedKeys(metadata map[string]string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for key := range metadata {
+		if IsReservedKey(key) {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Key(key), "is managed by the controller"))
+		}
+	}
+	return allErrs
+}
+
+// validateOverrides validates overrides of the pod template. Containers of a referenced
+// DaemonJobTemplate are not known here and are checked when the template is rendered.
+func validateOverrides(spec *DaemonJobSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	containerNames := sets.NewString()
+	podSpec := &spec.JobTemplate.Spec.Template.Spec
+	for _, containers := range [][]corev1.Container{podSpec.InitContainers, podSpec.Containers} {
+		for _, container := range containers {
+			containerNames.Insert(container.Name)
+		}
+	}
+	overrideNames := sets.NewString()
+	for i, override := range spec.Overrides {
+		overridePath := fldPath.Index(i)
+		if override.Name == "" {
+			allErrs = append(allErrs, field.Required(overridePath.Child("name"), ""))
+		} else if overrideNames.Has(override.Name) {
+			allErrs = append(allErrs, field.Duplicate(overridePath.Child("name"), override.Name))
+		} else if strings.Contains(override.Name, ",") {
+			allErrs = append(allErrs, field.Invalid(overridePath.Child("name"), override.Name, "must not contain a comma"))
+		}
+		overrideNames.Insert(override.Name)
+		allErrs = append(allErrs, metav1validation.ValidateLabelSelector(&override.Selector, overridePath.Child("selector"))...)
+		if len(override.Containers) == 0 {
+			allErrs = append(allErrs, field.Required(overridePath.Child("containers"), ""))
+		}
+		for j, container := range override.Containers {
+			namePath := overridePath.Child("containers").Index(j).Child("name")
+			if container.Name == "" {
+				allErrs = append(allErrs, field.Required(namePath, ""))
+			} else if spec.TemplateRef == nil && !containerNames.Has(container.Name) {
+				allErrs = append(allErrs, field.NotFound(namePath, container.Name))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateJobSpec validates the Job spec of a DaemonJob. With a template reference
+// the pod template only carries labels and annotations added to the referenced one.
+func validateJobSpec(spec *JobSpec, hasTemplateRef bool, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if spec.ActiveDeadlineSeconds != nil {
+		allErrs = append(allErrs, validateNonnegativeField(*spec.ActiveDeadlineSeconds, fldPath.Child("activeDeadlineSeconds"))...)
+	}
+	if spec.BackoffLimit != nil {
+		allErrs = append(allErrs, validateNonnegativeField(int64(*spec.BackoffLimit), fldPath.Child("backoffLimit"))...)
+	}
+	if spec.TTLSecondsAfterFinished != nil {
+		allErrs = append(allErrs, validateNonnegativeField(int64(*spec.TTLSecondsAfterFinished), fldPath.Child("ttlSecondsAfterFinished"))...)
+	}
+
+	if spec.ManualSelector != nil && *spec.ManualSelector && spec.Selector == nil {
+		allErrs = append(allErrs, field.Required(fldPath.Child("selector"), "must be set when manualSelector is true"))
+	}
+	if spec.Selector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(spec.Selector)
+		if err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("selector"), spec.Selector, err.Error()))
+		} else if !hasTemplateRef && !selector.Matches(labels.Set(spec.Template.Labels)) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("template", "metadata", "labels"), spec.Template.Labels,
+				"`selector` does not match template `labels`"))
+		}
+	}
+
+	if hasTemplateRef {
+		if !equality.Semantic.DeepEqual(spec.Template.Spec, corev1.PodSpec{}) {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("template", "spec"),
+				"the pod spec comes from spec.templateRef"))
+		}
+		return allErrs
+	}
+	allErrs = append(allErrs, validateRestartPolicy(spec.Template.Spec.RestartPolicy, fldPath.Child("template", "spec", "restartPolicy"))...)
+	if len(spec.Template.Spec.NodeSelector) > 0 {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("template", "spec", "nodeSelector"),
+			"use spec.nodes.nodeSelector to select nodes"))
+	}
+	return allErrs
+}
+
+func validateRollout(rollout *Rollout, fldPath *field.Path) field.ErrorList {
+	allErrs := validateIntOrPercent(rollout.MaxParallel, fldPath.Child("maxParallel"))
+	allErrs = append(allErrs, validateIntOrPercent(rollout.MaxFailedNodes, fldPath.Child("maxFailedNodes"))...)
+	if rollout.ActiveDeadlineSeconds != nil {
+		allErrs = append(allErrs, validateNonnegativeField(*rollout.ActiveDeadlineSeconds, fldPath.Child("activeDeadlineSeconds"))...)
+	}
+	if rollout.BackoffLimit != nil {
+		allErrs = append(allErrs, validateNonnegativeField(int64(*rollout.BackoffLimit), fldPath.Child("backoffLimit"))...)
+	}
+	if rollout.Canary != nil {
+		allErrs = append(allErrs, validateIntOrPercent(rollout.Canary.Nodes, fldPath.Child("canary", "nodes"))...)
+		if rollout.Canary.Selector != nil {
+			if _, err := metav1.LabelSelectorAsSelector(rollout.Canary.Selector); err != nil {
+				allErrs = append(allErrs, field.Invalid(fldPath.Child("canary", "selector"), rollout.Canary.Selector, err.Error()))
+			}
+		}
+	}
+	for i := range rollout.Waves {
+		allErrs = append(allErrs, validateIntOrPercent(&rollout.Waves[i], fldPath.Child("waves").Index(i))...)
+	}
+	return allErrs
+}
+
+// validateRestartPolicy rejects restart policies not supported by Jobs.
+// An empty policy is left for the API server to default.
+func validateRestartPolicy(policy corev1.RestartPolicy, fldPath *field.Path) field.ErrorList {
+	switch policy {
+	case "", corev1.RestartPolicyOnFailure, corev1.RestartPolicyNever:
+		return nil
+	default:
+		return field.ErrorList{field.NotSupported(fldPath, policy,
+			[]string{string(corev1.RestartPolicyOnFailure), string(corev1.RestartPolicyNever)})}
+	}
+}
+
+func validateNonnegativeField(value int64, fldPath *field.Path) field.ErrorList {
+	if value < 0 {
+		return field.ErrorList{field.Invalid(fldPath, value, "must be greater than or equal to 0")}
+	}
+	return nil
+}
+
+// validateIntOrPercent accepts non-negative numbers and percentages between 0% and 100%.
+func validateIntOrPercent(value *intstr.IntOrString, fldPath *field.Path) field.ErrorList {
+	if value == nil {
+		return nil
+	}
+	if value.Type == intstr.Int {
+		return validateNonnegativeField(int64(value.IntVal), fldPath)
+	}
+	percent, err := intstr.GetValueFromIntOrPercent(value, 100, false)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, value.StrVal, "must be an integer or a percentage, e.g. 10%")}
+	}
+	if percent < 0 || percent > 100 {
+		return field.ErrorList{field.Invalid(fldPath, value.StrVal, "must be between 0% and 100%")}
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package v2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func getTestDaemonJob() *DaemonJob {
+	return &DaemonJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "test-daemonjob",
+		},
+		Spec: DaemonJobSpec{
+			JobTemplate: JobTemplateSpec{
+				Spec: JobSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{
+							Labels: map[string]string{"app": "test"},
+						},
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{
+								{
+									Image: "test-image",
+									Name:  "test-container",
+								},
+							},
+							RestartPolicy: corev1.RestartPolicyOnFailure,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func getFieldErrors(t *testing.T, err error) map[string]string {
+	require.Error(t, err)
+	statusErr, ok := err.(*apierrors.StatusError)
+	require.True(t, ok)
+	assert.True(t, apierrors.IsInvalid(err))
+	fieldErrors := map[string]string{}
+	for _, cause := range statusErr.ErrStatus.Details.Causes {
+		fieldErrors[cause.Field] = string(cause.Type)
+	}
+	return fieldErrors
+}
+
+func TestValidateDaemonJob(t *testing.T) {
+	t.Run("should accept valid DaemonJob", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		manualSelector := true
+		instance.Spec.JobTemplate.Spec.ManualSelector = &manualSelector
+		instance.Spec.JobTemplate.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}
+		maxParallel := intstr.FromString("10%")
+		instance.Spec.Nodes.NodeSelector = map[string]string{"role": "worker"}
+		instance.Spec.Rollout = &Rollout{MaxParallel: &maxParallel}
+		assert.NoError(t, instance.ValidateCreate())
+		assert.NoError(t, instance.ValidateUpdate(getTestDaemonJob()))
+		assert.NoError(t, instance.ValidateDelete())
+	})
+
+	t.Run("should reject Always restart policy", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+		instance.Spec.Teardown = &Teardown{Template: *instance.Spec.JobTemplate.Spec.Template.DeepCopy()}
+		assert.Equal(t, map[string]string{
+			"spec.jobTemplate.spec.template.spec.restartPolicy": "FieldValueNotSupported",
+			"spec.teardown.template.spec.restartPolicy":         "FieldValueNotSupported",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should reject selector not matching template labels", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.JobTemplate.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}}
+		assert.Equal(t, map[string]string{
+			"spec.jobTemplate.spec.template.metadata.labels": "FieldValueInvalid",
+		}, getFieldErrors(t, instance.ValidateUpdate(getTestDaemonJob())))
+	})
+
+	t.Run("should reject manualSelector without selector", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		manualSelector := true
+		instance.Spec.JobTemplate.Spec.ManualSelector = &manualSelector
+		assert.Equal(t, map[string]string{
+			"spec.jobTemplate.spec.selector": "FieldValueRequired",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should reject node selector in pod template", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.JobTemplate.Spec.Template.Spec.NodeSelector = map[string]string{"role": "worker"}
+		assert.Equal(t, map[string]string{
+			"spec.jobTemplate.spec.template.spec.nodeSelector": "FieldValueForbidden",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should reject invalid node selector", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.Nodes.Selector = &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "role", Operator: metav1.LabelSelectorOpIn}},
+		}
+		assert.Equal(t, map[string]string{
+			"spec.nodes.selector.matchExpressions[0].values": "FieldValueRequired",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should reject negative values", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		var deadline int64 = -1
+		var backoffLimit int32 = -1
+		maxParallel := intstr.FromString("150%")
+		maxFailedNodes := intstr.FromInt(-1)
+		instance.Spec.JobTemplate.Spec.ActiveDeadlineSeconds = &deadline
+		instance.Spec.JobTemplate.Spec.BackoffLimit = &backoffLimit
+		instance.Spec.Teardown = &Teardown{Template: *instance.Spec.JobTemplate.Spec.Template.DeepCopy(), TimeoutSeconds: &deadline}
+		instance.Spec.Rollout = &Rollout{
+			MaxParallel:           &maxParallel,
+			MaxFailedNodes:        &maxFailedNodes,
+			Waves:                 []intstr.IntOrString{intstr.FromInt(1), intstr.FromString("ten")},
+			ActiveDeadlineSeconds: &deadline,
+			BackoffLimit:          &backoffLimit,
+		}
+		assert.Equal(t, map[string]string{
+			"spec.jobTemplate.spec.activeDeadlineSeconds": "FieldValueInvalid",
+			"spec.jobTemplate.spec.backoffLimit":          "FieldValueInvalid",
+			"spec.teardown.timeoutSeconds":                "FieldValueInvalid",
+			"spec.rollout.maxParallel":                    "FieldValueInvalid",
+			"spec.rollout.maxFailedNodes":                 "FieldValueInvalid",
+			"spec.rollout.waves[1]":                       "FieldValueInvalid",
+			"spec.rollout.activeDeadlineSeconds":          "FieldValueInvalid",
+			"spec.rollout.backoffLimit":                   "FieldValueInvalid",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should accept template reference without pod spec", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.JobTemplate.Spec.Template.Spec = corev1.PodSpec{}
+		instance.Spec.TemplateRef = &TemplateReference{Name: "test-template"}
+		assert.NoError(t, instance.ValidateCreate())
+	})
+
+	t.Run("should reject template reference together with pod spec", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.TemplateRef = &TemplateReference{}
+		assert.Equal(t, map[string]string{
+			"spec.templateRef.name":               "FieldValueRequired",
+			"spec.jobTemplate.spec.template.spec": "FieldValueForbidden",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should reject invalid overrides", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		selector := metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/arch": "arm64"}}
+		instance.Spec.Overrides = []Override{
+			{Name: "arm64", Selector: selector, Containers: []ContainerOverride{{Name: "test-container", Image: "arm64-image"}}},
+			{Name: "arm64", Selector: selector, Containers: []ContainerOverride{{Name: "missing"}}},
+			{Selector: metav1.LabelSelector{MatchLabels: map[string]string{"size": "-large"}}},
+		}
+		assert.Equal(t, map[string]string{
+			"spec.overrides[1].name":                 "FieldValueDuplicate",
+			"spec.overrides[1].containers[0].name":   "FieldValueNotFound",
+			"spec.overrides[2].name":                 "FieldValueRequired",
+			"spec.overrides[2].selector.matchLabels": "FieldValueInvalid",
+			"spec.overrides[2].containers":           "FieldValueRequired",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should reject invalid teardown template", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.Teardown = &Teardown{Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"dj.dysproz.io/node": "node-a"}},
+			Spec: corev1.PodSpec{
+				Containers:    []corev1.Container{{Name: "teardown"}},
+				NodeSelector:  map[string]string{"role": "worker"},
+				RestartPolicy: corev1.RestartPolicyNever,
+			},
+		}}
+		assert.Equal(t, map[string]string{
+			"spec.teardown.template.metadata.annotations[dj.dysproz.io/node]": "FieldValueForbidden",
+			"spec.teardown.template.spec.containers[0].image":                 "FieldValueRequired",
+			"spec.teardown.template.spec.nodeSelector":                        "FieldValueForbidden",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+
+		instance.Spec.Teardown.Template = corev1.PodTemplateSpec{}
+		assert.Equal(t, map[string]string{
+			"spec.teardown.template.spec.containers": "FieldValueRequired",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+
+	t.Run("should reject reserved and invalid metadata keys", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Spec.JobTemplate.Metadata = JobMetadata{
+			Labels:      map[string]string{"team": "platform", "dj.dysproz.io/run": "1", "invalid key": "value"},
+			Annotations: map[string]string{"batch.kubernetes.io/job-tracking": ""},
+		}
+		instance.Spec.JobTemplate.Spec.Template.Labels["job-name"] = "test"
+		assert.Equal(t, map[string]string{
+			"spec.jobTemplate.metadata.labels":                                        "FieldValueInvalid",
+			"spec.jobTemplate.metadata.labels[dj.dysproz.io/run]":                     "FieldValueForbidden",
+			"spec.jobTemplate.metadata.annotations[batch.kubernetes.io/job-tracking]": "FieldValueForbidden",
+			"spec.jobTemplate.spec.template.metadata.labels[job-name]":                "FieldValueForbidden",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+}
+
+func TestDefaultDaemonJob(t *testing.T) {
+	daemonJobDefaults = DaemonJobDefaults{
+		Tolerations: []corev1.Toleration{
+			{Key: "maintenance", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+			{Key: "dedicated", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute},
+		},
+	}
+	defer func() { daemonJobDefaults = DaemonJobDefaults{} }()
+
+	t.Run("should fill in defaults", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		template := &instance.Spec.JobTemplate.Spec.Template
+		template.Spec.RestartPolicy = ""
+		template.Spec.Tolerations = []corev1.Toleration{
+			{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "batch", Effect: corev1.TaintEffectNoExecute},
+		}
+		instance.Spec.Teardown = &Teardown{Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "teardown", Image: "teardown-image"}}},
+		}}
+		instance.Default()
+
+		require.NotNil(t, instance.Spec.JobTemplate.Spec.BackoffLimit)
+		assert.Equal(t, int32(6), *instance.Spec.JobTemplate.Spec.BackoffLimit)
+		assert.Equal(t, corev1.RestartPolicyOnFailure, template.Spec.RestartPolicy)
+		assert.Equal(t, map[string]string{"app": "test"}, template.Labels)
+		assert.Equal(t, []corev1.Toleration{
+			{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "batch", Effect: corev1.TaintEffectNoExecute},
+			{Key: "maintenance", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+		}, template.Spec.Tolerations)
+
+		teardownTemplate := &instance.Spec.Teardown.Template
+		assert.Equal(t, corev1.RestartPolicyOnFailure, teardownTemplate.Spec.RestartPolicy)
+		assert.Nil(t, teardownTemplate.Labels)
+		assert.Equal(t, daemonJobDefaults.Tolerations, teardownTemplate.Spec.Tolerations)
+		assert.NoError(t, instance.ValidateCreate())
+	})
+
+	t.Run("should keep values already set", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		var backoffLimit int32 = 0
+		instance.Spec.JobTemplate.Spec.BackoffLimit = &backoffLimit
+		instance.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+		instance.Default()
+
+		assert.Equal(t, int32(0), *instance.Spec.JobTemplate.Spec.BackoffLimit)
+		assert.Equal(t, corev1.RestartPolicyNever, instance.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy)
+		assert.Nil(t, instance.Spec.Teardown)
+	})
+
+	t.Run("should be idempotent", func(t *testing.T) {
+		instance := getTestDaemonJob()
+		instance.Default()
+		defaulted := instance.DeepCopy()
+		instance.Default()
+		assert.Equal(t, defaulted, instance)
+	})
+}
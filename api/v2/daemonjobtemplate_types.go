@@ -0,0 +1,72 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DaemonJobTemplateSpec defines the desired state of DaemonJobTemplate
+type DaemonJobTemplateSpec struct {
+	// Parameters accepted by the template. A parameter is referenced in any string
+	// of the pod template as {{ .Parameters.<name> }}.
+	// +optional
+	Parameters []DaemonJobTemplateParameter `json:"parameters,omitempty"`
+
+	// Describes the pod run by DaemonJobs referencing this template.
+	Template corev1.PodTemplateSpec `json:"template"`
+}
+
+// DaemonJobTemplateParameter declares a parameter of a DaemonJobTemplate.
+type DaemonJobTemplateParameter struct {
+	// Name of the parameter. Must be a valid identifier: letters, digits and underscores,
+	// not starting with a digit.
+	Name string `json:"name"`
+
+	// Human readable description of the parameter.
+	// +optional
+	Description string `json:"description,omitempty"`
+
+	// Value used when a DaemonJob does not set the parameter.
+	// Parameters without a default have to be set by every DaemonJob.
+	// +optional
+	Default *string `json:"default,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DaemonJobTemplate is the Schema for the daemonjobtemplates API
+type DaemonJobTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec DaemonJobTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// DaemonJobTemplateList contains a list of DaemonJobTemplate
+type DaemonJobTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DaemonJobTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DaemonJobTemplate{}, &DaemonJobTemplateList{})
+}
@@ -0,0 +1,86 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"regexp"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+var parameterNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SetupWebhookWithManager registers DaemonJobTemplate webhooks in the manager.
+func (r *DaemonJobTemplate) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-dj-dysproz-io-v2-daemonjobtemplate,mutating=true,failurePolicy=fail,groups=dj.dysproz.io,resources=daemonjobtemplates,verbs=create;update,versions=v2,name=mdaemonjobtemplate.v2.dj.dysproz.io
+
+var _ webhook.Defaulter = &DaemonJobTemplate{}
+
+// Default implements webhook.Defaulter so a webhook will be registered for the type
+func (r *DaemonJobTemplate) Default() {
+	defaultPodSpec(&r.Spec.Template.Spec)
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-dj-dysproz-io-v2-daemonjobtemplate,mutating=false,failurePolicy=fail,groups=dj.dysproz.io,resources=daemonjobtemplates,versions=v2,name=vdaemonjobtemplate.v2.dj.dysproz.io
+
+var _ webhook.Validator = &DaemonJobTemplate{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJobTemplate) ValidateCreate() error {
+	return r.validateDaemonJobTemplate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJobTemplate) ValidateUpdate(old runtime.Object) error {
+	return r.validateDaemonJobTemplate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *DaemonJobTemplate) ValidateDelete() error {
+	return nil
+}
+
+func (r *DaemonJobTemplate) validateDaemonJobTemplate() error {
+	fldPath := field.NewPath("spec")
+	var allErrs field.ErrorList
+	names := sets.NewString()
+	for i, parameter := range r.Spec.Parameters {
+		namePath := fldPath.Child("parameters").Index(i).Child("name")
+		if !parameterNameRegexp.MatchString(parameter.Name) {
+			allErrs = append(allErrs, field.Invalid(namePath, parameter.Name,
+				"must consist of letters, digits and underscores and must not start with a digit"))
+		} else if names.Has(parameter.Name) {
+			allErrs = append(allErrs, field.Duplicate(namePath, parameter.Name))
+		}
+		names.Insert(parameter.Name)
+	}
+	allErrs = append(allErrs, validateRestartPolicy(r.Spec.Template.Spec.RestartPolicy, fldPath.Child("template", "spec", "restartPolicy"))...)
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("DaemonJobTemplate").GroupKind(), r.Name, allErrs)
+}
@@ -0,0 +1,59 @@
+package v2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func getTestDaemonJobTemplate() *DaemonJobTemplate {
+	return &DaemonJobTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "test-template",
+		},
+		Spec: DaemonJobTemplateSpec{
+			Parameters: []DaemonJobTemplateParameter{{Name: "image"}},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Image: "{{ .Parameters.image }}",
+							Name:  "test-container",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestValidateDaemonJobTemplate(t *testing.T) {
+	t.Run("should accept valid DaemonJobTemplate", func(t *testing.T) {
+		instance := getTestDaemonJobTemplate()
+		assert.NoError(t, instance.ValidateCreate())
+		assert.NoError(t, instance.ValidateUpdate(getTestDaemonJobTemplate()))
+		assert.NoError(t, instance.ValidateDelete())
+	})
+
+	t.Run("should reject invalid and duplicate parameter names", func(t *testing.T) {
+		instance := getTestDaemonJobTemplate()
+		instance.Spec.Parameters = append(instance.Spec.Parameters,
+			DaemonJobTemplateParameter{Name: "image"}, DaemonJobTemplateParameter{Name: "1st-node"})
+		instance.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyAlways
+		assert.Equal(t, map[string]string{
+			"spec.parameters[1].name":          "FieldValueDuplicate",
+			"spec.parameters[2].name":          "FieldValueInvalid",
+			"spec.template.spec.restartPolicy": "FieldValueNotSupported",
+		}, getFieldErrors(t, instance.ValidateCreate()))
+	})
+}
+
+func TestDefaultDaemonJobTemplate(t *testing.T) {
+	instance := getTestDaemonJobTemplate()
+	instance.Default()
+	assert.Equal(t, corev1.RestartPolicyOnFailure, instance.Spec.Template.Spec.RestartPolicy)
+}
@@ -0,0 +1,158 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// NamespacedCacheBuilder returns a cache limited to the given namespaces.
+// Namespaced objects are cached per namespace, while cluster-scoped objects such as Nodes,
+// which a multi-namespace cache would list once for every namespace, are cached cluster-wide.
+func NamespacedCacheBuilder(namespaces []string) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		if opts.Mapper == nil {
+			mapper, err := apiutil.NewDynamicRESTMapper(config)
+			if err != nil {
+				return nil, err
+			}
+			opts.Mapper = mapper
+		}
+		namespaced, err := cache.MultiNamespacedCacheBuilder(namespaces)(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		opts.Namespace = ""
+		cluster, err := cache.New(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &namespacedCache{
+			namespaced: namespaced,
+			cluster:    cluster,
+			scheme:     opts.Scheme,
+			mapper:     opts.Mapper,
+		}, nil
+	}
+}
+
+// namespacedCache routes every object to the namespaced or the cluster-wide cache by its scope.
+type namespacedCache struct {
+	namespaced cache.Cache
+	cluster    cache.Cache
+	scheme     *runtime.Scheme
+	mapper     meta.RESTMapper
+}
+
+var _ cache.Cache = &namespacedCache{}
+
+func (c *namespacedCache) getCacheForKind(gvk schema.GroupVersionKind) (cache.Cache, error) {
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() == meta.RESTScopeNameRoot {
+		return c.cluster, nil
+	}
+	return c.namespaced, nil
+}
+
+func (c *namespacedCache) getCache(obj runtime.Object) (cache.Cache, error) {
+	gvk, err := apiutil.GVKForObject(obj, c.scheme)
+	if err != nil {
+		return nil, err
+	}
+	if meta.IsListType(obj) {
+		gvk.Kind = strings.TrimSuffix(gvk.Kind, "List")
+	}
+	return c.getCacheForKind(gvk)
+}
+
+// Get implements client.Reader.
+func (c *namespacedCache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	objectCache, err := c.getCache(obj)
+	if err != nil {
+		return err
+	}
+	return objectCache.Get(ctx, key, obj)
+}
+
+// List implements client.Reader.
+func (c *namespacedCache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	objectCache, err := c.getCache(list)
+	if err != nil {
+		return err
+	}
+	return objectCache.List(ctx, list, opts...)
+}
+
+// GetInformer implements cache.Informers.
+func (c *namespacedCache) GetInformer(ctx context.Context, obj runtime.Object) (cache.Informer, error) {
+	objectCache, err := c.getCache(obj)
+	if err != nil {
+		return nil, err
+	}
+	return objectCache.GetInformer(ctx, obj)
+}
+
+// GetInformerForKind implements cache.Informers.
+func (c *namespacedCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	objectCache, err := c.getCacheForKind(gvk)
+	if err != nil {
+		return nil, err
+	}
+	return objectCache.GetInformerForKind(ctx, gvk)
+}
+
+// Start implements cache.Informers.
+func (c *namespacedCache) Start(stopCh <-chan struct{}) error {
+	errCh := make(chan error, 2)
+	for _, informers := range []cache.Cache{c.namespaced, c.cluster} {
+		go func(informers cache.Cache) {
+			errCh <- informers.Start(stopCh)
+		}(informers)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForCacheSync implements cache.Informers.
+func (c *namespacedCache) WaitForCacheSync(stop <-chan struct{}) bool {
+	return c.namespaced.WaitForCacheSync(stop) && c.cluster.WaitForCacheSync(stop)
+}
+
+// IndexField implements client.FieldIndexer.
+func (c *namespacedCache) IndexField(ctx context.Context, obj runtime.Object, field string, extractValue client.IndexerFunc) error {
+	objectCache, err := c.getCache(obj)
+	if err != nil {
+		return err
+	}
+	return objectCache.IndexField(ctx, obj, field, extractValue)
+}
@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// namedCache tells caches apart in tests.
+type namedCache struct {
+	cache.Cache
+	name string
+}
+
+func TestNamespacedCache(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(corev1.SchemeGroupVersion.WithKind("Node"), meta.RESTScopeRoot)
+	mapper.Add(batchv1.SchemeGroupVersion.WithKind("Job"), meta.RESTScopeNamespace)
+	mapper.Add(djv2.GroupVersion.WithKind("DaemonJob"), meta.RESTScopeNamespace)
+	c := &namespacedCache{
+		namespaced: &namedCache{name: "namespaced"},
+		cluster:    &namedCache{name: "cluster"},
+		scheme:     getTestScheme(t),
+		mapper:     mapper,
+	}
+
+	for expected, objects := range map[string][]runtime.Object{
+		"cluster":    {&corev1.Node{}, &corev1.NodeList{}},
+		"namespaced": {&batchv1.Job{}, &batchv1.JobList{}, &djv2.DaemonJobList{}},
+	} {
+		for _, obj := range objects {
+			objectCache, err := c.getCache(obj)
+			require.NoError(t, err)
+			assert.Equal(t, expected, objectCache.(*namedCache).name, "%T", obj)
+		}
+	}
+
+	_, err := c.getCache(&corev1.Pod{})
+	assert.Error(t, err)
+}
@@ -18,6 +18,13 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
 	batchv1 "k8s.io/api/batch/v1"
@@ -26,72 +33,99 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	djv1 "github.com/Dysproz/DaemonJob/api/v1"
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+const (
+	// requeueInterval is how often a DaemonJob with unfinished nodes is checked for progress.
+	requeueInterval = 10 * time.Second
+
+	// maxJobNamePrefixLength keeps Job names within the 63 characters allowed for the job-name label.
+	maxJobNamePrefixLength = 52
+
+	// maxListedNodes is the number of nodes named in a condition message.
+	// The full list is available in the status.
+	maxListedNodes = 10
 )
 
 // DaemonJobReconciler reconciles a DaemonJob object
 type DaemonJobReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 }
 
 // +kubebuilder:rbac:groups=dj.dysproz.io,resources=daemonjobs,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=dj.dysproz.io,resources=daemonjobs/status,verbs=get;update;patch
-// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=dj.dysproz.io,resources=daemonjobs/finalizers,verbs=update
+// +kubebuilder:rbac:groups=dj.dysproz.io,resources=daemonjobtemplates,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
 // +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // SetupWithManager function specifies how the controller is built to watch a CR and
 // other resources that are owned and managed by that controller.
-func (r *DaemonJobReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	if err := ctrl.NewControllerManagedBy(mgr).
-		For(&djv1.DaemonJob{}).
-		Complete(r); err != nil {
-		return err
+// Options set the number of concurrent reconciles and the rate limiter of the controller.
+// With a shard, only DaemonJobs owned by the shard are reconciled.
+func (r *DaemonJobReconciler) SetupWithManager(mgr ctrl.Manager, options controller.Options, shard *Shard) error {
+	bldr := ctrl.NewControllerManagedBy(mgr).
+		WithOptions(options).
+		For(&djv2.DaemonJob{}).
+		Owns(&batchv1.Job{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, &handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(mapPodToDaemonJob)}).
+		Watches(&source.Kind{Type: &djv2.DaemonJobTemplate{}}, mapTemplateToDaemonJobs(mgr.GetClient(), r.Log.WithName("templates"))).
+		Watches(&source.Kind{Type: &corev1.Node{}},
+			&nodeEventHandler{client: mgr.GetClient(), log: r.Log.WithName("nodes")},
+			builder.WithPredicates(nodePredicate))
+	if shard == nil {
+		return bldr.Complete(r)
 	}
-
-	if err := ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Node{}).
-		Watches(&source.Kind{Type: &corev1.Node{}}, &handler.EnqueueRequestsFromMapFunc{
-			ToRequests: handler.ToRequestsFunc(func(nodeObject handler.MapObject) []reconcile.Request {
-				var djObjects djv1.DaemonJobList
-				_ = mgr.GetClient().List(context.TODO(), &djObjects)
-				var requests = []reconcile.Request{}
-				for _, djObject := range djObjects.Items {
-					requests = append(requests, reconcile.Request{
-						NamespacedName: types.NamespacedName{
-							Name:      djObject.Name,
-							Namespace: djObject.Namespace,
-						},
-					})
-				}
-				return requests
-			}),
-		}).
-		Complete(r); err != nil {
+	if err := mgr.Add(shard); err != nil {
 		return err
 	}
+	return bldr.
+		Watches(&source.Channel{Source: shard.events}, &handler.EnqueueRequestForObject{}).
+		Complete(&shardedReconciler{Reconciler: r, client: mgr.GetClient(), shard: shard})
+}
 
-	return nil
+// mapPodToDaemonJob returns the request of the DaemonJob that runs the pod.
+// Only pods labeled with the DaemonJob name are cached, see PodCacheBuilder. Jobs created before pods
+// got the label are still watched, and their pods are labeled when the Job is migrated.
+func mapPodToDaemonJob(podObject handler.MapObject) []reconcile.Request {
+	name, ok := podObject.Meta.GetLabels()[djv2.DaemonJobNameLabel]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{
+			Name:      name,
+			Namespace: podObject.Meta.GetNamespace(),
+		},
+	}}
 }
 
 // Reconcile method that implements the reconcile loop.
 // The reconcile loop is passed the Request argument which is a Namespace/Name key
 // used to lookup the primary resource object
 func (r *DaemonJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
-	_ = context.Background()
-	_ = r.Log.WithValues("daemonjob", req.NamespacedName)
-	r.Log.Info("Reconciling DaemonJob", "request name", req.Name, "request namespace", req.Namespace)
-	instance := &djv1.DaemonJob{}
-	instanceType := "daemonjob"
-	ctx := context.TODO()
+	log := r.Log.WithValues("daemonjob", req.NamespacedName)
+	log.V(1).Info("Reconciling DaemonJob")
+	instance := &djv2.DaemonJob{}
+	ctx := withLogger(context.TODO(), log)
 
 	if err := r.Client.Get(ctx, req.NamespacedName, instance); err != nil {
 		if errors.IsNotFound(err) {
@@ -101,90 +135,615 @@ func (r *DaemonJobReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	}
 
 	if !instance.GetDeletionTimestamp().IsZero() {
-		return reconcile.Result{}, nil
+		return r.reconcileTeardown(ctx, instance)
+	}
+	if err := r.updateTeardownFinalizer(ctx, instance); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	template, err := r.getPodTemplate(ctx, instance)
+	if err != nil {
+		r.Recorder.Event(instance, corev1.EventTypeWarning, "TemplateRenderFailed", err.Error())
+		return reconcile.Result{}, err
 	}
 
-	nodeSelector := map[string]string{}
-	if instance.Spec.Template.Spec.NodeSelector != nil {
-		nodeSelector = instance.Spec.Template.Spec.NodeSelector
+	nodeSelector, err := getNodeSelector(instance)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 	var nodes corev1.NodeList
-	if err := r.Client.List(ctx, &nodes, client.MatchingLabels(nodeSelector)); err != nil && errors.IsNotFound(err) {
-		return reconcile.Result{}, nil
+	if err := r.Client.List(ctx, &nodes, client.MatchingLabelsSelector{Selector: nodeSelector}); err != nil {
+		return reconcile.Result{}, err
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool { return nodes.Items[i].Name < nodes.Items[j].Name })
+
+	nodeJobs, orphanedJobs, err := r.getNodeJobs(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
-	jobReplicas := int32(len(nodes.Items))
-	job := getJob(instance, &jobReplicas, req.Name, instanceType)
-	err := controllerutil.SetControllerReference(instance, job, r.Scheme)
+	legacyJob, err := r.getLegacyJob(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	var legacyPods map[string]*corev1.Pod
+	if legacyJob != nil {
+		var stopping bool
+		if legacyPods, stopping, err = r.getLegacyPods(ctx, instance, legacyJob); err != nil {
+			return reconcile.Result{}, err
+		}
+		if stopping {
+			log.Info("Waiting for Job of earlier version to stop", "job", legacyJob.Name)
+			return reconcile.Result{RequeueAfter: requeueInterval}, nil
+		}
+		orphanedJobs = append(orphanedJobs, legacyJob)
+	}
+	runPods, err := r.getRunPods(ctx, instance)
 	if err != nil {
 		return reconcile.Result{}, err
 	}
 
-	var clusterJob batchv1.Job
-	clusterJob.ObjectMeta = job.ObjectMeta
-	_, err = ctrl.CreateOrUpdate(ctx, r, &clusterJob, func() error {
-		modifyJob(job, &clusterJob)
-		return controllerutil.SetControllerReference(instance, &clusterJob, r.Scheme)
-	})
+	maxParallel, err := getMaxParallel(instance, len(nodes.Items))
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	waves, err := getWaves(instance, nodes.Items)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+
+	overrideSelectors, err := getOverrideSelectors(instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	var busyNodes map[string]bool
+	if getPodReplacementPolicy(instance) == djv2.ReplaceFailed {
+		if busyNodes, err = r.getBusyNodes(ctx, instance); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+	var nodeIndexes map[string]int
+	if isIndexed(instance) {
+		nodeIndexes = getCompletionIndexes(nodes.Items, nodeJobs, runPods)
+	}
+	runID := getRunID(instance, template)
+	log = log.WithValues("runID", runID)
+	ctx = withLogger(ctx, log)
+	status := &djv2.DaemonJobStatus{DesiredNodes: int32(len(nodes.Items))}
+	var runningJobs []*batchv1.Job
+	var failedPods int32
+	waveStatuses := make([]djv2.WaveStatus, len(waves))
+	var pendingJobs []pendingJob
+	previousWavesFinished, canaryFailed, noCanaryNodes := true, false, false
+	for i, wave := range waves {
+		waveStatus := &waveStatuses[i]
+		waveStatus.Name = wave.name
+		waveStatus.Nodes = int32(len(wave.nodes))
+		for _, node := range wave.nodes {
+			nodeCtx := withLogger(ctx, log.WithValues("node", node.Name))
+			nodeTemplate, overrides, err := applyOverrides(instance, overrideSelectors, template, &node)
+			if err != nil {
+				r.Recorder.Event(instance, corev1.EventTypeWarning, "OverrideFailed", err.Error())
+				return reconcile.Result{}, err
+			}
+			nodeTemplate = renderNodeTemplate(nodeTemplate, &node, runID)
+			if isIndexed(instance) {
+				setCompletionIndex(nodeTemplate, nodeIndexes[node.Name])
+			}
+			job := getJob(instance, nodeTemplate, node.Name, runID)
+			if len(overrides) > 0 {
+				job.Annotations[djv2.OverridesAnnotation] = strings.Join(overrides, ",")
+			}
+			clusterJob, ok := nodeJobs[node.Name]
+			delete(nodeJobs, node.Name)
+			if pod := legacyPods[node.Name]; !ok && pod != nil {
+				if err := r.migrateLegacyPod(nodeCtx, instance, legacyJob, pod, job); err != nil {
+					return reconcile.Result{}, err
+				}
+				runPods[node.Name] = append(runPods[node.Name], *pod)
+			}
+			if !ok {
+				if orphan, rest := takeAdoptableJob(orphanedJobs, job); orphan != nil {
+					if err := r.adoptJob(nodeCtx, instance, orphan); err != nil {
+						return reconcile.Result{}, err
+					}
+					clusterJob, ok, orphanedJobs = orphan, true, rest
+				} else if pod := getSucceededPod(runPods[node.Name], job); pod != nil {
+					updateStatusWithPod(status, node.Name, pod)
+					waveStatus.Succeeded++
+					continue
+				}
+			}
+			if ok && clusterJob.Annotations[djv2.TemplateHashAnnotation] != job.Annotations[djv2.TemplateHashAnnotation] {
+				// Job spec is mostly immutable, so a changed template means the node has to run again.
+				// The replacement is created once the old Job is gone.
+				if err := r.deleteJob(nodeCtx, clusterJob); err != nil {
+					return reconcile.Result{}, err
+				}
+				status.PendingNodes++
+				continue
+			}
+			if ok && shouldRetry(instance, clusterJob) {
+				// The failed Job is kept, so the follow-up run gets a Job of its own.
+				setJobRetry(job, instance, getJobRetry(clusterJob)+1)
+				ok = false
+			}
+			if !ok {
+				if reason, message := getUnavailableReason(&node, nodeTemplate); reason != "" {
+					// The node does not hold back later waves, and runs once it becomes available.
+					waveStatus.Unavailable++
+					status.PendingNodes++
+					status.Nodes = append(status.Nodes, getPendingNodeStatus(job, reason, message))
+				} else if previousWavesFinished && !busyNodes[node.Name] {
+					pendingJobs = append(pendingJobs, pendingJob{job: job, wave: waveStatus})
+				} else {
+					status.PendingNodes++
+				}
+				continue
+			}
+			if err := r.updateJobMetadata(nodeCtx, clusterJob, job); err != nil {
+				return reconcile.Result{}, err
+			}
+			updateStatusWithJob(status, clusterJob, runPods[node.Name])
+			updateWaveStatusWithJob(waveStatus, clusterJob)
+			failedPods += clusterJob.Status.Failed
+			if finished, _ := getFinishedStatus(clusterJob); !finished {
+				runningJobs = append(runningJobs, clusterJob)
+			}
+		}
+		previousWavesFinished = previousWavesFinished && isWaveFinished(waveStatus)
+		if wave.name == canaryWaveName {
+			// The fleet starts only once a canary node proved the job works.
+			previousWavesFinished = previousWavesFinished && waveStatus.Succeeded > 0
+			canaryFailed = waveStatus.Failed > 0
+			noCanaryNodes = waveStatus.Nodes == 0 && len(nodes.Items) > 0
+		}
+	}
+
+	maxFailedNodes, err := getMaxFailedNodes(instance, len(nodes.Items))
 	if err != nil {
-		if errors.IsInvalid(err) {
-			_ = r.Client.Delete(ctx, &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: job.Name, Namespace: job.Namespace}}, client.PropagationPolicy("Background"))
-			return reconcile.Result{RequeueAfter: 5}, nil
+		return reconcile.Result{}, err
+	}
+	failureBudgetExceeded := maxFailedNodes > 0 && status.FailedNodes >= maxFailedNodes
+	now := time.Now()
+	fleetLimitReason, fleetLimitMessage := getFleetLimitExceeded(instance, status, failedPods, now)
+	if fleetLimitReason != "" {
+		for _, clusterJob := range runningJobs {
+			nodeCtx := withLogger(ctx, log.WithValues("node", clusterJob.Annotations[djv2.NodeNameAnnotation]))
+			if err := r.stopJob(nodeCtx, clusterJob, now); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+	halted := canaryFailed || noCanaryNodes || failureBudgetExceeded || fleetLimitReason != ""
+
+	for _, pending := range pendingJobs {
+		if halted || status.ActiveNodes >= maxParallel {
+			status.PendingNodes++
+			continue
+		}
+		if err := controllerutil.SetControllerReference(instance, pending.job, r.Scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := r.Client.Create(ctx, pending.job); err != nil && !errors.IsAlreadyExists(err) {
+			return reconcile.Result{}, err
+		}
+		log.Info("Created Job", "node", pending.job.Annotations[djv2.NodeNameAnnotation], "job", pending.job.Name)
+		status.ActiveNodes++
+		status.Nodes = append(status.Nodes, getNodeStatus(pending.job))
+		pending.wave.Active++
+	}
+
+	if err := r.cleanupStaleJobs(ctx, instance, orphanedJobs); err != nil {
+		return reconcile.Result{}, err
+	}
+
+	// Nodes that are no longer targeted should not keep running the job.
+	for _, clusterJob := range nodeJobs {
+		if finished, _ := getFinishedStatus(clusterJob); !finished {
+			nodeCtx := withLogger(ctx, log.WithValues("node", clusterJob.Annotations[djv2.NodeNameAnnotation]))
+			if err := r.deleteJob(nodeCtx, clusterJob); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+
+	sort.Strings(status.FailedNodeNames)
+	sort.Slice(status.Nodes, func(i, j int) bool { return status.Nodes[i].Name < status.Nodes[j].Name })
+	if hasRolloutWaves(instance) {
+		status.Rollout = getRolloutStatus(waveStatuses, halted)
+		r.recordRolloutEvents(instance, instance.Status.Rollout, status.Rollout)
+	}
+	if status.DesiredNodes > 0 && status.SucceededNodes == status.DesiredNodes {
+		status.Conditions = append(status.Conditions, getCondition(&instance.Status, djv2.DaemonJobComplete, "", ""))
+	}
+	if message := getUnavailableNodesMessage(status.Nodes); message != "" {
+		status.Conditions = append(status.Conditions, getCondition(&instance.Status, djv2.DaemonJobNodesUnavailable, "CannotStartPods", message))
+	}
+	if canaryFailed {
+		r.setFailedCondition(instance, status, "CanaryFailed", "Canary nodes failed, rollout halted")
+	} else if noCanaryNodes {
+		r.setFailedCondition(instance, status, "NoCanaryNodes", "No targeted node is selected as canary, rollout halted")
+	} else if failureBudgetExceeded {
+		r.setFailedCondition(instance, status, "FailureBudgetExceeded", getFailedNodesMessage(status.FailedNodeNames))
+	} else if fleetLimitReason != "" {
+		r.setFailedCondition(instance, status, fleetLimitReason, fleetLimitMessage)
+	}
+	if err := r.patchStatus(ctx, instance, status); err != nil {
+		if errors.IsConflict(err) {
+			log.Info("DaemonJob changed while reconciling, reconciling again")
+			return reconcile.Result{Requeue: true}, nil
 		}
 		return reconcile.Result{}, err
 	}
+	if status.ActiveNodes > 0 || (status.PendingNodes > 0 && !halted) {
+		return reconcile.Result{RequeueAfter: requeueInterval}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// setFailedCondition adds a Failed condition to the status and reports it in an Event when it is new.
+func (r *DaemonJobReconciler) setFailedCondition(instance *djv2.DaemonJob, status *djv2.DaemonJobStatus, reason, message string) {
+	if !hasCondition(&instance.Status, djv2.DaemonJobFailed, reason) {
+		r.Recorder.Event(instance, corev1.EventTypeWarning, reason, message)
+	}
+	status.Conditions = append(status.Conditions, getCondition(&instance.Status, djv2.DaemonJobFailed, reason, message))
+}
+
+// getNodeJobs returns the latest Jobs controlled by the DaemonJob indexed by the name of the node they run on.
+// Jobs carrying labels of the DaemonJob that were left behind, see isOrphanedJob, or that do not run on a node
+// are returned as orphaned Jobs.
+func (r *DaemonJobReconciler) getNodeJobs(ctx context.Context, instance *djv2.DaemonJob) (map[string]*batchv1.Job, []*batchv1.Job, error) {
+	var jobs batchv1.JobList
+	if err := r.Client.List(ctx, &jobs, client.InNamespace(instance.Namespace), client.MatchingLabels{djv2.DaemonJobNameLabel: instance.Name}); err != nil {
+		return nil, nil, err
+	}
+	nodeJobs := map[string]*batchv1.Job{}
+	var orphanedJobs []*batchv1.Job
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		if !metav1.IsControlledBy(job, instance) {
+			if isOrphanedJob(instance, job) {
+				orphanedJobs = append(orphanedJobs, job)
+			}
+			continue
+		}
+		if job.Labels[djv2.TeardownLabel] == "true" {
+			continue
+		}
+		nodeName, ok := job.Annotations[djv2.NodeNameAnnotation]
+		if !ok {
+			orphanedJobs = append(orphanedJobs, job)
+			continue
+		}
+		// Failed Jobs are kept after a retry, so only the latest Job of the node is relevant.
+		if latest, ok := nodeJobs[nodeName]; ok && getJobRetry(latest) > getJobRetry(job) {
+			continue
+		}
+		nodeJobs[nodeName] = job
+	}
+	return nodeJobs, orphanedJobs, nil
+}
+
+func (r *DaemonJobReconciler) deleteJob(ctx context.Context, job *batchv1.Job) error {
+	if job.DeletionTimestamp.IsZero() {
+		r.getLogger(ctx).Info("Deleting Job", "job", job.Name)
+	}
+	if err := r.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// getMaxParallel returns how many nodes may run the job at the same time.
+func getMaxParallel(instance *djv2.DaemonJob, nodeCount int) (int32, error) {
+	if instance.Spec.Rollout == nil || instance.Spec.Rollout.MaxParallel == nil {
+		return int32(nodeCount), nil
+	}
+	maxParallel, err := intstr.GetValueFromIntOrPercent(instance.Spec.Rollout.MaxParallel, nodeCount, true)
+	if err != nil {
+		return 0, err
+	}
+	if maxParallel < 1 {
+		maxParallel = 1
+	}
+	return int32(maxParallel), nil
+}
+
+// getFinishedStatus returns whether the Job has finished and with which condition.
+func getFinishedStatus(job *batchv1.Job) (bool, batchv1.JobConditionType) {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true, c.Type
+		}
+	}
+	return false, ""
+}
+
+// updateStatusWithJob accounts the node Job and the latest of its pods in the DaemonJob status.
+func updateStatusWithJob(status *djv2.DaemonJobStatus, job *batchv1.Job, pods []corev1.Pod) {
+	if job.Status.StartTime != nil && (status.StartTime == nil || job.Status.StartTime.Before(status.StartTime)) {
+		status.StartTime = job.Status.StartTime
+	}
+	if job.Status.CompletionTime != nil && (status.CompletionTime == nil || status.CompletionTime.Before(job.Status.CompletionTime)) {
+		status.CompletionTime = job.Status.CompletionTime
+	}
+	nodeStatus := getNodeStatus(job)
+	updateNodeStatusWithPod(&nodeStatus, getLatestJobPod(pods, job))
+	switch nodeStatus.Phase {
+	case djv2.NodeSucceeded:
+		status.SucceededNodes++
+	case djv2.NodeFailed:
+		status.FailedNodes++
+		status.FailedNodeNames = append(status.FailedNodeNames, nodeStatus.Name)
+	default:
+		status.ActiveNodes++
+	}
+	status.Nodes = append(status.Nodes, nodeStatus)
+}
+
+// getNodeStatus returns the progress of the node the Job runs on.
+func getNodeStatus(job *batchv1.Job) djv2.NodeStatus {
+	nodeStatus := djv2.NodeStatus{
+		Name:      job.Annotations[djv2.NodeNameAnnotation],
+		Phase:     djv2.NodeRunning,
+		Job:       job.Name,
+		Retries:   getJobRetry(job),
+		Overrides: getJobOverrides(job.Annotations),
+	}
+	switch _, condition := getFinishedStatus(job); condition {
+	case batchv1.JobComplete:
+		nodeStatus.Phase = djv2.NodeSucceeded
+	case batchv1.JobFailed:
+		nodeStatus.Phase = djv2.NodeFailed
+	}
+	return nodeStatus
+}
+
+// getPendingNodeStatus returns the status of a node whose Job cannot be created yet for the given reason.
+func getPendingNodeStatus(job *batchv1.Job, reason, message string) djv2.NodeStatus {
+	return djv2.NodeStatus{
+		Name:      job.Annotations[djv2.NodeNameAnnotation],
+		Phase:     djv2.NodePending,
+		Retries:   getJobRetry(job),
+		Overrides: getJobOverrides(job.Annotations),
+		Reason:    reason,
+		Message:   message,
+	}
+}
+
+// getJobRetry returns the number of times the node was retried before the Job was created.
+func getJobRetry(job *batchv1.Job) int32 {
+	retry, _ := strconv.Atoi(job.Annotations[djv2.RetryAnnotation])
+	return int32(retry)
+}
+
+// shouldRetry returns whether the node of the Job has to run again because the Job failed
+// before spec.rollout.retryFailedNodes was last changed.
+func shouldRetry(instance *djv2.DaemonJob, job *batchv1.Job) bool {
+	_, condition := getFinishedStatus(job)
+	return condition == batchv1.JobFailed && job.Annotations[djv2.RetryFailedNodesAnnotation] != getRetryFailedNodes(instance)
+}
+
+// getRetryFailedNodes returns spec.rollout.retryFailedNodes, or an empty string when there is no rollout block.
+func getRetryFailedNodes(instance *djv2.DaemonJob) string {
+	if instance.Spec.Rollout == nil {
+		return ""
+	}
+	return instance.Spec.Rollout.RetryFailedNodes
+}
+
+// setJobRetry turns the Job into the given retry of its node.
+func setJobRetry(job *batchv1.Job, instance *djv2.DaemonJob, retry int32) {
+	job.Name = getJobName(instance, job.Annotations[djv2.NodeNameAnnotation], retry)
+	job.Annotations[djv2.RetryAnnotation] = strconv.Itoa(int(retry))
+}
+
+// getMaxFailedNodes returns the number of failed nodes that halts the DaemonJob, or 0 when there is no limit.
+func getMaxFailedNodes(instance *djv2.DaemonJob, nodeCount int) (int32, error) {
+	if instance.Spec.Rollout == nil || instance.Spec.Rollout.MaxFailedNodes == nil {
+		return 0, nil
+	}
+	maxFailedNodes, err := intstr.GetValueFromIntOrPercent(instance.Spec.Rollout.MaxFailedNodes, nodeCount, true)
+	if err != nil {
+		return 0, err
+	}
+	if maxFailedNodes < 1 {
+		maxFailedNodes = 1
+	}
+	return int32(maxFailedNodes), nil
+}
+
+// getFailedNodesMessage lists failed nodes, shortening the list so that the condition message stays readable.
+func getFailedNodesMessage(failedNodes []string) string {
+	return fmt.Sprintf("%d nodes failed, rollout halted: %s", len(failedNodes), listNodes(failedNodes))
+}
+
+// getUnavailableNodesMessage lists nodes that cannot start a pod together with the reason.
+func getUnavailableNodesMessage(nodes []djv2.NodeStatus) string {
+	var listed []string
+	for _, node := range nodes {
+		if node.Phase == djv2.NodePending && node.Reason != "" {
+			listed = append(listed, fmt.Sprintf("%s (%s)", node.Name, node.Reason))
+		}
+	}
+	if len(listed) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d nodes cannot start pods: %s", len(listed), listNodes(listed))
+}
+
+// listNodes joins names of nodes, naming at most maxListedNodes of them.
+func listNodes(nodes []string) string {
+	listed := nodes
+	if len(listed) > maxListedNodes {
+		listed = listed[:maxListedNodes]
+	}
+	message := strings.Join(listed, ", ")
+	if len(nodes) > len(listed) {
+		message += fmt.Sprintf(" and %d more", len(nodes)-len(listed))
+	}
+	return message
+}
+
+// hasCondition returns whether the status has a true condition of the given type and reason.
+func hasCondition(status *djv2.DaemonJobStatus, conditionType djv2.DaemonJobConditionType, reason string) bool {
+	for _, c := range status.Conditions {
+		if c.Type == conditionType && c.Status == corev1.ConditionTrue && c.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// getCondition returns a true condition of the given type, reusing the previously reported one
+// so that its transition time is preserved.
+func getCondition(previous *djv2.DaemonJobStatus, conditionType djv2.DaemonJobConditionType, reason, message string) djv2.DaemonJobCondition {
+	for _, c := range previous.Conditions {
+		if c.Type == conditionType && c.Status == corev1.ConditionTrue && c.Reason == reason {
+			c.Message = message
+			return c
+		}
+	}
+	now := metav1.Now()
+	return djv2.DaemonJobCondition{
+		Type:               conditionType,
+		Status:             corev1.ConditionTrue,
+		LastProbeTime:      now,
+		LastTransitionTime: now,
+		Reason:             reason,
+		Message:            message,
+	}
+}
 
-	instance.Status = &clusterJob.Status
+// getJobName returns the name of the Job running the given retry of the DaemonJob on the node.
+func getJobName(instance *djv2.DaemonJob, nodeName string, retry int32) string {
+	if retry > 0 {
+		return getHashedName(instance, fmt.Sprintf("%s/%d", nodeName, retry))
+	}
+	return getHashedName(instance, nodeName)
+}
 
-	return ctrl.Result{}, r.Client.Status().Update(context.TODO(), instance)
+// getHashedName returns the name of the DaemonJob followed by a hash of the key.
+// Node names can be long, so they are represented by a hash to keep the name a valid label value.
+// Long DaemonJob names are shortened and end with a hash of the namespace and name of the DaemonJob instead,
+// so that DaemonJobs sharing the beginning of their names get Jobs of their own.
+func getHashedName(instance *djv2.DaemonJob, key string) string {
+	prefix := instance.Name
+	if len(prefix) > maxJobNamePrefixLength {
+		nameHash := getShortHash(instance.Namespace + "/" + instance.Name)
+		prefix = strings.TrimRight(prefix[:maxJobNamePrefixLength-len(nameHash)-1], "-.") + "-" + nameHash
+	}
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(key))
+	return prefix + "-" + rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
 }
 
-func getJob(instance *djv1.DaemonJob, replicas *int32, reqName, instanceType string) *batchv1.Job {
+// getShortHash returns a five character hash of the value.
+func getShortHash(value string) string {
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(value))
+	return rand.SafeEncodeString(fmt.Sprintf("%05d", hasher.Sum32()%100000))
+}
+
+// getTemplateHash returns the hash of the Job spec used to detect template changes.
+// The completion index is left out, so that Jobs are not run again when indexes are assigned differently.
+func getTemplateHash(spec *batchv1.JobSpec) string {
+	data, _ := json.Marshal(withoutCompletionIndex(spec))
+	hasher := fnv.New32a()
+	_, _ = hasher.Write(data)
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// getJob returns the Job running the pod template on the node as part of the run.
+func getJob(instance *djv2.DaemonJob, podTemplate *corev1.PodTemplateSpec, nodeName, runID string) *batchv1.Job {
+	template := podTemplate.DeepCopy()
+	// Pods keep the node selector in their spec, so that Jobs created from v1 DaemonJobs stay up to date.
+	template.Spec.NodeSelector = instance.Spec.Nodes.NodeSelector
+	job := newNodeJob(instance, template, &instance.Spec.JobTemplate.Spec, getJobName(instance, nodeName, 0), nodeName, runID,
+		getNodeSelectorRequirements(instance))
+	if retryFailedNodes := getRetryFailedNodes(instance); retryFailedNodes != "" {
+		job.Annotations[djv2.RetryFailedNodesAnnotation] = retryFailedNodes
+	}
+	return job
+}
+
+// newNodeJob returns a Job with a single pod created from the template and pinned to the node.
+// The pod is labeled with the DaemonJob name and the run ID, and keeps away from other pods of the run.
+// Limits of the Job are taken from jobSpec, when set.
+// Node requirements further constrain the node the pod may be scheduled on.
+func newNodeJob(instance *djv2.DaemonJob, template *corev1.PodTemplateSpec, jobSpec *djv2.JobSpec, name, nodeName, runID string,
+	nodeRequirements []corev1.NodeSelectorRequirement) *batchv1.Job {
 	var jobAffinity = corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchFields: []corev1.NodeSelectorRequirement{{
+						Key:      "metadata.name",
+						Operator: corev1.NodeSelectorOpIn,
+						Values:   []string{nodeName},
+					}},
+					MatchExpressions: nodeRequirements,
+				}},
+			},
+		},
 		PodAntiAffinity: &corev1.PodAntiAffinity{
 			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
 				LabelSelector: &metav1.LabelSelector{
-					MatchExpressions: []metav1.LabelSelectorRequirement{{
-						Key:      instanceType,
-						Operator: "In",
-						Values:   []string{reqName},
-					}},
+					MatchLabels: map[string]string{
+						djv2.DaemonJobNameLabel: instance.Name,
+						djv2.DaemonJobRunLabel:  runID,
+					},
 				},
 				TopologyKey: "kubernetes.io/hostname",
 			}},
 		},
 	}
 
-	var podSpec = instance.Spec.Template
+	var podSpec = *template.DeepCopy()
 	podSpec.Spec.Affinity = &jobAffinity
-
-	if podSpec.Spec.RestartPolicy == "Always" {
-		podSpec.Spec.RestartPolicy = "OnFailure"
+	// The defaulting webhook already sets a restart policy Jobs accept, but DaemonJobs stored before it
+	// existed or created with webhooks disabled may still carry none, which means Always.
+	if podSpec.Spec.RestartPolicy == "" || podSpec.Spec.RestartPolicy == corev1.RestartPolicyAlways {
+		podSpec.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
 	}
+	labelPolicy, annotationPolicy := getPropagationPolicies(instance)
+	podSpec.Labels = mergeStringMaps(getPropagatedMetadata(instance.Labels, labelPolicy, true), podSpec.Labels)
+	podSpec.Labels = mergeStringMaps(podSpec.Labels, map[string]string{
+		djv2.DaemonJobNameLabel: instance.Name,
+		djv2.DaemonJobRunLabel:  runID,
+	})
+	podSpec.Annotations = mergeStringMaps(getPropagatedMetadata(instance.Annotations, annotationPolicy, true), podSpec.Annotations)
+
+	jobMetadata := &instance.Spec.JobTemplate.Metadata
+	labels := mergeStringMaps(getPropagatedMetadata(instance.Labels, labelPolicy, false), jobMetadata.Labels)
+	labels = mergeStringMaps(labels, map[string]string{djv2.DaemonJobNameLabel: instance.Name})
+	annotations := mergeStringMaps(getPropagatedMetadata(instance.Annotations, annotationPolicy, false), jobMetadata.Annotations)
+	annotations = mergeStringMaps(annotations, map[string]string{djv2.NodeNameAnnotation: nodeName})
 
-	return &batchv1.Job{
+	var replicas int32 = 1
+	job := &batchv1.Job{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Job",
 			APIVersion: "batch/v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      instance.Name + "-job",
-			Namespace: instance.Namespace,
-			Labels:    instance.Labels,
+			Name:        name,
+			Namespace:   instance.Namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 		Spec: batchv1.JobSpec{
-			Parallelism:             replicas,
-			Completions:             replicas,
-			Selector:                instance.Spec.Selector,
-			Template:                podSpec,
-			ManualSelector:          instance.Spec.ManualSelector,
-			TTLSecondsAfterFinished: instance.Spec.TTLSecondsAfterFinished,
-			BackoffLimit:            instance.Spec.BackoffLimit,
-			ActiveDeadlineSeconds:   instance.Spec.ActiveDeadlineSeconds,
+			Parallelism: &replicas,
+			Completions: &replicas,
+			Template:    podSpec,
 		},
 	}
-}
-
-func modifyJob(job, clusterJob *batchv1.Job) {
-	clusterJob.Spec = job.Spec
-	clusterJob.Annotations = job.Annotations
+	if jobSpec != nil {
+		job.Spec.BackoffLimit = jobSpec.BackoffLimit
+		job.Spec.ActiveDeadlineSeconds = jobSpec.ActiveDeadlineSeconds
+	}
+	job.Annotations[djv2.TemplateHashAnnotation] = getTemplateHash(&job.Spec)
+	setRunMetadata(job, runID)
+	return job
 }
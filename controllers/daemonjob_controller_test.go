@@ -2,6 +2,8 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -10,12 +12,19 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
-	djv1 "github.com/Dysproz/DaemonJob/api/v1"
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
 )
 
 var daemonjobName = types.NamespacedName{
@@ -23,18 +32,22 @@ var daemonjobName = types.NamespacedName{
 	Name:      "test-daemonjob",
 }
 
-var daemonjobCR = &djv1.DaemonJob{
+var daemonjobCR = &djv2.DaemonJob{
 	ObjectMeta: metav1.ObjectMeta{
 		Namespace: daemonjobName.Namespace,
 		Name:      daemonjobName.Name,
 	},
-	Spec: djv1.DaemonJobSpec{
-		Template: corev1.PodTemplateSpec{
-			Spec: corev1.PodSpec{
-				Containers: []corev1.Container{
-					{
-						Image: "test-image",
-						Name:  "test-container",
+	Spec: djv2.DaemonJobSpec{
+		JobTemplate: djv2.JobTemplateSpec{
+			Spec: djv2.JobSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{
+							{
+								Image: "test-image",
+								Name:  "test-container",
+							},
+						},
 					},
 				},
 			},
@@ -44,151 +57,350 @@ var daemonjobCR = &djv1.DaemonJob{
 
 var trueVal = true
 
-func TestDaemonJobController(t *testing.T) {
-	scheme, err := djv1.SchemeBuilder.Build()
+func getTestNode(name string, labels map[string]string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Status: corev1.NodeStatus{
+			Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+		},
+	}
+}
+
+func getTestScheme(t *testing.T) *runtime.Scheme {
+	scheme, err := djv2.SchemeBuilder.Build()
 	require.NoError(t, err)
 	require.NoError(t, corev1.SchemeBuilder.AddToScheme(scheme))
 	require.NoError(t, batchv1.SchemeBuilder.AddToScheme(scheme))
+	return scheme
+}
 
-	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR)
-	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme}
-	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+func getJobs(t *testing.T, c client.Client) []batchv1.Job {
+	var jobs batchv1.JobList
+	require.NoError(t, c.List(context.Background(), &jobs, client.InNamespace(daemonjobName.Namespace)))
+	return jobs.Items
+}
+
+func getDaemonJob(t *testing.T, c client.Client) *djv2.DaemonJob {
+	instance := &djv2.DaemonJob{}
+	require.NoError(t, c.Get(context.Background(), daemonjobName, instance))
+	return instance
+}
+
+func finishJob(t *testing.T, c client.Client, job batchv1.Job, condition batchv1.JobConditionType) {
+	job.Status.Conditions = []batchv1.JobCondition{{Type: condition, Status: corev1.ConditionTrue}}
+	require.NoError(t, c.Status().Update(context.Background(), &job))
+}
+
+func completeJob(t *testing.T, c client.Client, job batchv1.Job) {
+	finishJob(t, c, job, batchv1.JobComplete)
+}
+
+func failJob(t *testing.T, c client.Client, job batchv1.Job) {
+	finishJob(t, c, job, batchv1.JobFailed)
+}
+
+func TestDaemonJobController(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR, getTestNode("node-a", nil), getTestNode("node-b", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
 	assert.NoError(t, err)
 
-	t.Run("should create job for daemonjob", func(t *testing.T) {
-		job := &batchv1.Job{}
-		err = fakeClient.Get(context.Background(), types.NamespacedName{
-			Name:      "test-daemonjob-job",
-			Namespace: "default",
-		}, job)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, job)
-		expectedOwnerRefs := []metav1.OwnerReference{{
-			APIVersion: "dj.dysproz.io/v1", Kind: "DaemonJob", Name: "test-daemonjob",
-			Controller: &trueVal, BlockOwnerDeletion: &trueVal,
-		}}
-		assert.Equal(t, expectedOwnerRefs, job.OwnerReferences)
-		var expectedCompletions int32 = 0
-		assert.Equal(t, &expectedCompletions, job.Spec.Completions)
+	t.Run("should create job for every node", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 2)
+		nodes := []string{}
+		for _, job := range jobs {
+			expectedOwnerRefs := []metav1.OwnerReference{{
+				APIVersion: "dj.dysproz.io/v2", Kind: "DaemonJob", Name: "test-daemonjob",
+				Controller: &trueVal, BlockOwnerDeletion: &trueVal,
+			}}
+			assert.Equal(t, expectedOwnerRefs, job.OwnerReferences)
+			var expectedCompletions int32 = 1
+			assert.Equal(t, &expectedCompletions, job.Spec.Completions)
+			assert.Equal(t, &expectedCompletions, job.Spec.Parallelism)
+			assert.Equal(t, "test-daemonjob", job.Labels[djv2.DaemonJobNameLabel])
+			nodes = append(nodes, job.Annotations[djv2.NodeNameAnnotation])
+		}
+		assert.ElementsMatch(t, []string{"node-a", "node-b"}, nodes)
+	})
+
+	t.Run("should report nodes in status", func(t *testing.T) {
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(2), status.DesiredNodes)
+		assert.Equal(t, int32(2), status.ActiveNodes)
+		assert.Equal(t, int32(0), status.PendingNodes)
+		assert.Nil(t, status.Rollout)
 	})
 }
 
 func TestDaemonJobControllerUpdate(t *testing.T) {
-	scheme, err := djv1.SchemeBuilder.Build()
+	scheme := getTestScheme(t)
+
+	staleJob := getJob(daemonjobCR, &daemonjobCR.Spec.JobTemplate.Spec.Template, "node-a", "test-run")
+	staleJob.Annotations[djv2.TemplateHashAnnotation] = "stale"
+	require.NoError(t, controllerutil.SetControllerReference(daemonjobCR, staleJob, scheme))
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR, getTestNode("node-a", nil), staleJob)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	assert.NoError(t, err)
+
+	t.Run("should delete job with outdated template", func(t *testing.T) {
+		assert.Empty(t, getJobs(t, fakeClient))
+		assert.Equal(t, int32(1), getDaemonJob(t, fakeClient).Status.PendingNodes)
+	})
+
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	assert.NoError(t, err)
+
+	t.Run("should recreate job with current template", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.NotEqual(t, "stale", jobs[0].Annotations[djv2.TemplateHashAnnotation])
+	})
+}
+
+func TestDaemonJobControllerMaxParallel(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	maxParallel := intstr.FromString("50%")
+	instance.Spec.Rollout = &djv2.Rollout{MaxParallel: &maxParallel}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance,
+		getTestNode("node-a", nil), getTestNode("node-b", nil), getTestNode("node-c", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	assert.NoError(t, err)
+
+	t.Run("should start only maxParallel nodes", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 2)
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(3), status.DesiredNodes)
+		assert.Equal(t, int32(2), status.ActiveNodes)
+		assert.Equal(t, int32(1), status.PendingNodes)
+		assert.Equal(t, requeueInterval, result.RequeueAfter)
+	})
+
+	completeJob(t, fakeClient, getJobs(t, fakeClient)[0])
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	assert.NoError(t, err)
+
+	t.Run("should start next node when one finishes", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 3)
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(1), status.SucceededNodes)
+		assert.Equal(t, int32(2), status.ActiveNodes)
+		assert.Equal(t, int32(0), status.PendingNodes)
+	})
+
+	for _, job := range getJobs(t, fakeClient) {
+		completeJob(t, fakeClient, job)
+	}
+	result, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	assert.NoError(t, err)
+
+	t.Run("should be complete when every node succeeded", func(t *testing.T) {
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(3), status.SucceededNodes)
+		require.Len(t, status.Conditions, 1)
+		assert.Equal(t, djv2.DaemonJobComplete, status.Conditions[0].Type)
+		assert.Zero(t, result.RequeueAfter)
+	})
+}
+
+func TestDaemonJobControllerFailurePolicy(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	maxParallel := intstr.FromInt(2)
+	maxFailedNodes := intstr.FromString("25%")
+	instance.Spec.Rollout = &djv2.Rollout{MaxParallel: &maxParallel, MaxFailedNodes: &maxFailedNodes}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil),
+		getTestNode("node-b", nil), getTestNode("node-c", nil), getTestNode("node-d", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	failJob(t, fakeClient, getJobs(t, fakeClient)[0])
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
 	require.NoError(t, err)
-	require.NoError(t, corev1.SchemeBuilder.AddToScheme(scheme))
-	require.NoError(t, batchv1.SchemeBuilder.AddToScheme(scheme))
 
-	var mockCompletions int32 = 6
-	jobCR := &batchv1.Job{
-		ObjectMeta: metav1.ObjectMeta{
-			Namespace: "default",
-			Name:      "test-daemonjob-job",
-		},
-		Spec: batchv1.JobSpec{
-			Completions: &mockCompletions,
-		},
+	t.Run("should stop starting nodes when failure budget is exceeded", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 2)
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(1), status.FailedNodes)
+		assert.Equal(t, int32(1), status.ActiveNodes)
+		assert.Equal(t, int32(2), status.PendingNodes)
+		assert.Equal(t, []string{"node-a"}, status.FailedNodeNames)
+		require.Len(t, status.Conditions, 1)
+		assert.Equal(t, djv2.DaemonJobFailed, status.Conditions[0].Type)
+		assert.Equal(t, "FailureBudgetExceeded", status.Conditions[0].Reason)
+		assert.Equal(t, "1 nodes failed, rollout halted: node-a", status.Conditions[0].Message)
+		assert.Equal(t, "Warning FailureBudgetExceeded 1 nodes failed, rollout halted: node-a", <-recorder.Events)
+		assert.Equal(t, requeueInterval, result.RequeueAfter)
+	})
+
+	for _, job := range getJobs(t, fakeClient) {
+		if job.Annotations[djv2.NodeNameAnnotation] != "node-a" {
+			completeJob(t, fakeClient, job)
+		}
+	}
+	result, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should leave untouched nodes untouched", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 2)
+		assert.Equal(t, int32(2), getDaemonJob(t, fakeClient).Status.PendingNodes)
+		assert.Zero(t, result.RequeueAfter)
+		assert.Empty(t, recorder.Events)
+	})
+}
+
+func TestDaemonJobControllerRetryFailedNodes(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR.DeepCopy(), getTestNode("node-a", nil), getTestNode("node-b", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	for _, job := range getJobs(t, fakeClient) {
+		if job.Annotations[djv2.NodeNameAnnotation] == "node-a" {
+			failJob(t, fakeClient, job)
+		} else {
+			completeJob(t, fakeClient, job)
+		}
 	}
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
 
-	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR, jobCR)
-	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme}
-	t.Run("should have daemonjob job with 6 completions", func(t *testing.T) {
-		job := &batchv1.Job{}
-		err = fakeClient.Get(context.Background(), types.NamespacedName{
-			Name:      "test-daemonjob-job",
-			Namespace: "default",
-		}, job)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, job)
-		var expectedCompletions int32 = 6
-		assert.Equal(t, &expectedCompletions, job.Spec.Completions)
+	t.Run("should not retry failed nodes by itself", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 2)
+		assert.Equal(t, []string{"node-a"}, getDaemonJob(t, fakeClient).Status.FailedNodeNames)
 	})
 
+	instance := getDaemonJob(t, fakeClient)
+	instance.Spec.Rollout = &djv2.Rollout{RetryFailedNodes: "1"}
+	require.NoError(t, fakeClient.Update(context.Background(), instance))
 	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
-	assert.NoError(t, err)
+	require.NoError(t, err)
+
+	t.Run("should start follow-up run only on failed nodes", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		assert.Len(t, jobs, 3)
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Empty(t, status.FailedNodes)
+		assert.Equal(t, int32(1), status.ActiveNodes)
+		assert.Equal(t, int32(1), status.SucceededNodes)
+		assert.Equal(t, []djv2.NodeStatus{
+			{Name: "node-a", Phase: djv2.NodeRunning, Job: getJobName(daemonjobCR, "node-a", 1), Retries: 1},
+			{Name: "node-b", Phase: djv2.NodeSucceeded, Job: getJobName(daemonjobCR, "node-b", 0)},
+		}, status.Nodes)
+	})
+
+	for _, job := range getJobs(t, fakeClient) {
+		if job.Name == getJobName(daemonjobCR, "node-a", 1) {
+			failJob(t, fakeClient, job)
+		}
+	}
 	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should retry failed nodes once per trigger", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 3)
+		assert.Equal(t, []string{"node-a"}, getDaemonJob(t, fakeClient).Status.FailedNodeNames)
+	})
+}
+
+func TestGetFailedNodesMessage(t *testing.T) {
+	nodes := []string{}
+	for i := 0; i < 12; i++ {
+		nodes = append(nodes, fmt.Sprintf("node-%d", i))
+	}
+	assert.Equal(t, "12 nodes failed, rollout halted: node-0, node-1, node-2, node-3, node-4, "+
+		"node-5, node-6, node-7, node-8, node-9 and 2 more", getFailedNodesMessage(nodes))
+}
+
+func TestGetMaxParallel(t *testing.T) {
+	instance := daemonjobCR.DeepCopy()
+	maxParallel, err := getMaxParallel(instance, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(10), maxParallel)
+
+	fixed := intstr.FromInt(3)
+	instance.Spec.Rollout = &djv2.Rollout{MaxParallel: &fixed}
+	maxParallel, err = getMaxParallel(instance, 10)
 	assert.NoError(t, err)
+	assert.Equal(t, int32(3), maxParallel)
 
-	t.Run("should update job for daemonjob", func(t *testing.T) {
-		job := &batchv1.Job{}
-		err = fakeClient.Get(context.Background(), types.NamespacedName{
-			Name:      "test-daemonjob-job",
-			Namespace: "default",
-		}, job)
-		assert.NoError(t, err)
-		assert.NotEmpty(t, job)
-		var expectedCompletions int32 = 0
-		assert.Equal(t, expectedCompletions, *job.Spec.Completions)
+	percent := intstr.FromString("1%")
+	instance.Spec.Rollout.MaxParallel = &percent
+	maxParallel, err = getMaxParallel(instance, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), maxParallel)
+}
+
+func TestGetJobName(t *testing.T) {
+	instance := daemonjobCR.DeepCopy()
+	assert.NotEqual(t, getJobName(instance, "node-a", 0), getJobName(instance, "node-b", 0))
+	assert.NotEqual(t, getJobName(instance, "node-a", 0), getJobName(instance, "node-a", 1))
+	assert.Equal(t, getJobName(instance, "node-a", 0), getJobName(instance, "node-a", 0))
+	assert.True(t, strings.HasPrefix(getJobName(instance, "node-a", 0), "test-daemonjob-"))
+
+	instance.Name = strings.Repeat("a", 253)
+	assert.LessOrEqual(t, len(getJobName(instance, strings.Repeat("b", 253), 10)), 63)
+
+	t.Run("should keep long names of different DaemonJobs apart", func(t *testing.T) {
+		long, other := daemonjobCR.DeepCopy(), daemonjobCR.DeepCopy()
+		long.Name = strings.Repeat("a", 46) + "-cleanup.x-1"
+		other.Name = strings.Repeat("a", 46) + "-cleanup.x-2"
+		assert.NotEqual(t, getJobName(long, "node-a", 0), getJobName(other, "node-a", 0))
+		other.Name, other.Namespace = long.Name, "other"
+		assert.NotEqual(t, getJobName(long, "node-a", 0), getJobName(other, "node-a", 0))
+	})
+
+	t.Run("should not leave separators before the hash", func(t *testing.T) {
+		long := daemonjobCR.DeepCopy()
+		long.Name = strings.Repeat("a", 45) + "-.b" + strings.Repeat("c", 20)
+		name := getJobName(long, "node-a", 0)
+		assert.Regexp(t, "^a{45}-[a-z0-9]{5}-[a-z0-9]+$", name)
+		assert.Empty(t, validation.IsDNS1123Label(name))
 	})
 }
 
 func TestGetJob(t *testing.T) {
-	var replicas int32 = 6
+	var replicas int32 = 1
 	expectedJob := &batchv1.Job{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Job",
 			APIVersion: "batch/v1",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      daemonjobCR.Name + "-job",
+			Name:      getJobName(daemonjobCR, "test-node", 0),
 			Namespace: daemonjobCR.Namespace,
-			Labels:    daemonjobCR.Labels,
+			Labels: map[string]string{
+				djv2.DaemonJobNameLabel: daemonjobCR.Name,
+				djv2.DaemonJobRunLabel:  "test-run",
+			},
 		},
 		Spec: batchv1.JobSpec{
 			Parallelism: &replicas,
 			Completions: &replicas,
-			Selector:    daemonjobCR.Spec.Selector,
 			Template: corev1.PodTemplateSpec{
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "test-container",
-							Image: "test-image",
-						},
-					},
-					RestartPolicy: "OnFailure",
-					Affinity: &corev1.Affinity{
-						PodAntiAffinity: &corev1.PodAntiAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
-								LabelSelector: &metav1.LabelSelector{
-									MatchExpressions: []metav1.LabelSelectorRequirement{{
-										Key:      "daemonjob",
-										Operator: "In",
-										Values:   []string{"test-req"},
-									}},
-								},
-								TopologyKey: "kubernetes.io/hostname",
-							}},
-						},
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						djv2.DaemonJobNameLabel: daemonjobCR.Name,
+						djv2.DaemonJobRunLabel:  "test-run",
 					},
 				},
-			},
-			ManualSelector:          daemonjobCR.Spec.ManualSelector,
-			TTLSecondsAfterFinished: daemonjobCR.Spec.TTLSecondsAfterFinished,
-			BackoffLimit:            daemonjobCR.Spec.BackoffLimit,
-			ActiveDeadlineSeconds:   daemonjobCR.Spec.ActiveDeadlineSeconds,
-		},
-	}
-	assert.ObjectsAreEqual(expectedJob, getJob(daemonjobCR, &replicas, "test-req", "daemonjob"))
-}
-
-func TestModifyJob(t *testing.T) {
-	var replicas int32 = 6
-	expectedJob := &batchv1.Job{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Job",
-			APIVersion: "batch/v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      daemonjobCR.Name + "-job",
-			Namespace: daemonjobCR.Namespace,
-			Labels:    daemonjobCR.Labels,
-		},
-		Spec: batchv1.JobSpec{
-			Parallelism: &replicas,
-			Completions: &replicas,
-			Selector:    daemonjobCR.Spec.Selector,
-			Template: corev1.PodTemplateSpec{
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
 						{
@@ -196,59 +408,26 @@ func TestModifyJob(t *testing.T) {
 							Image: "test-image",
 						},
 					},
-					RestartPolicy: "OnFailure",
+					RestartPolicy: corev1.RestartPolicyOnFailure,
 					Affinity: &corev1.Affinity{
-						PodAntiAffinity: &corev1.PodAntiAffinity{
-							RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
-								LabelSelector: &metav1.LabelSelector{
-									MatchExpressions: []metav1.LabelSelectorRequirement{{
-										Key:      "daemonjob",
-										Operator: "In",
-										Values:   []string{"test-req"},
+						NodeAffinity: &corev1.NodeAffinity{
+							RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+								NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+									MatchFields: []corev1.NodeSelectorRequirement{{
+										Key:      "metadata.name",
+										Operator: corev1.NodeSelectorOpIn,
+										Values:   []string{"test-node"},
 									}},
-								},
-								TopologyKey: "kubernetes.io/hostname",
-							}},
-						},
-					},
-				},
-			},
-			ManualSelector:          daemonjobCR.Spec.ManualSelector,
-			TTLSecondsAfterFinished: daemonjobCR.Spec.TTLSecondsAfterFinished,
-			BackoffLimit:            daemonjobCR.Spec.BackoffLimit,
-			ActiveDeadlineSeconds:   daemonjobCR.Spec.ActiveDeadlineSeconds,
-		},
-	}
-	controllerJob := &batchv1.Job{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Job",
-			APIVersion: "batch/v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      daemonjobCR.Name + "-job",
-			Namespace: daemonjobCR.Namespace,
-		},
-		Spec: batchv1.JobSpec{
-			Parallelism: &replicas,
-			Completions: &replicas,
-			Template: corev1.PodTemplateSpec{
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  "test-container",
-							Image: "test-image",
+								}},
+							},
 						},
-					},
-					RestartPolicy: "OnFailure",
-					Affinity: &corev1.Affinity{
 						PodAntiAffinity: &corev1.PodAntiAffinity{
 							RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
 								LabelSelector: &metav1.LabelSelector{
-									MatchExpressions: []metav1.LabelSelectorRequirement{{
-										Key:      "daemonjob",
-										Operator: "In",
-										Values:   []string{"test-req"},
-									}},
+									MatchLabels: map[string]string{
+										djv2.DaemonJobNameLabel: daemonjobCR.Name,
+										djv2.DaemonJobRunLabel:  "test-run",
+									},
 								},
 								TopologyKey: "kubernetes.io/hostname",
 							}},
@@ -256,27 +435,61 @@ func TestModifyJob(t *testing.T) {
 					},
 				},
 			},
-			ManualSelector:          daemonjobCR.Spec.ManualSelector,
-			TTLSecondsAfterFinished: daemonjobCR.Spec.TTLSecondsAfterFinished,
-			BackoffLimit:            daemonjobCR.Spec.BackoffLimit,
-			ActiveDeadlineSeconds:   daemonjobCR.Spec.ActiveDeadlineSeconds,
+			BackoffLimit:          daemonjobCR.Spec.JobTemplate.Spec.BackoffLimit,
+			ActiveDeadlineSeconds: daemonjobCR.Spec.JobTemplate.Spec.ActiveDeadlineSeconds,
 		},
 	}
+	expectedJob.Annotations = map[string]string{
+		djv2.NodeNameAnnotation:     "test-node",
+		djv2.TemplateHashAnnotation: getTemplateHash(&expectedJob.Spec),
+	}
+	expectedJob.Spec.Template.Annotations = map[string]string{
+		djv2.NodeNameAnnotation:     "test-node",
+		djv2.TemplateHashAnnotation: expectedJob.Annotations[djv2.TemplateHashAnnotation],
+	}
+	assert.Equal(t, expectedJob, getJob(daemonjobCR, &daemonjobCR.Spec.JobTemplate.Spec.Template, "test-node", "test-run"))
+}
 
-	bareJob := &batchv1.Job{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "Job",
-			APIVersion: "batch/v1",
-		},
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      daemonjobCR.Name + "-job",
-			Namespace: daemonjobCR.Namespace,
-			Labels:    daemonjobCR.Labels,
-		},
-		Spec: batchv1.JobSpec{
-			Selector: daemonjobCR.Spec.Selector,
-		},
+func TestGetJobRestartPolicy(t *testing.T) {
+	for _, policy := range []corev1.RestartPolicy{"", corev1.RestartPolicyAlways} {
+		instance := daemonjobCR.DeepCopy()
+		instance.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy = policy
+		job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "test-node", "test-run")
+		assert.Equal(t, corev1.RestartPolicyOnFailure, job.Spec.Template.Spec.RestartPolicy)
 	}
-	modifyJob(controllerJob, bareJob)
-	assert.ObjectsAreEqual(expectedJob, bareJob)
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "test-node", "test-run")
+	assert.Equal(t, corev1.RestartPolicyNever, job.Spec.Template.Spec.RestartPolicy)
+}
+
+func TestGetJobSharedFields(t *testing.T) {
+	instance := daemonjobCR.DeepCopy()
+	var ttl int32 = 60
+	instance.Spec.JobTemplate.Spec.TTLSecondsAfterFinished = &ttl
+	instance.Spec.JobTemplate.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}
+	instance.Spec.JobTemplate.Spec.ManualSelector = &trueVal
+	job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "test-node", "test-run")
+	assert.Nil(t, job.Spec.TTLSecondsAfterFinished)
+	assert.Nil(t, job.Spec.Selector)
+	assert.Nil(t, job.Spec.ManualSelector)
+}
+
+func TestGetJobNodeSelector(t *testing.T) {
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Nodes.NodeSelector = map[string]string{"role": "worker"}
+	job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "test-node", "test-run")
+	assert.Equal(t, map[string]string{"role": "worker"}, job.Spec.Template.Spec.NodeSelector)
+	assert.Nil(t, instance.Spec.JobTemplate.Spec.Template.Spec.NodeSelector)
+}
+
+func TestMapPodToDaemonJob(t *testing.T) {
+	getPod := func(labels map[string]string) handler.MapObject {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: daemonjobName.Namespace, Name: "test-pod", Labels: labels}}
+		return handler.MapObject{Meta: pod, Object: pod}
+	}
+	expected := []reconcile.Request{{NamespacedName: daemonjobName}}
+
+	assert.Equal(t, expected, mapPodToDaemonJob(getPod(map[string]string{djv2.DaemonJobNameLabel: daemonjobName.Name})))
+	assert.Empty(t, mapPodToDaemonJob(getPod(map[string]string{"app": "test"})))
 }
@@ -0,0 +1,173 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+const (
+	// completionIndexAnnotation holds the index of the node of an Indexed DaemonJob, as for Indexed Jobs.
+	completionIndexAnnotation = "batch.kubernetes.io/job-completion-index"
+
+	// completionIndexEnv holds the index of the node of an Indexed DaemonJob in every container.
+	completionIndexEnv = "JOB_COMPLETION_INDEX"
+)
+
+func isIndexed(instance *djv2.DaemonJob) bool {
+	mode := instance.Spec.JobTemplate.Spec.CompletionMode
+	return mode != nil && *mode == djv2.IndexedCompletion
+}
+
+func getPodReplacementPolicy(instance *djv2.DaemonJob) djv2.PodReplacementPolicy {
+	if policy := instance.Spec.JobTemplate.Spec.PodReplacementPolicy; policy != nil {
+		return *policy
+	}
+	return djv2.ReplaceTerminatingOrFailed
+}
+
+// setCompletionIndex gives the pod of the template the index of its node.
+func setCompletionIndex(template *corev1.PodTemplateSpec, index int) {
+	value := strconv.Itoa(index)
+	template.Annotations = mergeStringMaps(template.Annotations, map[string]string{completionIndexAnnotation: value})
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for i := range containers {
+			containers[i].Env = append(containers[i].Env, corev1.EnvVar{Name: completionIndexEnv, Value: value})
+		}
+	}
+}
+
+// withoutCompletionIndex returns the spec without the completion index set by setCompletionIndex.
+func withoutCompletionIndex(spec *batchv1.JobSpec) *batchv1.JobSpec {
+	if _, ok := spec.Template.Annotations[completionIndexAnnotation]; !ok {
+		return spec
+	}
+	spec = spec.DeepCopy()
+	delete(spec.Template.Annotations, completionIndexAnnotation)
+	if len(spec.Template.Annotations) == 0 {
+		spec.Template.Annotations = nil
+	}
+	for _, containers := range [][]corev1.Container{spec.Template.Spec.InitContainers, spec.Template.Spec.Containers} {
+		for i := range containers {
+			var env []corev1.EnvVar
+			for _, envVar := range containers[i].Env {
+				if envVar.Name != completionIndexEnv {
+					env = append(env, envVar)
+				}
+			}
+			containers[i].Env = env
+		}
+	}
+	return spec
+}
+
+// getCompletionIndexes returns the completion index of every node.
+// Nodes keep the index of their Job, or of their pods once the Job is gone,
+// and other nodes get the lowest free indexes in order of names.
+func getCompletionIndexes(nodes []corev1.Node, nodeJobs map[string]*batchv1.Job, runPods map[string][]corev1.Pod) map[string]int {
+	indexes := map[string]int{}
+	used := map[int]bool{}
+	for _, node := range nodes {
+		index, ok := -1, false
+		if job, found := nodeJobs[node.Name]; found {
+			index, ok = getCompletionIndex(job.Spec.Template.Annotations)
+		}
+		for i := 0; !ok && i < len(runPods[node.Name]); i++ {
+			index, ok = getCompletionIndex(runPods[node.Name][i].Annotations)
+		}
+		if ok && !used[index] {
+			indexes[node.Name] = index
+			used[index] = true
+		}
+	}
+	next := 0
+	for _, node := range nodes {
+		if _, ok := indexes[node.Name]; ok {
+			continue
+		}
+		for used[next] {
+			next++
+		}
+		indexes[node.Name] = next
+		used[next] = true
+	}
+	return indexes
+}
+
+func getCompletionIndex(annotations map[string]string) (int, bool) {
+	index, err := strconv.Atoi(annotations[completionIndexAnnotation])
+	return index, err == nil && index >= 0
+}
+
+// getFleetLimitExceeded returns the reason and message of the fleet-wide limit the run has exceeded, if any.
+// Reasons are the ones the Job controller uses for the same limits of a single Job.
+func getFleetLimitExceeded(instance *djv2.DaemonJob, status *djv2.DaemonJobStatus, failedPods int32, now time.Time) (string, string) {
+	rollout := instance.Spec.Rollout
+	if rollout == nil {
+		return "", ""
+	}
+	if rollout.ActiveDeadlineSeconds != nil && status.StartTime != nil &&
+		now.Sub(status.StartTime.Time) >= time.Duration(*rollout.ActiveDeadlineSeconds)*time.Second {
+		return "DeadlineExceeded", fmt.Sprintf("DaemonJob was active longer than %ds", *rollout.ActiveDeadlineSeconds)
+	}
+	if rollout.BackoffLimit != nil && failedPods > *rollout.BackoffLimit {
+		return "BackoffLimitExceeded", fmt.Sprintf("%d pods failed across nodes, more than the backoff limit of %d", failedPods, *rollout.BackoffLimit)
+	}
+	return "", ""
+}
+
+// stopJob terminates a running Job by cutting its activeDeadlineSeconds down to the time it has been active.
+// The Job controller then stops its pod and marks the Job failed, so the Job is kept for inspection.
+func (r *DaemonJobReconciler) stopJob(ctx context.Context, job *batchv1.Job, now time.Time) error {
+	var deadline int64 = 1
+	if job.Status.StartTime != nil {
+		if active := int64(now.Sub(job.Status.StartTime.Time) / time.Second); active > deadline {
+			deadline = active
+		}
+	}
+	if job.Spec.ActiveDeadlineSeconds != nil && *job.Spec.ActiveDeadlineSeconds <= deadline {
+		return nil
+	}
+	r.getLogger(ctx).Info("Stopping Job", "job", job.Name)
+	patch := client.MergeFrom(job.DeepCopy())
+	job.Spec.ActiveDeadlineSeconds = &deadline
+	return r.Client.Patch(ctx, job, patch)
+}
+
+// getBusyNodes returns nodes that still run pods of the DaemonJob, e.g. pods of deleted Jobs that are terminating.
+func (r *DaemonJobReconciler) getBusyNodes(ctx context.Context, instance *djv2.DaemonJob) (map[string]bool, error) {
+	var pods corev1.PodList
+	if err := r.Client.List(ctx, &pods, client.InNamespace(instance.Namespace), client.MatchingLabels{djv2.DaemonJobNameLabel: instance.Name}); err != nil {
+		return nil, err
+	}
+	busyNodes := map[string]bool{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed && pod.Spec.NodeName != "" {
+			busyNodes[pod.Spec.NodeName] = true
+		}
+	}
+	return busyNodes, nil
+}
@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func TestGetFleetLimitExceeded(t *testing.T) {
+	var deadline int64 = 60
+	var backoffLimit int32 = 2
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Rollout = &djv2.Rollout{ActiveDeadlineSeconds: &deadline, BackoffLimit: &backoffLimit}
+	now := time.Now()
+	startTime := metav1.NewTime(now.Add(-time.Minute))
+	status := &djv2.DaemonJobStatus{}
+
+	reason, _ := getFleetLimitExceeded(instance, status, 2, now)
+	assert.Empty(t, reason)
+	reason, _ = getFleetLimitExceeded(instance, status, 3, now)
+	assert.Equal(t, "BackoffLimitExceeded", reason)
+	status.StartTime = &startTime
+	reason, _ = getFleetLimitExceeded(instance, status, 0, now)
+	assert.Equal(t, "DeadlineExceeded", reason)
+	reason, _ = getFleetLimitExceeded(daemonjobCR, status, 3, now)
+	assert.Empty(t, reason)
+}
+
+func TestDaemonJobControllerFleetDeadline(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	var deadline int64 = 60
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Rollout = &djv2.Rollout{ActiveDeadlineSeconds: &deadline}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil), getTestNode("node-b", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	jobs := getJobs(t, fakeClient)
+	require.Len(t, jobs, 2)
+	startTime := metav1.NewTime(time.Now().Add(-2 * time.Minute))
+	for _, job := range jobs {
+		job.Status.StartTime = &startTime
+		job.Status.Active = 1
+		require.NoError(t, fakeClient.Status().Update(context.Background(), &job))
+	}
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should stop running jobs when fleet deadline passed", func(t *testing.T) {
+		for _, job := range getJobs(t, fakeClient) {
+			require.NotNil(t, job.Spec.ActiveDeadlineSeconds)
+			assert.InDelta(t, 120, *job.Spec.ActiveDeadlineSeconds, 5)
+		}
+		status := getDaemonJob(t, fakeClient).Status
+		require.Len(t, status.Conditions, 1)
+		assert.Equal(t, djv2.DaemonJobFailed, status.Conditions[0].Type)
+		assert.Equal(t, "DeadlineExceeded", status.Conditions[0].Reason)
+	})
+}
+
+func TestDaemonJobControllerFleetBackoffLimit(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	var backoffLimit int32 = 1
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Rollout = &djv2.Rollout{BackoffLimit: &backoffLimit}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil), getTestNode("node-b", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	jobs := getJobs(t, fakeClient)
+	require.Len(t, jobs, 2)
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should keep running while failed pods are within limit", func(t *testing.T) {
+		jobs[0].Status.Failed = 1
+		require.NoError(t, fakeClient.Status().Update(context.Background(), &jobs[0]))
+		_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+		require.NoError(t, err)
+		assert.Empty(t, getDaemonJob(t, fakeClient).Status.Conditions)
+	})
+
+	t.Run("should stop running jobs when failed pods exceed limit", func(t *testing.T) {
+		jobs[1].Status.Failed = 1
+		require.NoError(t, fakeClient.Status().Update(context.Background(), &jobs[1]))
+		_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+		require.NoError(t, err)
+		for _, job := range getJobs(t, fakeClient) {
+			assert.NotNil(t, job.Spec.ActiveDeadlineSeconds)
+		}
+		status := getDaemonJob(t, fakeClient).Status
+		require.Len(t, status.Conditions, 1)
+		assert.Equal(t, "BackoffLimitExceeded", status.Conditions[0].Reason)
+	})
+}
+
+func TestDaemonJobControllerPodReplacementPolicy(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	policy := djv2.ReplaceFailed
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.JobTemplate.Spec.PodReplacementPolicy = &policy
+	now := metav1.Now()
+	terminatingPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:         daemonjobName.Namespace,
+			Name:              "test-daemonjob-old",
+			Labels:            map[string]string{djv2.DaemonJobNameLabel: daemonjobName.Name},
+			DeletionTimestamp: &now,
+		},
+		Spec:   corev1.PodSpec{NodeName: "node-a"},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil), getTestNode("node-b", nil), terminatingPod)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should wait for pods of previous jobs to terminate", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, "node-b", jobs[0].Annotations[djv2.NodeNameAnnotation])
+		assert.Equal(t, int32(1), getDaemonJob(t, fakeClient).Status.PendingNodes)
+	})
+
+	t.Run("should create job once pods terminated", func(t *testing.T) {
+		require.NoError(t, fakeClient.Delete(context.Background(), terminatingPod))
+		_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+		require.NoError(t, err)
+		assert.Len(t, getJobs(t, fakeClient), 2)
+	})
+}
+
+func TestDaemonJobControllerIndexedCompletion(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	mode := djv2.IndexedCompletion
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.JobTemplate.Spec.CompletionMode = &mode
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-b", nil), getTestNode("node-a", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should give every node its completion index", func(t *testing.T) {
+		indexes := map[string]string{}
+		for _, job := range getJobs(t, fakeClient) {
+			index := job.Spec.Template.Annotations[completionIndexAnnotation]
+			assert.Equal(t, []corev1.EnvVar{{Name: completionIndexEnv, Value: index}}, job.Spec.Template.Spec.Containers[0].Env)
+			indexes[job.Annotations[djv2.NodeNameAnnotation]] = index
+		}
+		assert.Equal(t, map[string]string{"node-a": "0", "node-b": "1"}, indexes)
+	})
+}
+
+func TestDaemonJobControllerStableCompletionIndex(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	mode := djv2.IndexedCompletion
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.JobTemplate.Spec.CompletionMode = &mode
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-b", nil), getTestNode("node-c", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	previousJobs := map[string]string{}
+	for _, job := range getJobs(t, fakeClient) {
+		completeJob(t, fakeClient, job)
+		previousJobs[job.Annotations[djv2.NodeNameAnnotation]] = job.Name
+	}
+
+	require.NoError(t, fakeClient.Create(context.Background(), getTestNode("node-a", nil)))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should keep indexes and jobs of nodes when node is added", func(t *testing.T) {
+		indexes := map[string]string{}
+		for _, job := range getJobs(t, fakeClient) {
+			nodeName := job.Annotations[djv2.NodeNameAnnotation]
+			if previousJob, ok := previousJobs[nodeName]; ok {
+				assert.Equal(t, previousJob, job.Name)
+			}
+			indexes[nodeName] = job.Spec.Template.Annotations[completionIndexAnnotation]
+		}
+		assert.Equal(t, map[string]string{"node-a": "2", "node-b": "0", "node-c": "1"}, indexes)
+		assert.Equal(t, int32(2), getDaemonJob(t, fakeClient).Status.SucceededNodes)
+	})
+}
+
+func TestGetCompletionIndexes(t *testing.T) {
+	nodes := []corev1.Node{*getTestNode("node-a", nil), *getTestNode("node-b", nil), *getTestNode("node-c", nil), *getTestNode("node-d", nil)}
+	jobWithIndex := func(index string) *batchv1.Job {
+		job := &batchv1.Job{}
+		job.Spec.Template.Annotations = map[string]string{completionIndexAnnotation: index}
+		return job
+	}
+	nodeJobs := map[string]*batchv1.Job{"node-b": jobWithIndex("0"), "node-c": jobWithIndex("0")}
+	runPods := map[string][]corev1.Pod{"node-d": {{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{completionIndexAnnotation: "3"}}}}}
+
+	assert.Equal(t, map[string]int{"node-a": 1, "node-b": 0, "node-c": 2, "node-d": 3}, getCompletionIndexes(nodes, nodeJobs, runPods))
+}
+
+func TestGetTemplateHashWithoutCompletionIndex(t *testing.T) {
+	template := daemonjobCR.Spec.JobTemplate.Spec.Template.DeepCopy()
+	job := getJob(daemonjobCR, template, "node-a", "test-run")
+	setCompletionIndex(template, 3)
+	indexedJob := getJob(daemonjobCR, template, "node-a", "test-run")
+
+	assert.Equal(t, job.Annotations[djv2.TemplateHashAnnotation], indexedJob.Annotations[djv2.TemplateHashAnnotation])
+}
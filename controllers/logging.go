@@ -0,0 +1,39 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+)
+
+// loggerKey holds the logger of a reconcile in its context.
+type loggerKey struct{}
+
+// withLogger returns a context carrying the logger, so that helpers log with the fields of the reconcile.
+func withLogger(ctx context.Context, log logr.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// getLogger returns the logger carried by the context, or the logger of the reconciler.
+func (r *DaemonJobReconciler) getLogger(ctx context.Context) logr.Logger {
+	if log, ok := ctx.Value(loggerKey{}).(logr.Logger); ok {
+		return log
+	}
+	return r.Log
+}
@@ -0,0 +1,73 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// logEntry is a message logged by testLogger with all its fields.
+type logEntry struct {
+	msg    string
+	fields map[string]interface{}
+}
+
+// testLogger records every entry logged through it or loggers derived from it.
+type testLogger struct {
+	entries *[]logEntry
+	values  []interface{}
+}
+
+func (l testLogger) Enabled() bool { return true }
+
+func (l testLogger) Info(msg string, keysAndValues ...interface{}) {
+	fields := map[string]interface{}{}
+	values := append(append([]interface{}{}, l.values...), keysAndValues...)
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i].(string)] = values[i+1]
+	}
+	*l.entries = append(*l.entries, logEntry{msg: msg, fields: fields})
+}
+
+func (l testLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	l.Info(msg, append(keysAndValues, "error", err)...)
+}
+
+func (l testLogger) V(level int) logr.InfoLogger { return l }
+
+func (l testLogger) WithValues(keysAndValues ...interface{}) logr.Logger {
+	return testLogger{entries: l.entries, values: append(append([]interface{}{}, l.values...), keysAndValues...)}
+}
+
+func (l testLogger) WithName(name string) logr.Logger { return l }
+
+func TestDaemonJobControllerLogging(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR, getTestNode("node-a", nil))
+	var entries []logEntry
+	reconciler := DaemonJobReconciler{fakeClient, testLogger{entries: &entries}, scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should log with DaemonJob, run ID and node", func(t *testing.T) {
+		var created *logEntry
+		for i := range entries {
+			assert.Equal(t, daemonjobName, entries[i].fields["daemonjob"], entries[i].msg)
+			if entries[i].msg == "Created Job" {
+				created = &entries[i]
+			}
+		}
+		require.NotNil(t, created)
+		assert.Equal(t, "node-a", created.fields["node"])
+		assert.Equal(t, getJobs(t, fakeClient)[0].Spec.Template.Labels[djv2.DaemonJobRunLabel], created.fields["runID"])
+	})
+}
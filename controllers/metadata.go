@@ -0,0 +1,101 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// kubectlPrefix marks annotations kubectl keeps on objects it applies, e.g. the last applied configuration.
+const kubectlPrefix = "kubectl.kubernetes.io/"
+
+// getPropagationPolicies returns where labels and annotations of the DaemonJob are copied to.
+func getPropagationPolicies(instance *djv2.DaemonJob) (labels, annotations djv2.PropagationPolicy) {
+	labels, annotations = djv2.PropagateToJobs, djv2.PropagateNone
+	if propagation := instance.Spec.MetadataPropagation; propagation != nil {
+		if propagation.Labels != "" {
+			labels = propagation.Labels
+		}
+		if propagation.Annotations != "" {
+			annotations = propagation.Annotations
+		}
+	}
+	return labels, annotations
+}
+
+// getPropagatedMetadata returns labels or annotations of the DaemonJob copied to Jobs, or to pods when toPods is set.
+func getPropagatedMetadata(metadata map[string]string, policy djv2.PropagationPolicy, toPods bool) map[string]string {
+	if policy == djv2.PropagateNone || (toPods && policy != djv2.PropagateToJobsAndPods) {
+		return nil
+	}
+	var propagated map[string]string
+	for key, value := range metadata {
+		if djv2.IsReservedKey(key) || strings.HasPrefix(key, kubectlPrefix) {
+			continue
+		}
+		if propagated == nil {
+			propagated = map[string]string{}
+		}
+		propagated[key] = value
+	}
+	return propagated
+}
+
+// updateJobMetadata brings labels and annotations of a Job in the cluster up to date with the desired Job.
+// Keys managed by the controller are left as they are, as they describe the run the Job was created for.
+func (r *DaemonJobReconciler) updateJobMetadata(ctx context.Context, clusterJob, job *batchv1.Job) error {
+	patch := client.MergeFrom(clusterJob.DeepCopy())
+	labels, labelsChanged := mergeUnreservedKeys(clusterJob.Labels, job.Labels)
+	// Jobs created before the run was recorded on them take it from their pods.
+	if runID := clusterJob.Spec.Template.Labels[djv2.DaemonJobRunLabel]; runID != "" && labels[djv2.DaemonJobRunLabel] != runID {
+		labels, labelsChanged = mergeStringMaps(labels, map[string]string{djv2.DaemonJobRunLabel: runID}), true
+	}
+	annotations, annotationsChanged := mergeUnreservedKeys(clusterJob.Annotations, job.Annotations)
+	if !labelsChanged && !annotationsChanged {
+		return nil
+	}
+	clusterJob.Labels, clusterJob.Annotations = labels, annotations
+	return r.Client.Patch(ctx, clusterJob, patch)
+}
+
+// mergeUnreservedKeys returns current metadata updated with unreserved keys of desired metadata.
+func mergeUnreservedKeys(current, desired map[string]string) (map[string]string, bool) {
+	merged, changed := current, false
+	for key, value := range desired {
+		if djv2.IsReservedKey(key) {
+			continue
+		}
+		if existing, ok := current[key]; ok && existing == value {
+			continue
+		}
+		if !changed {
+			merged = mergeStringMaps(current, nil)
+			if merged == nil {
+				merged = map[string]string{}
+			}
+			changed = true
+		}
+		merged[key] = value
+	}
+	return merged, changed
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func getMetadataDaemonJob() *djv2.DaemonJob {
+	instance := daemonjobCR.DeepCopy()
+	instance.Labels = map[string]string{"team": "platform", "dj.dysproz.io/name": "spoofed"}
+	instance.Annotations = map[string]string{
+		"cost-center": "1234",
+		"kubectl.kubernetes.io/last-applied-configuration": "{}",
+	}
+	instance.Spec.JobTemplate.Metadata = djv2.JobMetadata{
+		Labels:      map[string]string{"team": "batch", "tier": "maintenance"},
+		Annotations: map[string]string{"owner": "ops"},
+	}
+	instance.Spec.JobTemplate.Spec.Template.Labels = map[string]string{"app": "test"}
+	return instance
+}
+
+func TestGetJobMetadata(t *testing.T) {
+	t.Run("should propagate labels to jobs by default", func(t *testing.T) {
+		job := getJob(getMetadataDaemonJob(), &getMetadataDaemonJob().Spec.JobTemplate.Spec.Template, "test-node", "test-run")
+		assert.Equal(t, map[string]string{
+			"team":                  "batch",
+			"tier":                  "maintenance",
+			djv2.DaemonJobNameLabel: daemonjobName.Name,
+			djv2.DaemonJobRunLabel:  "test-run",
+		}, job.Labels)
+		assert.Equal(t, "ops", job.Annotations["owner"])
+		assert.NotContains(t, job.Annotations, "cost-center")
+		assert.Equal(t, map[string]string{
+			"app":                   "test",
+			djv2.DaemonJobNameLabel: daemonjobName.Name,
+			djv2.DaemonJobRunLabel:  "test-run",
+		}, job.Spec.Template.Labels)
+		assert.Equal(t, map[string]string{
+			djv2.NodeNameAnnotation:     "test-node",
+			djv2.TemplateHashAnnotation: job.Annotations[djv2.TemplateHashAnnotation],
+		}, job.Spec.Template.Annotations)
+	})
+
+	t.Run("should propagate metadata to jobs and pods", func(t *testing.T) {
+		instance := getMetadataDaemonJob()
+		instance.Spec.MetadataPropagation = &djv2.MetadataPropagation{
+			Labels:      djv2.PropagateToJobsAndPods,
+			Annotations: djv2.PropagateToJobsAndPods,
+		}
+		job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "test-node", "test-run")
+		assert.Equal(t, "1234", job.Annotations["cost-center"])
+		assert.NotContains(t, job.Annotations, "kubectl.kubernetes.io/last-applied-configuration")
+		assert.Equal(t, map[string]string{
+			"app":                   "test",
+			"team":                  "platform",
+			djv2.DaemonJobNameLabel: daemonjobName.Name,
+			djv2.DaemonJobRunLabel:  "test-run",
+		}, job.Spec.Template.Labels)
+		assert.Equal(t, "1234", job.Spec.Template.Annotations["cost-center"])
+	})
+
+	t.Run("should not propagate labels with none policy", func(t *testing.T) {
+		instance := getMetadataDaemonJob()
+		instance.Spec.JobTemplate.Metadata = djv2.JobMetadata{}
+		instance.Spec.MetadataPropagation = &djv2.MetadataPropagation{Labels: djv2.PropagateNone}
+		job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "test-node", "test-run")
+		assert.Equal(t, map[string]string{
+			djv2.DaemonJobNameLabel: daemonjobName.Name,
+			djv2.DaemonJobRunLabel:  "test-run",
+		}, job.Labels)
+	})
+}
+
+func TestDaemonJobControllerJobMetadata(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, getMetadataDaemonJob(), getTestNode("node-a", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	jobName := getJobs(t, fakeClient)[0].Name
+
+	instance := getDaemonJob(t, fakeClient)
+	instance.Spec.JobTemplate.Metadata.Labels["tier"] = "critical"
+	instance.Spec.JobTemplate.Metadata.Annotations["owner"] = "sre"
+	require.NoError(t, fakeClient.Update(context.Background(), instance))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should update metadata of existing jobs without running them again", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, jobName, jobs[0].Name)
+		assert.Equal(t, "critical", jobs[0].Labels["tier"])
+		assert.Equal(t, "sre", jobs[0].Annotations["owner"])
+	})
+}
@@ -0,0 +1,109 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// getLegacyPods stops the single Job released versions ran for all nodes, see getLegacyJob, if it is still running,
+// and returns its succeeded pods by the node they ran on. It tells whether the Job is still stopping:
+// Jobs of nodes are not created until its pods have finished, so that a node never runs the job twice at once.
+// The Job is stopped rather than deleted, so that pods that already succeeded are kept.
+func (r *DaemonJobReconciler) getLegacyPods(ctx context.Context, instance *djv2.DaemonJob, job *batchv1.Job) (map[string]*corev1.Pod, bool, error) {
+	if finished, _ := getFinishedStatus(job); !finished {
+		deadline := getActiveDeadline(job)
+		if err := r.stopJob(ctx, job, time.Now()); err != nil {
+			return nil, false, err
+		}
+		if getActiveDeadline(job) != deadline {
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "LegacyJobStopped", "Stopped Job %s of earlier version, every node runs a Job of its own", job.Name)
+		}
+		return nil, true, nil
+	}
+	if job.Spec.Selector == nil {
+		return nil, false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(job.Spec.Selector)
+	if err != nil {
+		return nil, false, err
+	}
+	var pods corev1.PodList
+	if err := r.Client.List(ctx, &pods, client.InNamespace(job.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, false, err
+	}
+	legacyPods := map[string]*corev1.Pod{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		switch {
+		case !metav1.IsControlledBy(pod, job):
+		case pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed:
+			return nil, true, nil
+		case pod.Status.Phase == corev1.PodSucceeded && pod.Spec.NodeName != "":
+			legacyPods[pod.Spec.NodeName] = pod
+		}
+	}
+	return legacyPods, false, nil
+}
+
+// migrateLegacyPod turns a succeeded pod of the legacy Job into a record of the node having run the desired Job,
+// as if the Job of the node was gone and only its pod was left, see getSucceededPod.
+// The DaemonJob becomes its controller, so that the pod outlives the legacy Job once that is cleaned up.
+// The legacy Job ran the template the DaemonJob had when the controller was upgraded, so nodes
+// run again only when the template changes afterwards.
+func (r *DaemonJobReconciler) migrateLegacyPod(ctx context.Context, instance *djv2.DaemonJob, legacyJob *batchv1.Job, pod *corev1.Pod, job *batchv1.Job) error {
+	patch := client.MergeFrom(pod.DeepCopy())
+	pod.Labels = mergeStringMaps(pod.Labels, map[string]string{
+		djv2.DaemonJobNameLabel: job.Spec.Template.Labels[djv2.DaemonJobNameLabel],
+		djv2.DaemonJobRunLabel:  job.Spec.Template.Labels[djv2.DaemonJobRunLabel],
+	})
+	pod.Annotations = mergeStringMaps(pod.Annotations, map[string]string{
+		djv2.NodeNameAnnotation:     job.Annotations[djv2.NodeNameAnnotation],
+		djv2.TemplateHashAnnotation: job.Annotations[djv2.TemplateHashAnnotation],
+	})
+	var ownerReferences []metav1.OwnerReference
+	for _, ownerReference := range pod.OwnerReferences {
+		if ownerReference.UID != legacyJob.UID {
+			ownerReferences = append(ownerReferences, ownerReference)
+		}
+	}
+	pod.OwnerReferences = ownerReferences
+	if err := controllerutil.SetControllerReference(instance, pod, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Client.Patch(ctx, pod, patch); err != nil {
+		return err
+	}
+	r.getLogger(ctx).Info("Migrated pod of Job of earlier version", "job", legacyJob.Name, "pod", pod.Name)
+	return nil
+}
+
+func getActiveDeadline(job *batchv1.Job) int64 {
+	if job.Spec.ActiveDeadlineSeconds == nil {
+		return -1
+	}
+	return *job.Spec.ActiveDeadlineSeconds
+}
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// getReleasedTestJob returns the single Job the released version ran for all nodes, selecting its pods by controller-uid.
+func getReleasedTestJob(t *testing.T, instance *djv2.DaemonJob, status batchv1.JobStatus) *batchv1.Job {
+	job := getLegacyTestJob(t, instance)
+	job.UID = "legacy-uid"
+	job.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "legacy-uid"}}
+	job.Status = status
+	return job
+}
+
+// getReleasedTestPod returns a pod of the released Job that ran on the node.
+func getReleasedTestPod(t *testing.T, job *batchv1.Job, nodeName string, phase corev1.PodPhase) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: job.Namespace,
+			Name:      job.Name + "-" + nodeName,
+			Labels:    map[string]string{"controller-uid": "legacy-uid", jobNameLabel: job.Name},
+		},
+		Spec:   corev1.PodSpec{NodeName: nodeName},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(job, pod, getTestScheme(t)))
+	return pod
+}
+
+func TestDaemonJobControllerMigrateReleasedJob(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	releasedJob := getReleasedTestJob(t, instance, batchv1.JobStatus{
+		Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: corev1.ConditionTrue}},
+	})
+	succeededPod := getReleasedTestPod(t, releasedJob, "node-a", corev1.PodSucceeded)
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, releasedJob, succeededPod,
+		getReleasedTestPod(t, releasedJob, "node-b", corev1.PodFailed),
+		getTestNode("node-a", nil), getTestNode("node-b", nil), getTestNode("node-c", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should not run node whose pod succeeded", func(t *testing.T) {
+		assert.Equal(t, []string{"node-b", "node-c"}, getJobNodes(getJobs(t, fakeClient)))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(1), status.SucceededNodes)
+		require.Len(t, status.Nodes, 3)
+		assert.Equal(t, djv2.NodeStatus{Name: "node-a", Phase: djv2.NodeSucceeded, Job: releasedJob.Name}, status.Nodes[0])
+	})
+
+	t.Run("should keep succeeded pod after released job is deleted", func(t *testing.T) {
+		pod := &corev1.Pod{}
+		require.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Namespace: succeededPod.Namespace, Name: succeededPod.Name}, pod))
+		assert.True(t, metav1.IsControlledBy(pod, getDaemonJob(t, fakeClient)))
+		assert.Len(t, pod.OwnerReferences, 1)
+		assert.Equal(t, instance.Name, pod.Labels[djv2.DaemonJobNameLabel])
+		assert.Equal(t, "node-a", pod.Annotations[djv2.NodeNameAnnotation])
+		err := fakeClient.Get(context.Background(), types.NamespacedName{Namespace: releasedJob.Namespace, Name: releasedJob.Name}, &batchv1.Job{})
+		assert.True(t, apierrors.IsNotFound(err))
+	})
+
+	reconciler = restartReconciler(t, fakeClient, reconciler)
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should not run node again after restart", func(t *testing.T) {
+		assert.Equal(t, []string{"node-b", "node-c"}, getJobNodes(getJobs(t, fakeClient)))
+		assert.Equal(t, int32(1), getDaemonJob(t, fakeClient).Status.SucceededNodes)
+	})
+
+	changed := getDaemonJob(t, fakeClient)
+	changed.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image = "busybox:new"
+	require.NoError(t, fakeClient.Update(context.Background(), changed))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run node again when template changes", func(t *testing.T) {
+		assert.Contains(t, getJobNodes(getJobs(t, fakeClient)), "node-a")
+	})
+}
+
+func TestDaemonJobControllerStopReleasedJob(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	startTime := metav1.Now()
+	releasedJob := getReleasedTestJob(t, instance, batchv1.JobStatus{Active: 1, StartTime: &startTime})
+	runningPod := getReleasedTestPod(t, releasedJob, "node-a", corev1.PodRunning)
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, releasedJob, runningPod, getTestNode("node-a", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+	for i := 0; i < 2; i++ {
+		result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+		require.NoError(t, err)
+		assert.Equal(t, requeueInterval, result.RequeueAfter)
+	}
+
+	t.Run("should stop released job and keep it", func(t *testing.T) {
+		assert.Equal(t, []string{""}, getJobNodes(getJobs(t, fakeClient)))
+		job := &batchv1.Job{}
+		require.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Namespace: releasedJob.Namespace, Name: releasedJob.Name}, job))
+		assert.NotNil(t, job.Spec.ActiveDeadlineSeconds)
+		assert.Equal(t, []string{"Normal LegacyJobStopped Stopped Job " + releasedJob.Name + " of earlier version, every node runs a Job of its own"}, drainEvents(recorder))
+	})
+
+	// The Job controller fails the Job and terminates its pod.
+	failJob(t, fakeClient, *getLegacyJobFromClient(t, fakeClient, releasedJob))
+	require.NoError(t, fakeClient.Delete(context.Background(), runningPod))
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run nodes once released job stopped", func(t *testing.T) {
+		assert.Equal(t, []string{"node-a"}, getJobNodes(getJobs(t, fakeClient)))
+	})
+}
+
+func getLegacyJobFromClient(t *testing.T, c client.Client, job *batchv1.Job) *batchv1.Job {
+	clusterJob := &batchv1.Job{}
+	require.NoError(t, c.Get(context.Background(), types.NamespacedName{Namespace: job.Namespace, Name: job.Name}, clusterJob))
+	return clusterJob
+}
@@ -0,0 +1,219 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// getNodeSelector returns the selector of nodes targeted by the DaemonJob.
+// Nodes have to match both the selector and the node selector map.
+func getNodeSelector(instance *djv2.DaemonJob) (labels.Selector, error) {
+	selector := labels.Everything()
+	if instance.Spec.Nodes.Selector != nil {
+		var err error
+		if selector, err = metav1.LabelSelectorAsSelector(instance.Spec.Nodes.Selector); err != nil {
+			return nil, err
+		}
+	}
+	for key, value := range instance.Spec.Nodes.NodeSelector {
+		requirement, err := labels.NewRequirement(key, selection.Equals, []string{value})
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*requirement)
+	}
+	return selector, nil
+}
+
+// getNodeSelectorRequirements translates spec.nodes.selector into node affinity requirements,
+// so that pods are placed only on nodes counted as targeted.
+// The node selector map reaches pods through their nodeSelector instead.
+func getNodeSelectorRequirements(instance *djv2.DaemonJob) []corev1.NodeSelectorRequirement {
+	selector := instance.Spec.Nodes.Selector
+	if selector == nil {
+		return nil
+	}
+	var requirements []corev1.NodeSelectorRequirement
+	keys := make([]string, 0, len(selector.MatchLabels))
+	for key := range selector.MatchLabels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      key,
+			Operator: corev1.NodeSelectorOpIn,
+			Values:   []string{selector.MatchLabels[key]},
+		})
+	}
+	for _, expression := range selector.MatchExpressions {
+		// Label selector operators share their names with node selector operators.
+		requirements = append(requirements, corev1.NodeSelectorRequirement{
+			Key:      expression.Key,
+			Operator: corev1.NodeSelectorOperator(expression.Operator),
+			Values:   expression.Values,
+		})
+	}
+	return requirements
+}
+
+// getNodeReady returns the status of the Ready condition of the node.
+func getNodeReady(node *corev1.Node) corev1.ConditionStatus {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == corev1.NodeReady {
+			return condition.Status
+		}
+	}
+	return corev1.ConditionUnknown
+}
+
+// getUnavailableReason returns why a new pod of the template cannot start on the node, or an empty reason
+// when it can: the node is ready and the pod tolerates its NoSchedule and NoExecute taints,
+// including the one of a cordoned node. Jobs already running on the node are kept either way.
+func getUnavailableReason(node *corev1.Node, template *corev1.PodTemplateSpec) (reason, message string) {
+	if ready := getNodeReady(node); ready != corev1.ConditionTrue {
+		return "NotReady", fmt.Sprintf("Node is not ready, its Ready condition is %s", ready)
+	}
+	taints := node.Spec.Taints
+	if node.Spec.Unschedulable {
+		taints = append(taints[:len(taints):len(taints)], corev1.Taint{Key: corev1.TaintNodeUnschedulable, Effect: corev1.TaintEffectNoSchedule})
+	}
+	for i := range taints {
+		if taints[i].Effect == corev1.TaintEffectPreferNoSchedule || toleratesTaint(template.Spec.Tolerations, &taints[i]) {
+			continue
+		}
+		if taints[i].Key == corev1.TaintNodeUnschedulable {
+			return "Unschedulable", "Node is cordoned"
+		}
+		return "UntoleratedTaint", fmt.Sprintf("Node has taint %s that the pod does not tolerate", taints[i].ToString())
+	}
+	return "", ""
+}
+
+func toleratesTaint(tolerations []corev1.Toleration, taint *corev1.Taint) bool {
+	for i := range tolerations {
+		if tolerations[i].ToleratesTaint(taint) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeChanged tells whether an update of a node may matter to DaemonJobs.
+// Heartbeats and other status updates are ignored.
+func nodeChanged(oldNode, newNode *corev1.Node) bool {
+	return !reflect.DeepEqual(oldNode.Labels, newNode.Labels) ||
+		!reflect.DeepEqual(oldNode.Spec.Taints, newNode.Spec.Taints) ||
+		oldNode.Spec.Unschedulable != newNode.Spec.Unschedulable ||
+		getNodeReady(oldNode) != getNodeReady(newNode)
+}
+
+// nodePredicate passes node creations, deletions and meaningful updates.
+var nodePredicate = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldNode, okOld := e.ObjectOld.(*corev1.Node)
+		newNode, okNew := e.ObjectNew.(*corev1.Node)
+		return okOld && okNew && nodeChanged(oldNode, newNode)
+	},
+	GenericFunc: func(event.GenericEvent) bool { return false },
+}
+
+// nodeEventHandler enqueues DaemonJobs targeting a node before or after its change.
+type nodeEventHandler struct {
+	client client.Client
+	log    logr.Logger
+}
+
+// Create implements handler.EventHandler.
+func (h *nodeEventHandler) Create(e event.CreateEvent, q workqueue.RateLimitingInterface) {
+	h.enqueue(q, e.Object)
+}
+
+// Update implements handler.EventHandler.
+func (h *nodeEventHandler) Update(e event.UpdateEvent, q workqueue.RateLimitingInterface) {
+	h.enqueue(q, e.ObjectOld, e.ObjectNew)
+}
+
+// Delete implements handler.EventHandler.
+func (h *nodeEventHandler) Delete(e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	h.enqueue(q, e.Object)
+}
+
+// Generic implements handler.EventHandler.
+func (h *nodeEventHandler) Generic(e event.GenericEvent, q workqueue.RateLimitingInterface) {
+	h.enqueue(q, e.Object)
+}
+
+func (h *nodeEventHandler) enqueue(q workqueue.RateLimitingInterface, objects ...runtime.Object) {
+	for _, request := range h.getRequests(objects...) {
+		q.Add(request)
+	}
+}
+
+// getRequests returns requests of DaemonJobs whose node targeting matches any of the nodes.
+func (h *nodeEventHandler) getRequests(objects ...runtime.Object) []reconcile.Request {
+	var nodeLabels []labels.Set
+	for _, object := range objects {
+		if node, ok := object.(*corev1.Node); ok {
+			nodeLabels = append(nodeLabels, labels.Set(node.Labels))
+		}
+	}
+	var djObjects djv2.DaemonJobList
+	if err := h.client.List(context.TODO(), &djObjects); err != nil {
+		h.log.Error(err, "Failed to list DaemonJobs for node event")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, djObject := range djObjects.Items {
+		selector, err := getNodeSelector(&djObject)
+		if err != nil {
+			h.log.Error(err, "Invalid node selector", "daemonjob", types.NamespacedName{Namespace: djObject.Namespace, Name: djObject.Name})
+			continue
+		}
+		for _, set := range nodeLabels {
+			if selector.Matches(set) {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      djObject.Name,
+						Namespace: djObject.Namespace,
+					},
+				})
+				break
+			}
+		}
+	}
+	return requests
+}
@@ -0,0 +1,247 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+var workerSelector = &metav1.LabelSelector{
+	MatchLabels: map[string]string{"zone": "a"},
+	MatchExpressions: []metav1.LabelSelectorRequirement{
+		{Key: "role", Operator: metav1.LabelSelectorOpIn, Values: []string{"worker", "edge"}},
+		{Key: "gpu", Operator: metav1.LabelSelectorOpDoesNotExist},
+	},
+}
+
+func TestDaemonJobControllerNodeSelector(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Nodes.Selector = workerSelector
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance,
+		getTestNode("node-a", map[string]string{"zone": "a", "role": "worker"}),
+		getTestNode("node-b", map[string]string{"zone": "a", "role": "edge"}),
+		getTestNode("node-c", map[string]string{"zone": "a", "role": "worker", "gpu": "true"}),
+		getTestNode("node-d", map[string]string{"zone": "a", "role": "master"}),
+		getTestNode("node-e", map[string]string{"zone": "b", "role": "worker"}))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should count only matching nodes", func(t *testing.T) {
+		assert.Equal(t, int32(2), getDaemonJob(t, fakeClient).Status.DesiredNodes)
+		jobs := getJobs(t, fakeClient)
+		nodes := []string{}
+		for _, job := range jobs {
+			nodes = append(nodes, job.Annotations[djv2.NodeNameAnnotation])
+		}
+		assert.ElementsMatch(t, []string{"node-a", "node-b"}, nodes)
+	})
+
+	t.Run("should constrain pods to matching nodes", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.NotEmpty(t, jobs)
+		terms := jobs[0].Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+		require.Len(t, terms, 1)
+		assert.Equal(t, getNodeSelectorRequirements(instance), terms[0].MatchExpressions)
+	})
+}
+
+func getUnavailableTestNodes() []runtime.Object {
+	notReady := getTestNode("node-b", nil)
+	notReady.Status.Conditions[0].Status = corev1.ConditionFalse
+	cordoned := getTestNode("node-c", nil)
+	cordoned.Spec.Unschedulable = true
+	tainted := getTestNode("node-d", nil)
+	tainted.Spec.Taints = []corev1.Taint{{Key: "maintenance", Effect: corev1.TaintEffectNoExecute}}
+	return []runtime.Object{notReady, cordoned, tainted}
+}
+
+func TestDaemonJobControllerUnavailableNodes(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	preferNoSchedule := getTestNode("node-e", nil)
+	preferNoSchedule.Spec.Taints = []corev1.Taint{{Key: "spot", Effect: corev1.TaintEffectPreferNoSchedule}}
+	objects := append([]runtime.Object{daemonjobCR.DeepCopy(), getTestNode("node-a", nil), preferNoSchedule}, getUnavailableTestNodes()...)
+	fakeClient := fake.NewFakeClientWithScheme(scheme, objects...)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run only nodes that can start pods", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"node-a", "node-e"}, getJobNodes(getJobs(t, fakeClient)))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(5), status.DesiredNodes)
+		assert.Equal(t, int32(3), status.PendingNodes)
+	})
+
+	t.Run("should report why nodes cannot start pods", func(t *testing.T) {
+		status := getDaemonJob(t, fakeClient).Status
+		require.Len(t, status.Nodes, 5)
+		assert.Equal(t, djv2.NodeStatus{Name: "node-b", Phase: djv2.NodePending, Reason: "NotReady", Message: "Node is not ready, its Ready condition is False"}, status.Nodes[1])
+		assert.Equal(t, djv2.NodeStatus{Name: "node-c", Phase: djv2.NodePending, Reason: "Unschedulable", Message: "Node is cordoned"}, status.Nodes[2])
+		assert.Equal(t, djv2.NodeStatus{Name: "node-d", Phase: djv2.NodePending, Reason: "UntoleratedTaint", Message: "Node has taint maintenance:NoExecute that the pod does not tolerate"}, status.Nodes[3])
+		require.Len(t, status.Conditions, 1)
+		assert.Equal(t, djv2.DaemonJobNodesUnavailable, status.Conditions[0].Type)
+		assert.Equal(t, "CannotStartPods", status.Conditions[0].Reason)
+		assert.Equal(t, "3 nodes cannot start pods: node-b (NotReady), node-c (Unschedulable), node-d (UntoleratedTaint)", status.Conditions[0].Message)
+	})
+}
+
+func TestDaemonJobControllerTolerations(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.JobTemplate.Spec.Template.Spec.Tolerations = []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
+	objects := append([]runtime.Object{instance}, getUnavailableTestNodes()...)
+	fakeClient := fake.NewFakeClientWithScheme(scheme, objects...)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run tolerated nodes but not NotReady ones", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"node-c", "node-d"}, getJobNodes(getJobs(t, fakeClient)))
+	})
+
+	t.Run("should clear the reason once the node can start pods", func(t *testing.T) {
+		node := &corev1.Node{}
+		require.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-b"}, node))
+		node.Status.Conditions[0].Status = corev1.ConditionTrue
+		require.NoError(t, fakeClient.Update(context.Background(), node))
+		_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+		require.NoError(t, err)
+
+		status := getDaemonJob(t, fakeClient).Status
+		require.Len(t, status.Nodes, 3)
+		assert.Equal(t, djv2.NodeRunning, status.Nodes[0].Phase)
+		assert.Empty(t, status.Conditions)
+	})
+}
+
+func TestDaemonJobControllerKeepJobOfUnavailableNode(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	node := getTestNode("node-a", nil)
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR.DeepCopy(), node)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	jobs := getJobs(t, fakeClient)
+	require.Len(t, jobs, 1)
+
+	node.Spec.Unschedulable = true
+	require.NoError(t, fakeClient.Update(context.Background(), node))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should keep job of cordoned node", func(t *testing.T) {
+		remaining := getJobs(t, fakeClient)
+		require.Len(t, remaining, 1)
+		assert.Equal(t, jobs[0].Name, remaining[0].Name)
+		assert.Equal(t, int32(1), getDaemonJob(t, fakeClient).Status.ActiveNodes)
+	})
+}
+
+func TestGetNodeSelector(t *testing.T) {
+	instance := daemonjobCR.DeepCopy()
+	selector, err := getNodeSelector(instance)
+	require.NoError(t, err)
+	assert.True(t, selector.Empty())
+
+	instance.Spec.Nodes.Selector = workerSelector
+	instance.Spec.Nodes.NodeSelector = map[string]string{"pool": "batch"}
+	selector, err = getNodeSelector(instance)
+	require.NoError(t, err)
+	assert.True(t, selector.Matches(labels.Set{"zone": "a", "role": "edge", "pool": "batch"}))
+	assert.False(t, selector.Matches(labels.Set{"zone": "a", "role": "worker"}), "node selector map has to match too")
+	assert.False(t, selector.Matches(labels.Set{"zone": "a", "role": "worker", "gpu": "true", "pool": "batch"}))
+}
+
+func TestGetNodeSelectorRequirements(t *testing.T) {
+	assert.Nil(t, getNodeSelectorRequirements(daemonjobCR))
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Nodes.Selector = workerSelector
+	assert.Equal(t, []corev1.NodeSelectorRequirement{
+		{Key: "zone", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}},
+		{Key: "role", Operator: corev1.NodeSelectorOpIn, Values: []string{"worker", "edge"}},
+		{Key: "gpu", Operator: corev1.NodeSelectorOpDoesNotExist},
+	}, getNodeSelectorRequirements(instance))
+}
+
+func TestNodePredicate(t *testing.T) {
+	node := getTestNode("node-a", map[string]string{"role": "worker"})
+
+	t.Run("should ignore heartbeats", func(t *testing.T) {
+		updated := node.DeepCopy()
+		updated.ResourceVersion = "2"
+		updated.Status.Conditions[0].LastHeartbeatTime = metav1.Now()
+		assert.False(t, nodePredicate.Update(event.UpdateEvent{ObjectOld: node, ObjectNew: updated}))
+	})
+
+	t.Run("should pass meaningful changes", func(t *testing.T) {
+		for name, update := range map[string]func(*corev1.Node){
+			"labels": func(n *corev1.Node) { n.Labels["zone"] = "a" },
+			"taints": func(n *corev1.Node) {
+				n.Spec.Taints = []corev1.Taint{{Key: "maintenance", Effect: corev1.TaintEffectNoSchedule}}
+			},
+			"unschedulable": func(n *corev1.Node) { n.Spec.Unschedulable = true },
+			"readiness":     func(n *corev1.Node) { n.Status.Conditions[0].Status = corev1.ConditionFalse },
+		} {
+			updated := node.DeepCopy()
+			update(updated)
+			assert.True(t, nodePredicate.Update(event.UpdateEvent{ObjectOld: node, ObjectNew: updated}), name)
+		}
+		assert.True(t, nodePredicate.Create(event.CreateEvent{Object: node}))
+		assert.True(t, nodePredicate.Delete(event.DeleteEvent{Object: node}))
+	})
+}
+
+func TestNodeEventHandler(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	workers := daemonjobCR.DeepCopy()
+	workers.Name = "workers"
+	workers.Spec.Nodes.NodeSelector = map[string]string{"role": "worker"}
+	edges := daemonjobCR.DeepCopy()
+	edges.Name = "edges"
+	edges.Spec.Nodes.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"role": "edge"}}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, workers, edges)
+	handler := &nodeEventHandler{client: fakeClient, log: ctrl.Log.WithName("nodes")}
+
+	getNames := func(requests []reconcile.Request) []string {
+		names := []string{}
+		for _, request := range requests {
+			names = append(names, request.Name)
+		}
+		return names
+	}
+
+	t.Run("should enqueue only matching DaemonJobs", func(t *testing.T) {
+		assert.Equal(t, []string{"workers"}, getNames(handler.getRequests(getTestNode("node-a", map[string]string{"role": "worker"}))))
+		assert.Empty(t, handler.getRequests(getTestNode("node-a", map[string]string{"role": "master"})))
+	})
+
+	t.Run("should enqueue DaemonJobs matching old or new node", func(t *testing.T) {
+		requests := handler.getRequests(
+			getTestNode("node-a", map[string]string{"role": "worker"}),
+			getTestNode("node-a", map[string]string{"role": "edge"}))
+		assert.ElementsMatch(t, []string{"workers", "edges"}, getNames(requests))
+	})
+}
@@ -0,0 +1,133 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// legacyJobSuffix was appended to the DaemonJob name by earlier versions, which ran a single Job for all nodes.
+const legacyJobSuffix = "-job"
+
+// getStaleJobsPolicy returns spec.staleJobsPolicy, defaulting to Delete.
+func getStaleJobsPolicy(instance *djv2.DaemonJob) djv2.StaleJobsPolicy {
+	if policy := instance.Spec.StaleJobsPolicy; policy != nil {
+		return *policy
+	}
+	return djv2.DeleteStaleJobs
+}
+
+// isOrphanedJob tells whether a Job carrying labels of the DaemonJob, but not controlled by it,
+// was left behind by it or by a previous DaemonJob of the same name. Jobs controlled by anything else are left alone.
+func isOrphanedJob(instance *djv2.DaemonJob, job *batchv1.Job) bool {
+	controller := metav1.GetControllerOf(job)
+	if controller == nil {
+		return true
+	}
+	gv, err := schema.ParseGroupVersion(controller.APIVersion)
+	return err == nil && gv.Group == djv2.GroupVersion.Group && controller.Kind == "DaemonJob" &&
+		controller.Name == instance.Name && controller.UID != instance.UID
+}
+
+// getLegacyJob returns the single Job of earlier versions, named after the DaemonJob, if it is still around.
+// It did not carry labels of the DaemonJob, so it is found by its name and owner.
+func (r *DaemonJobReconciler) getLegacyJob(ctx context.Context, instance *djv2.DaemonJob) (*batchv1.Job, error) {
+	job := &batchv1.Job{}
+	if err := r.Client.Get(ctx, types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name + legacyJobSuffix}, job); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// Jobs with labels of the DaemonJob are already known to getNodeJobs.
+	if _, ok := job.Labels[djv2.DaemonJobNameLabel]; ok {
+		return nil, nil
+	}
+	if !metav1.IsControlledBy(job, instance) && !isOrphanedJob(instance, job) {
+		return nil, nil
+	}
+	return job, nil
+}
+
+// takeAdoptableJob removes from orphaned Jobs and returns the one that can stand in for the desired Job of a node:
+// a Job without a controller, created for the same node from the same template.
+func takeAdoptableJob(orphanedJobs []*batchv1.Job, job *batchv1.Job) (*batchv1.Job, []*batchv1.Job) {
+	for i, orphan := range orphanedJobs {
+		if metav1.GetControllerOf(orphan) == nil && orphan.DeletionTimestamp.IsZero() &&
+			orphan.Labels[djv2.TeardownLabel] != "true" &&
+			orphan.Annotations[djv2.NodeNameAnnotation] == job.Annotations[djv2.NodeNameAnnotation] &&
+			orphan.Annotations[djv2.TemplateHashAnnotation] == job.Annotations[djv2.TemplateHashAnnotation] {
+			return orphan, append(orphanedJobs[:i:i], orphanedJobs[i+1:]...)
+		}
+	}
+	return nil, orphanedJobs
+}
+
+// adoptJob makes the DaemonJob the controller of an orphaned Job, so that it is accounted as the Job of its node.
+func (r *DaemonJobReconciler) adoptJob(ctx context.Context, instance *djv2.DaemonJob, job *batchv1.Job) error {
+	patch := client.MergeFrom(job.DeepCopy())
+	if err := controllerutil.SetControllerReference(instance, job, r.Scheme); err != nil {
+		return err
+	}
+	delete(job.Annotations, djv2.StaleAnnotation)
+	if err := r.Client.Patch(ctx, job, patch); err != nil {
+		return err
+	}
+	r.getLogger(ctx).Info("Adopted Job", "job", job.Name)
+	r.Recorder.Eventf(instance, corev1.EventTypeNormal, "JobAdopted", "Adopted Job %s of node %s",
+		job.Name, job.Annotations[djv2.NodeNameAnnotation])
+	return nil
+}
+
+// cleanupStaleJobs deletes Jobs of the DaemonJob that were not adopted, or marks them with StaleAnnotation
+// when spec.staleJobsPolicy retains them. Every Job is reported in an Event once.
+func (r *DaemonJobReconciler) cleanupStaleJobs(ctx context.Context, instance *djv2.DaemonJob, jobs []*batchv1.Job) error {
+	policy := getStaleJobsPolicy(instance)
+	for _, job := range jobs {
+		if !job.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if policy == djv2.RetainStaleJobs {
+			if job.Annotations[djv2.StaleAnnotation] == "true" {
+				continue
+			}
+			patch := client.MergeFrom(job.DeepCopy())
+			job.Annotations = mergeStringMaps(job.Annotations, map[string]string{djv2.StaleAnnotation: "true"})
+			if err := r.Client.Patch(ctx, job, patch); err != nil {
+				return err
+			}
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, "StaleJobRetained", "Retained stale Job %s", job.Name)
+			continue
+		}
+		if err := r.deleteJob(ctx, job); err != nil {
+			return err
+		}
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "StaleJobDeleted", "Deleted stale Job %s", job.Name)
+	}
+	return nil
+}
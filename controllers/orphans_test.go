@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func getOrphansDaemonJob(uid types.UID) *djv2.DaemonJob {
+	instance := daemonjobCR.DeepCopy()
+	instance.UID = uid
+	return instance
+}
+
+// getLegacyTestJob returns the single Job earlier versions created for all nodes, already finished.
+func getLegacyTestJob(t *testing.T, instance *djv2.DaemonJob) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Namespace: instance.Namespace, Name: instance.Name + legacyJobSuffix},
+		Spec:       batchv1.JobSpec{Template: instance.Spec.JobTemplate.Spec.Template},
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}},
+		},
+	}
+	require.NoError(t, controllerutil.SetControllerReference(instance, job, getTestScheme(t)))
+	return job
+}
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	events := []string{}
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	sort.Strings(events)
+	return events
+}
+
+func TestIsOrphanedJob(t *testing.T) {
+	scheme := getTestScheme(t)
+	instance := getOrphansDaemonJob("new-uid")
+	job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "node-a", "test-run")
+
+	assert.True(t, isOrphanedJob(instance, job))
+
+	previous := job.DeepCopy()
+	require.NoError(t, controllerutil.SetControllerReference(getOrphansDaemonJob("old-uid"), previous, scheme))
+	assert.True(t, isOrphanedJob(instance, previous))
+
+	controlled := job.DeepCopy()
+	require.NoError(t, controllerutil.SetControllerReference(instance, controlled, scheme))
+	assert.False(t, isOrphanedJob(instance, controlled))
+
+	foreign := job.DeepCopy()
+	foreign.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "batch/v1beta1", Kind: "CronJob", Name: instance.Name, UID: "cronjob-uid", Controller: &trueVal,
+	}}
+	assert.False(t, isOrphanedJob(instance, foreign))
+}
+
+func TestDaemonJobControllerOrphanedJobs(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := getOrphansDaemonJob("new-uid")
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil), getTestNode("node-b", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	// The Job of node-a loses its owner, e.g. after the DaemonJob was deleted leaving its Jobs behind.
+	var orphan batchv1.Job
+	for _, job := range getJobs(t, fakeClient) {
+		if job.Annotations[djv2.NodeNameAnnotation] == "node-a" {
+			orphan = job
+		}
+	}
+	orphan.OwnerReferences = nil
+	require.NoError(t, fakeClient.Update(context.Background(), &orphan))
+	// A previous DaemonJob of the same name left a Job behind.
+	previous := getOrphansDaemonJob("old-uid")
+	previousJob := getJob(previous, &previous.Spec.JobTemplate.Spec.Template, "node-b", "old-run")
+	previousJob.Name = "test-daemonjob-previous"
+	require.NoError(t, controllerutil.SetControllerReference(previous, previousJob, scheme))
+	require.NoError(t, fakeClient.Create(context.Background(), previousJob))
+	// Jobs controlled by something else are not touched, even with labels of the DaemonJob.
+	foreignJob := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "node-b", "foreign-run")
+	foreignJob.Name = "test-daemonjob-foreign"
+	foreignJob.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "batch/v1beta1", Kind: "CronJob", Name: "test-cronjob", UID: "cronjob-uid", Controller: &trueVal,
+	}}
+	require.NoError(t, fakeClient.Create(context.Background(), foreignJob))
+	require.NoError(t, fakeClient.Create(context.Background(), getLegacyTestJob(t, instance)))
+	drainEvents(recorder)
+
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should adopt job matching node", func(t *testing.T) {
+		adopted := &batchv1.Job{}
+		require.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Namespace: orphan.Namespace, Name: orphan.Name}, adopted))
+		assert.True(t, metav1.IsControlledBy(adopted, instance))
+		assert.Len(t, getDaemonJob(t, fakeClient).Status.Nodes, 2)
+	})
+
+	t.Run("should delete stale jobs and keep foreign ones", func(t *testing.T) {
+		names := []string{}
+		for _, job := range getJobs(t, fakeClient) {
+			names = append(names, job.Name)
+		}
+		assert.ElementsMatch(t, []string{orphan.Name, getJobName(instance, "node-b", 0), foreignJob.Name}, names)
+	})
+
+	t.Run("should report adopted and deleted jobs", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"Normal JobAdopted Adopted Job " + orphan.Name + " of node node-a",
+			"Normal StaleJobDeleted Deleted stale Job test-daemonjob-job",
+			"Normal StaleJobDeleted Deleted stale Job test-daemonjob-previous",
+		}, drainEvents(recorder))
+	})
+}
+
+func TestDaemonJobControllerRetainStaleJobs(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := getOrphansDaemonJob("new-uid")
+	policy := djv2.RetainStaleJobs
+	instance.Spec.StaleJobsPolicy = &policy
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil), getLegacyTestJob(t, instance))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+
+	for i := 0; i < 2; i++ {
+		_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+		require.NoError(t, err)
+	}
+
+	t.Run("should mark stale job and report it once", func(t *testing.T) {
+		legacyJob := &batchv1.Job{}
+		require.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name + legacyJobSuffix}, legacyJob))
+		assert.Equal(t, "true", legacyJob.Annotations[djv2.StaleAnnotation])
+		assert.Equal(t, []string{"Warning StaleJobRetained Retained stale Job test-daemonjob-job"}, drainEvents(recorder))
+	})
+}
+
+func TestGetStaleJobsPolicy(t *testing.T) {
+	assert.Equal(t, djv2.DeleteStaleJobs, getStaleJobsPolicy(daemonjobCR))
+	instance := daemonjobCR.DeepCopy()
+	policy := djv2.RetainStaleJobs
+	instance.Spec.StaleJobsPolicy = &policy
+	assert.Equal(t, djv2.RetainStaleJobs, getStaleJobsPolicy(instance))
+}
@@ -0,0 +1,124 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// getOverrideSelectors returns selectors of nodes every override of the DaemonJob is applied to.
+func getOverrideSelectors(instance *djv2.DaemonJob) ([]labels.Selector, error) {
+	selectors := make([]labels.Selector, len(instance.Spec.Overrides))
+	for i := range instance.Spec.Overrides {
+		selector, err := metav1.LabelSelectorAsSelector(&instance.Spec.Overrides[i].Selector)
+		if err != nil {
+			return nil, err
+		}
+		selectors[i] = selector
+	}
+	return selectors, nil
+}
+
+// applyOverrides returns a copy of the pod template patched with every override matching the node,
+// along with names of applied overrides.
+func applyOverrides(instance *djv2.DaemonJob, selectors []labels.Selector, template *corev1.PodTemplateSpec,
+	node *corev1.Node) (*corev1.PodTemplateSpec, []string, error) {
+	var applied []string
+	patched := template
+	for i, override := range instance.Spec.Overrides {
+		if !selectors[i].Matches(labels.Set(node.Labels)) {
+			continue
+		}
+		if applied == nil {
+			patched = template.DeepCopy()
+		}
+		for _, containerOverride := range override.Containers {
+			container := findContainer(&patched.Spec, containerOverride.Name)
+			if container == nil {
+				return nil, nil, fmt.Errorf("override %s patches container %s missing in the pod template", override.Name, containerOverride.Name)
+			}
+			applyContainerOverride(container, &containerOverride)
+		}
+		applied = append(applied, override.Name)
+	}
+	return patched, applied, nil
+}
+
+func findContainer(spec *corev1.PodSpec, name string) *corev1.Container {
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			if containers[i].Name == name {
+				return &containers[i]
+			}
+		}
+	}
+	return nil
+}
+
+func applyContainerOverride(container *corev1.Container, override *djv2.ContainerOverride) {
+	if override.Image != "" {
+		container.Image = override.Image
+	}
+	if override.Args != nil {
+		container.Args = append([]string(nil), override.Args...)
+	}
+	if override.Resources != nil {
+		container.Resources.Limits = mergeResourceLists(container.Resources.Limits, override.Resources.Limits)
+		container.Resources.Requests = mergeResourceLists(container.Resources.Requests, override.Resources.Requests)
+	}
+	for _, envVar := range override.Env {
+		replaced := false
+		for i := range container.Env {
+			if container.Env[i].Name == envVar.Name {
+				container.Env[i] = *envVar.DeepCopy()
+				replaced = true
+			}
+		}
+		if !replaced {
+			container.Env = append(container.Env, *envVar.DeepCopy())
+		}
+	}
+}
+
+func mergeResourceLists(base, overrides corev1.ResourceList) corev1.ResourceList {
+	if len(overrides) == 0 {
+		return base
+	}
+	merged := corev1.ResourceList{}
+	for name, quantity := range base {
+		merged[name] = quantity
+	}
+	for name, quantity := range overrides {
+		merged[name] = quantity
+	}
+	return merged
+}
+
+// getJobOverrides returns names of overrides applied to the Job.
+func getJobOverrides(annotations map[string]string) []string {
+	if overrides := annotations[djv2.OverridesAnnotation]; overrides != "" {
+		return strings.Split(overrides, ",")
+	}
+	return nil
+}
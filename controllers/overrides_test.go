@@ -0,0 +1,109 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func getOverridesDaemonJob() *djv2.DaemonJob {
+	instance := daemonjobCR.DeepCopy()
+	container := &instance.Spec.JobTemplate.Spec.Template.Spec.Containers[0]
+	container.Args = []string{"--verbose"}
+	container.Env = []corev1.EnvVar{{Name: "MODE", Value: "default"}}
+	container.Resources.Requests = corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("100m"),
+		corev1.ResourceMemory: resource.MustParse("64Mi"),
+	}
+	instance.Spec.Overrides = []djv2.Override{
+		{
+			Name:       "arm64",
+			Selector:   metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/arch": "arm64"}},
+			Containers: []djv2.ContainerOverride{{Name: "test-container", Image: "test-image-arm64"}},
+		},
+		{
+			Name:     "large",
+			Selector: metav1.LabelSelector{MatchLabels: map[string]string{"size": "large"}},
+			Containers: []djv2.ContainerOverride{{
+				Name:      "test-container",
+				Resources: &corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")}},
+				Env:       []corev1.EnvVar{{Name: "MODE", Value: "large"}, {Name: "WORKERS", Value: "8"}},
+				Args:      []string{"--quiet"},
+			}},
+		},
+	}
+	return instance
+}
+
+func TestApplyOverrides(t *testing.T) {
+	instance := getOverridesDaemonJob()
+	selectors, err := getOverrideSelectors(instance)
+	require.NoError(t, err)
+	template := &instance.Spec.JobTemplate.Spec.Template
+
+	t.Run("should keep template on nodes without matching overrides", func(t *testing.T) {
+		patched, applied, err := applyOverrides(instance, selectors, template, getTestNode("node-a", nil))
+		require.NoError(t, err)
+		assert.Equal(t, template, patched)
+		assert.Nil(t, applied)
+	})
+
+	t.Run("should apply every matching override in order", func(t *testing.T) {
+		node := getTestNode("node-a", map[string]string{"kubernetes.io/arch": "arm64", "size": "large"})
+		patched, applied, err := applyOverrides(instance, selectors, template, node)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"arm64", "large"}, applied)
+		container := patched.Spec.Containers[0]
+		assert.Equal(t, "test-image-arm64", container.Image)
+		assert.Equal(t, []string{"--quiet"}, container.Args)
+		assert.Equal(t, []corev1.EnvVar{{Name: "MODE", Value: "large"}, {Name: "WORKERS", Value: "8"}}, container.Env)
+		assert.Equal(t, corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("100m"),
+			corev1.ResourceMemory: resource.MustParse("1Gi"),
+		}, container.Resources.Requests)
+		assert.Equal(t, "test-image", template.Spec.Containers[0].Image)
+	})
+
+	t.Run("should fail when patched container is missing", func(t *testing.T) {
+		instance := getOverridesDaemonJob()
+		instance.Spec.Overrides[0].Containers[0].Name = "missing"
+		_, _, err := applyOverrides(instance, selectors, template, getTestNode("node-a", map[string]string{"kubernetes.io/arch": "arm64"}))
+		assert.EqualError(t, err, "override arm64 patches container missing missing in the pod template")
+	})
+}
+
+func TestDaemonJobControllerOverrides(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, getOverridesDaemonJob(),
+		getTestNode("node-a", nil), getTestNode("node-b", map[string]string{"kubernetes.io/arch": "arm64"}))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should patch pods of matching nodes", func(t *testing.T) {
+		images := map[string]string{}
+		for _, job := range getJobs(t, fakeClient) {
+			images[job.Annotations[djv2.NodeNameAnnotation]] = job.Spec.Template.Spec.Containers[0].Image
+		}
+		assert.Equal(t, map[string]string{"node-a": "test-image", "node-b": "test-image-arm64"}, images)
+	})
+
+	t.Run("should report applied overrides in node status", func(t *testing.T) {
+		nodes := getDaemonJob(t, fakeClient).Status.Nodes
+		require.Len(t, nodes, 2)
+		assert.Nil(t, nodes[0].Overrides)
+		assert.Equal(t, []string{"arm64"}, nodes[1].Overrides)
+	})
+}
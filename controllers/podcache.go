@@ -0,0 +1,264 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// defaultPodResync is the resync period of pod informers, the same as of other informers of the manager.
+const defaultPodResync = 10 * time.Hour
+
+// PodCacheBuilder wraps the cache built by newCache so that only pods labeled with a DaemonJob name are cached,
+// instead of every pod of the watched namespaces. Lists of pods not selected by that label,
+// such as pods of Jobs created before pods were labeled, are read from the API server.
+// Pods are cached in the given namespaces, or in all namespaces if none are given.
+func PodCacheBuilder(newCache cache.NewCacheFunc, namespaces []string) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		objects, err := newCache(config, opts)
+		if err != nil {
+			return nil, err
+		}
+		apiReader, err := client.New(config, client.Options{Scheme: opts.Scheme, Mapper: opts.Mapper})
+		if err != nil {
+			return nil, err
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		resync := defaultPodResync
+		if opts.Resync != nil {
+			resync = *opts.Resync
+		}
+		if len(namespaces) == 0 {
+			namespaces = []string{metav1.NamespaceAll}
+		}
+		podInformers := map[string]toolscache.SharedIndexInformer{}
+		for _, namespace := range namespaces {
+			factory := informers.NewSharedInformerFactoryWithOptions(clientset, resync,
+				informers.WithNamespace(namespace),
+				informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+					options.LabelSelector = djv2.DaemonJobNameLabel
+				}))
+			podInformers[namespace] = factory.Core().V1().Pods().Informer()
+		}
+		return &podCache{Cache: objects, pods: podInformers, apiReader: apiReader}, nil
+	}
+}
+
+// podCache serves labeled pods from its own informers, one for every namespace, and other objects from the wrapped cache.
+type podCache struct {
+	cache.Cache
+	pods      map[string]toolscache.SharedIndexInformer
+	apiReader client.Reader
+}
+
+var _ cache.Cache = &podCache{}
+
+// getIndexers returns stores of pods in the namespace, or in all namespaces if it is empty.
+func (c *podCache) getIndexers(namespace string) []toolscache.Indexer {
+	if informer, ok := c.pods[metav1.NamespaceAll]; ok {
+		return []toolscache.Indexer{informer.GetIndexer()}
+	}
+	if namespace != metav1.NamespaceAll {
+		if informer, ok := c.pods[namespace]; ok {
+			return []toolscache.Indexer{informer.GetIndexer()}
+		}
+		return nil
+	}
+	var indexers []toolscache.Indexer
+	for _, informer := range c.pods {
+		indexers = append(indexers, informer.GetIndexer())
+	}
+	return indexers
+}
+
+// Get implements client.Reader. Pods missing from the cache are read from the API server.
+func (c *podCache) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return c.Cache.Get(ctx, key, obj)
+	}
+	for _, indexer := range c.getIndexers(key.Namespace) {
+		item, exists, err := indexer.GetByKey(key.String())
+		if err != nil {
+			return err
+		}
+		if exists {
+			item.(*corev1.Pod).DeepCopyInto(pod)
+			return nil
+		}
+	}
+	return c.apiReader.Get(ctx, key, obj)
+}
+
+// List implements client.Reader. Only lists selecting pods by the DaemonJob name are served from the cache.
+func (c *podCache) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	podList, ok := list.(*corev1.PodList)
+	if !ok {
+		return c.Cache.List(ctx, list, opts...)
+	}
+	listOpts := client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	if !selectsDaemonJobPods(listOpts.LabelSelector) || listOpts.FieldSelector != nil {
+		return c.apiReader.List(ctx, list, opts...)
+	}
+	indexers := c.getIndexers(listOpts.Namespace)
+	if len(indexers) == 0 {
+		return c.apiReader.List(ctx, list, opts...)
+	}
+	podList.Items = nil
+	for _, indexer := range indexers {
+		var items []interface{}
+		var err error
+		if listOpts.Namespace != metav1.NamespaceAll {
+			items, err = indexer.ByIndex(toolscache.NamespaceIndex, listOpts.Namespace)
+		} else {
+			items = indexer.List()
+		}
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			pod := item.(*corev1.Pod)
+			if listOpts.LabelSelector.Matches(labels.Set(pod.Labels)) {
+				podList.Items = append(podList.Items, *pod.DeepCopy())
+			}
+		}
+	}
+	return nil
+}
+
+// selectsDaemonJobPods tells whether the selector selects only pods labeled with a DaemonJob name.
+func selectsDaemonJobPods(selector labels.Selector) bool {
+	if selector == nil {
+		return false
+	}
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		if requirement.Key() != djv2.DaemonJobNameLabel {
+			continue
+		}
+		switch requirement.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In, selection.Exists:
+			return true
+		}
+	}
+	return false
+}
+
+// GetInformer implements cache.Informers.
+func (c *podCache) GetInformer(ctx context.Context, obj runtime.Object) (cache.Informer, error) {
+	if _, ok := obj.(*corev1.Pod); ok {
+		return c.getPodInformer(), nil
+	}
+	return c.Cache.GetInformer(ctx, obj)
+}
+
+// GetInformerForKind implements cache.Informers.
+func (c *podCache) GetInformerForKind(ctx context.Context, gvk schema.GroupVersionKind) (cache.Informer, error) {
+	if gvk == corev1.SchemeGroupVersion.WithKind("Pod") {
+		return c.getPodInformer(), nil
+	}
+	return c.Cache.GetInformerForKind(ctx, gvk)
+}
+
+func (c *podCache) getPodInformer() podInformer {
+	informer := podInformer{}
+	for _, namespaceInformer := range c.pods {
+		informer = append(informer, namespaceInformer)
+	}
+	return informer
+}
+
+// Start implements cache.Informers.
+func (c *podCache) Start(stopCh <-chan struct{}) error {
+	for _, informer := range c.pods {
+		go informer.Run(stopCh)
+	}
+	return c.Cache.Start(stopCh)
+}
+
+// WaitForCacheSync implements cache.Informers.
+func (c *podCache) WaitForCacheSync(stop <-chan struct{}) bool {
+	return toolscache.WaitForCacheSync(stop, c.getPodInformer().HasSynced) && c.Cache.WaitForCacheSync(stop)
+}
+
+// IndexField implements client.FieldIndexer.
+func (c *podCache) IndexField(ctx context.Context, obj runtime.Object, field string, extractValue client.IndexerFunc) error {
+	if _, ok := obj.(*corev1.Pod); ok {
+		return fmt.Errorf("field indexes of pods are not supported")
+	}
+	return c.Cache.IndexField(ctx, obj, field, extractValue)
+}
+
+// podInformer passes event handlers and indexers to informers of pods in every watched namespace.
+type podInformer []toolscache.SharedIndexInformer
+
+var _ cache.Informer = podInformer{}
+
+// AddEventHandler implements cache.Informer.
+func (i podInformer) AddEventHandler(handler toolscache.ResourceEventHandler) {
+	for _, informer := range i {
+		informer.AddEventHandler(handler)
+	}
+}
+
+// AddEventHandlerWithResyncPeriod implements cache.Informer.
+func (i podInformer) AddEventHandlerWithResyncPeriod(handler toolscache.ResourceEventHandler, resyncPeriod time.Duration) {
+	for _, informer := range i {
+		informer.AddEventHandlerWithResyncPeriod(handler, resyncPeriod)
+	}
+}
+
+// AddIndexers implements cache.Informer.
+func (i podInformer) AddIndexers(indexers toolscache.Indexers) error {
+	for _, informer := range i {
+		if err := informer.AddIndexers(indexers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HasSynced implements cache.Informer.
+func (i podInformer) HasSynced() bool {
+	for _, informer := range i {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func TestPodCache(t *testing.T) {
+	labeled := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: daemonjobName.Namespace, Name: "labeled-pod", Labels: map[string]string{djv2.DaemonJobNameLabel: daemonjobName.Name},
+	}}
+	other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: daemonjobName.Namespace, Name: "other-pod", Labels: map[string]string{djv2.DaemonJobNameLabel: "other"},
+	}}
+	unlabeled := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: daemonjobName.Namespace, Name: "unlabeled-pod", Labels: map[string]string{"controller-uid": "legacy-uid"},
+	}}
+	informer := informers.NewSharedInformerFactory(kubefake.NewSimpleClientset(), 0).Core().V1().Pods().Informer()
+	require.NoError(t, informer.GetIndexer().Add(labeled))
+	require.NoError(t, informer.GetIndexer().Add(other))
+	c := &podCache{
+		pods:      map[string]toolscache.SharedIndexInformer{daemonjobName.Namespace: informer},
+		apiReader: fake.NewFakeClientWithScheme(getTestScheme(t), unlabeled),
+	}
+	ctx := context.Background()
+
+	t.Run("should list labeled pods from cache", func(t *testing.T) {
+		var pods corev1.PodList
+		require.NoError(t, c.List(ctx, &pods, client.InNamespace(daemonjobName.Namespace), client.MatchingLabels{djv2.DaemonJobNameLabel: daemonjobName.Name}))
+		require.Len(t, pods.Items, 1)
+		assert.Equal(t, labeled.Name, pods.Items[0].Name)
+	})
+
+	t.Run("should list other pods from API server", func(t *testing.T) {
+		var pods corev1.PodList
+		require.NoError(t, c.List(ctx, &pods, client.InNamespace(daemonjobName.Namespace), client.MatchingLabels{"controller-uid": "legacy-uid"}))
+		require.Len(t, pods.Items, 1)
+		assert.Equal(t, unlabeled.Name, pods.Items[0].Name)
+	})
+
+	t.Run("should get pods from cache or API server", func(t *testing.T) {
+		for _, name := range []string{labeled.Name, unlabeled.Name} {
+			pod := &corev1.Pod{}
+			require.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: daemonjobName.Namespace, Name: name}, pod))
+			assert.Equal(t, name, pod.Name)
+		}
+		err := c.Get(ctx, types.NamespacedName{Namespace: daemonjobName.Namespace, Name: "missing-pod"}, &corev1.Pod{})
+		assert.True(t, errors.IsNotFound(err))
+	})
+}
+
+func TestSelectsDaemonJobPods(t *testing.T) {
+	for selector, expected := range map[string]bool{
+		djv2.DaemonJobNameLabel + "=test":     true,
+		djv2.DaemonJobNameLabel + " in (a,b)": true,
+		djv2.DaemonJobNameLabel + ",app=test": true,
+		djv2.DaemonJobNameLabel + "!=test":    false,
+		"app=test":                            false,
+		"!" + djv2.DaemonJobNameLabel:         false,
+	} {
+		parsed, err := labels.Parse(selector)
+		require.NoError(t, err)
+		assert.Equal(t, expected, selectsDaemonJobPods(parsed), selector)
+	}
+	assert.False(t, selectsDaemonJobPods(nil))
+}
@@ -0,0 +1,74 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// RateLimiterOptions configure how fast DaemonJobs are requeued.
+type RateLimiterOptions struct {
+	// BaseDelay is the delay before a DaemonJob that failed to reconcile is retried the first time.
+	// The delay doubles with every following failure.
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between retries of a failing DaemonJob.
+	MaxDelay time.Duration
+
+	// QPS is the overall rate of requeues of all DaemonJobs.
+	QPS float64
+
+	// Burst is the number of requeues allowed above QPS at once.
+	Burst int
+}
+
+// DefaultRateLimiterOptions are the settings of the default controller rate limiter.
+var DefaultRateLimiterOptions = RateLimiterOptions{
+	BaseDelay: 5 * time.Millisecond,
+	MaxDelay:  1000 * time.Second,
+	QPS:       10,
+	Burst:     100,
+}
+
+// Validate checks that the options allow DaemonJobs to be requeued at all.
+func (o RateLimiterOptions) Validate() error {
+	if o.BaseDelay <= 0 {
+		return fmt.Errorf("base delay must be positive, got %v", o.BaseDelay)
+	}
+	if o.MaxDelay < o.BaseDelay {
+		return fmt.Errorf("max delay %v must not be shorter than base delay %v", o.MaxDelay, o.BaseDelay)
+	}
+	if o.QPS <= 0 {
+		return fmt.Errorf("QPS must be positive, got %v", o.QPS)
+	}
+	if o.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1, got %d", o.Burst)
+	}
+	return nil
+}
+
+// NewRateLimiter returns a rate limiter with per-DaemonJob exponential backoff and an overall token bucket.
+func NewRateLimiter(options RateLimiterOptions) workqueue.RateLimiter {
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(options.BaseDelay, options.MaxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(options.QPS), options.Burst)},
+	)
+}
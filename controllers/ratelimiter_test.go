@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestRateLimiterOptionsValidate(t *testing.T) {
+	assert.NoError(t, DefaultRateLimiterOptions.Validate())
+
+	for name, update := range map[string]func(*RateLimiterOptions){
+		"base delay": func(o *RateLimiterOptions) { o.BaseDelay = 0 },
+		"max delay":  func(o *RateLimiterOptions) { o.MaxDelay = time.Millisecond },
+		"QPS":        func(o *RateLimiterOptions) { o.QPS = 0 },
+		"burst":      func(o *RateLimiterOptions) { o.Burst = 0 },
+	} {
+		options := DefaultRateLimiterOptions
+		update(&options)
+		assert.Error(t, options.Validate(), name)
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(RateLimiterOptions{BaseDelay: time.Second, MaxDelay: 4 * time.Second, QPS: 1000, Burst: 1000})
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "test-daemonjob"}}
+
+	t.Run("should back off failing DaemonJob exponentially up to max delay", func(t *testing.T) {
+		var delays []time.Duration
+		for i := 0; i < 4; i++ {
+			delays = append(delays, limiter.When(request))
+		}
+		assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}, delays)
+	})
+
+	t.Run("should reset backoff once DaemonJob is forgotten", func(t *testing.T) {
+		limiter.Forget(request)
+		assert.Equal(t, time.Second, limiter.When(request))
+	})
+}
@@ -0,0 +1,191 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+const canaryWaveName = "canary"
+
+// wave is a group of nodes rolled out together.
+type wave struct {
+	name  string
+	nodes []corev1.Node
+}
+
+// pendingJob is a Job of a node that has not started yet.
+type pendingJob struct {
+	job  *batchv1.Job
+	wave *djv2.WaveStatus
+}
+
+// getWaves splits targeted nodes into rollout waves.
+// Without a rollout all nodes form a single wave.
+func getWaves(instance *djv2.DaemonJob, nodes []corev1.Node) ([]wave, error) {
+	rollout := instance.Spec.Rollout
+	if rollout == nil {
+		return []wave{{name: getWaveName(1), nodes: nodes}}, nil
+	}
+
+	var waves []wave
+	if rollout.Canary != nil {
+		canaryNodes, fleetNodes, err := splitCanaryNodes(rollout.Canary, nodes)
+		if err != nil {
+			return nil, err
+		}
+		waves = append(waves, wave{name: canaryWaveName, nodes: canaryNodes})
+		nodes = fleetNodes
+	}
+
+	fleetSize := len(nodes)
+	for i := range rollout.Waves {
+		size, err := intstr.GetValueFromIntOrPercent(&rollout.Waves[i], fleetSize, true)
+		if err != nil {
+			return nil, err
+		}
+		if size > len(nodes) {
+			size = len(nodes)
+		}
+		waves = append(waves, wave{name: getWaveName(i + 1), nodes: nodes[:size]})
+		nodes = nodes[size:]
+	}
+	if len(nodes) > 0 || len(rollout.Waves) == 0 {
+		waves = append(waves, wave{name: getWaveName(len(rollout.Waves) + 1), nodes: nodes})
+	}
+	return waves, nil
+}
+
+// hasRolloutWaves returns whether canary nodes or waves are used, in which case the rollout status is reported.
+func hasRolloutWaves(instance *djv2.DaemonJob) bool {
+	rollout := instance.Spec.Rollout
+	return rollout != nil && (rollout.Canary != nil || len(rollout.Waves) > 0)
+}
+
+func getWaveName(index int) string {
+	return fmt.Sprintf("wave-%d", index)
+}
+
+// splitCanaryNodes returns canary nodes and the rest of the fleet.
+// Without a selector a single node is used as canary unless the number of nodes is given.
+func splitCanaryNodes(canary *djv2.Canary, nodes []corev1.Node) ([]corev1.Node, []corev1.Node, error) {
+	selector := labels.Everything()
+	if canary.Selector != nil {
+		var err error
+		if selector, err = metav1.LabelSelectorAsSelector(canary.Selector); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	limit := len(nodes)
+	if canary.Nodes != nil {
+		var err error
+		if limit, err = intstr.GetValueFromIntOrPercent(canary.Nodes, len(nodes), true); err != nil {
+			return nil, nil, err
+		}
+	} else if canary.Selector == nil {
+		limit = 1
+	}
+
+	var canaryNodes, fleetNodes []corev1.Node
+	for _, node := range nodes {
+		if len(canaryNodes) < limit && selector.Matches(labels.Set(node.Labels)) {
+			canaryNodes = append(canaryNodes, node)
+		} else {
+			fleetNodes = append(fleetNodes, node)
+		}
+	}
+	return canaryNodes, fleetNodes, nil
+}
+
+// updateWaveStatusWithJob accounts the node Job in the status of its wave.
+func updateWaveStatusWithJob(status *djv2.WaveStatus, job *batchv1.Job) {
+	switch _, condition := getFinishedStatus(job); condition {
+	case batchv1.JobComplete:
+		status.Succeeded++
+	case batchv1.JobFailed:
+		status.Failed++
+	default:
+		status.Active++
+	}
+}
+
+// isWaveFinished tells whether every node of the wave that can start a pod has finished.
+func isWaveFinished(status *djv2.WaveStatus) bool {
+	return status.Succeeded+status.Failed+status.Unavailable == status.Nodes
+}
+
+// getWavePhase returns the phase of the wave. Unavailable nodes are left out,
+// unless no node of the wave has started. An empty canary wave stays pending, as it holds back the fleet.
+func getWavePhase(status djv2.WaveStatus) djv2.WavePhase {
+	started := status.Active + status.Succeeded + status.Failed
+	switch {
+	case started == 0 && (status.Nodes > 0 || status.Name == canaryWaveName):
+		return djv2.WavePending
+	case status.Succeeded+status.Unavailable == status.Nodes:
+		return djv2.WaveSucceeded
+	case isWaveFinished(&status):
+		return djv2.WaveFailed
+	default:
+		return djv2.WaveRunning
+	}
+}
+
+// getRolloutStatus sets wave phases and returns the rollout status.
+// The current wave is the last one that has started, or the first one when none has started yet.
+func getRolloutStatus(waves []djv2.WaveStatus, halted bool) *djv2.RolloutStatus {
+	status := &djv2.RolloutStatus{Halted: halted, Waves: waves}
+	for i := range waves {
+		waves[i].Phase = getWavePhase(waves[i])
+		if waves[i].Phase != djv2.WavePending || status.CurrentWave == "" {
+			status.CurrentWave = waves[i].Name
+		}
+	}
+	return status
+}
+
+// recordRolloutEvents emits an Event for every wave that changed its phase since the previous status.
+func (r *DaemonJobReconciler) recordRolloutEvents(instance *djv2.DaemonJob, previous, current *djv2.RolloutStatus) {
+	previousPhases := map[string]djv2.WavePhase{}
+	if previous != nil {
+		for _, wave := range previous.Waves {
+			previousPhases[wave.Name] = wave.Phase
+		}
+	}
+
+	for _, wave := range current.Waves {
+		if previousPhase, ok := previousPhases[wave.Name]; ok && previousPhase == wave.Phase {
+			continue
+		}
+		switch wave.Phase {
+		case djv2.WaveRunning:
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "WaveStarted", "Started %s on %d nodes", wave.Name, wave.Nodes)
+		case djv2.WaveSucceeded:
+			r.Recorder.Eventf(instance, corev1.EventTypeNormal, "WaveSucceeded", "All %d nodes of %s succeeded", wave.Succeeded, wave.Name)
+		case djv2.WaveFailed:
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, "WaveFailed", "%d of %d nodes of %s failed", wave.Failed, wave.Nodes, wave.Name)
+		}
+	}
+}
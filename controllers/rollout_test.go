@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func getWaveNodeNames(waves []wave) map[string][]string {
+	names := map[string][]string{}
+	for _, w := range waves {
+		names[w.name] = []string{}
+		for _, node := range w.nodes {
+			names[w.name] = append(names[w.name], node.Name)
+		}
+	}
+	return names
+}
+
+func TestGetWaves(t *testing.T) {
+	nodes := []corev1.Node{
+		*getTestNode("node-a", nil),
+		*getTestNode("node-b", map[string]string{"canary": "true"}),
+		*getTestNode("node-c", nil),
+		*getTestNode("node-d", nil),
+		*getTestNode("node-e", nil),
+	}
+
+	t.Run("should use single wave without rollout", func(t *testing.T) {
+		waves, err := getWaves(daemonjobCR, nodes)
+		require.NoError(t, err)
+		assert.Equal(t, map[string][]string{
+			"wave-1": {"node-a", "node-b", "node-c", "node-d", "node-e"},
+		}, getWaveNodeNames(waves))
+	})
+
+	t.Run("should use first node as canary by default", func(t *testing.T) {
+		instance := daemonjobCR.DeepCopy()
+		instance.Spec.Rollout = &djv2.Rollout{Canary: &djv2.Canary{}}
+		waves, err := getWaves(instance, nodes)
+		require.NoError(t, err)
+		assert.Equal(t, canaryWaveName, waves[0].name)
+		assert.Equal(t, map[string][]string{
+			"canary": {"node-a"},
+			"wave-1": {"node-b", "node-c", "node-d", "node-e"},
+		}, getWaveNodeNames(waves))
+	})
+
+	t.Run("should select canary nodes by label and split fleet into waves", func(t *testing.T) {
+		instance := daemonjobCR.DeepCopy()
+		instance.Spec.Rollout = &djv2.Rollout{
+			Canary: &djv2.Canary{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"canary": "true"}}},
+			Waves:  []intstr.IntOrString{intstr.FromInt(1), intstr.FromString("50%")},
+		}
+		waves, err := getWaves(instance, nodes)
+		require.NoError(t, err)
+		assert.Equal(t, map[string][]string{
+			"canary": {"node-b"},
+			"wave-1": {"node-a"},
+			"wave-2": {"node-c", "node-d"},
+			"wave-3": {"node-e"},
+		}, getWaveNodeNames(waves))
+	})
+}
+
+func TestDaemonJobControllerRollout(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	canaryNodes := intstr.FromInt(1)
+	instance.Spec.Rollout = &djv2.Rollout{
+		Canary: &djv2.Canary{Nodes: &canaryNodes},
+		Waves:  []intstr.IntOrString{intstr.FromInt(1)},
+	}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance,
+		getTestNode("node-a", nil), getTestNode("node-b", nil), getTestNode("node-c", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should start canary first", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, "node-a", jobs[0].Annotations[djv2.NodeNameAnnotation])
+		rollout := getDaemonJob(t, fakeClient).Status.Rollout
+		require.NotNil(t, rollout)
+		assert.Equal(t, canaryWaveName, rollout.CurrentWave)
+		assert.Equal(t, []djv2.WavePhase{djv2.WaveRunning, djv2.WavePending, djv2.WavePending},
+			[]djv2.WavePhase{rollout.Waves[0].Phase, rollout.Waves[1].Phase, rollout.Waves[2].Phase})
+		assert.Equal(t, "Normal WaveStarted Started canary on 1 nodes", <-recorder.Events)
+	})
+
+	completeJob(t, fakeClient, getJobs(t, fakeClient)[0])
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should continue with next wave when canary succeeded", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 2)
+		rollout := getDaemonJob(t, fakeClient).Status.Rollout
+		assert.Equal(t, "wave-1", rollout.CurrentWave)
+		assert.Equal(t, djv2.WaveSucceeded, rollout.Waves[0].Phase)
+		assert.Equal(t, djv2.WaveRunning, rollout.Waves[1].Phase)
+		assert.Equal(t, djv2.WavePending, rollout.Waves[2].Phase)
+	})
+}
+
+func TestDaemonJobControllerRolloutCanaryFailure(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Rollout = &djv2.Rollout{Canary: &djv2.Canary{}}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil), getTestNode("node-b", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	<-recorder.Events
+
+	failJob(t, fakeClient, getJobs(t, fakeClient)[0])
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should halt rollout when canary failed", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 1)
+		status := getDaemonJob(t, fakeClient).Status
+		assert.True(t, status.Rollout.Halted)
+		assert.Equal(t, int32(1), status.PendingNodes)
+		require.Len(t, status.Conditions, 1)
+		assert.Equal(t, djv2.DaemonJobFailed, status.Conditions[0].Type)
+		assert.Equal(t, "CanaryFailed", status.Conditions[0].Reason)
+		assert.Zero(t, result.RequeueAfter)
+		assert.Equal(t, "Warning WaveFailed 1 of 1 nodes of canary failed", <-recorder.Events)
+		assert.Equal(t, "Warning CanaryFailed Canary nodes failed, rollout halted", <-recorder.Events)
+	})
+}
+
+func TestDaemonJobControllerRolloutUnavailableCanaryNode(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	canaryNodes := intstr.FromInt(2)
+	instance.Spec.Rollout = &djv2.Rollout{Canary: &djv2.Canary{Nodes: &canaryNodes}}
+	notReady := getTestNode("node-a", nil)
+	notReady.Status.Conditions[0].Status = corev1.ConditionFalse
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance,
+		notReady, getTestNode("node-b", nil), getTestNode("node-c", nil), getTestNode("node-d", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	require.Equal(t, []string{"node-b"}, getJobNodes(getJobs(t, fakeClient)))
+
+	completeJob(t, fakeClient, getJobs(t, fakeClient)[0])
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should continue with fleet when canary node cannot start", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"node-b", "node-c", "node-d"}, getJobNodes(getJobs(t, fakeClient)))
+		rollout := getDaemonJob(t, fakeClient).Status.Rollout
+		assert.Equal(t, "wave-1", rollout.CurrentWave)
+		assert.Equal(t, djv2.WaveStatus{Name: canaryWaveName, Phase: djv2.WaveSucceeded, Nodes: 2, Succeeded: 1, Unavailable: 1}, rollout.Waves[0])
+		assert.Equal(t, djv2.WaveRunning, rollout.Waves[1].Phase)
+	})
+
+	notReady.Status.Conditions[0].Status = corev1.ConditionTrue
+	require.NoError(t, fakeClient.Update(context.Background(), notReady))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run canary node once it becomes ready", func(t *testing.T) {
+		assert.ElementsMatch(t, []string{"node-a", "node-b", "node-c", "node-d"}, getJobNodes(getJobs(t, fakeClient)))
+	})
+}
+
+func TestDaemonJobControllerRolloutUnavailableCanary(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Rollout = &djv2.Rollout{Canary: &djv2.Canary{}}
+	notReady := getTestNode("node-a", nil)
+	notReady.Status.Conditions[0].Status = corev1.ConditionFalse
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, notReady, getTestNode("node-b", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should hold back fleet until a canary node succeeded", func(t *testing.T) {
+		assert.Empty(t, getJobs(t, fakeClient))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(2), status.PendingNodes)
+		assert.Equal(t, djv2.WavePending, status.Rollout.Waves[0].Phase)
+		assert.False(t, status.Rollout.Halted)
+		assert.NotZero(t, result.RequeueAfter)
+	})
+}
+
+func TestDaemonJobControllerRolloutNoCanaryNodes(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Rollout = &djv2.Rollout{
+		Canary: &djv2.Canary{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"canary": "true"}}},
+	}
+	node := getTestNode("node-a", nil)
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, node, getTestNode("node-b", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should halt rollout when no node is selected as canary", func(t *testing.T) {
+		assert.Empty(t, getJobs(t, fakeClient))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.True(t, status.Rollout.Halted)
+		assert.Equal(t, djv2.WaveStatus{Name: canaryWaveName, Phase: djv2.WavePending}, status.Rollout.Waves[0])
+		require.Len(t, status.Conditions, 1)
+		assert.Equal(t, djv2.DaemonJobFailed, status.Conditions[0].Type)
+		assert.Equal(t, "NoCanaryNodes", status.Conditions[0].Reason)
+		assert.Zero(t, result.RequeueAfter)
+		assert.Equal(t, []string{"Warning NoCanaryNodes No targeted node is selected as canary, rollout halted"}, drainEvents(recorder))
+	})
+
+	node.Labels = map[string]string{"canary": "true"}
+	require.NoError(t, fakeClient.Update(context.Background(), node))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run canary once a node is selected", func(t *testing.T) {
+		assert.Equal(t, []string{"node-a"}, getJobNodes(getJobs(t, fakeClient)))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.False(t, status.Rollout.Halted)
+		assert.Empty(t, status.Conditions)
+	})
+}
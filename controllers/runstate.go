@@ -0,0 +1,143 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// jobNameLabel is set by the Job controller on pods and holds the name of their Job.
+const jobNameLabel = "job-name"
+
+// setRunMetadata records the run on the Job, and the node and template hash on its pods,
+// so that the state of every node can be rebuilt from the cluster after the controller restarts.
+// It is applied after the template hash is computed, so that Jobs created before keep their hash.
+func setRunMetadata(job *batchv1.Job, runID string) {
+	job.Labels[djv2.DaemonJobRunLabel] = runID
+	job.Spec.Template.Annotations = mergeStringMaps(job.Spec.Template.Annotations, map[string]string{
+		djv2.NodeNameAnnotation:     job.Annotations[djv2.NodeNameAnnotation],
+		djv2.TemplateHashAnnotation: job.Annotations[djv2.TemplateHashAnnotation],
+	})
+}
+
+// getPodNodeName returns the node the pod was created for.
+// Pods of Jobs created before the node was recorded on pods fall back to the node they were scheduled on.
+func getPodNodeName(pod *corev1.Pod) string {
+	if nodeName, ok := pod.Annotations[djv2.NodeNameAnnotation]; ok {
+		return nodeName
+	}
+	return pod.Spec.NodeName
+}
+
+// getRunPods returns pods of the DaemonJob, except teardown pods, indexed by the node they were created for.
+func (r *DaemonJobReconciler) getRunPods(ctx context.Context, instance *djv2.DaemonJob) (map[string][]corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := r.Client.List(ctx, &pods, client.InNamespace(instance.Namespace), client.MatchingLabels{djv2.DaemonJobNameLabel: instance.Name}); err != nil {
+		return nil, err
+	}
+	nodePods := map[string][]corev1.Pod{}
+	for _, pod := range pods.Items {
+		nodeName := getPodNodeName(&pod)
+		if nodeName == "" || pod.Labels[djv2.DaemonJobRunLabel] == teardownRunID {
+			continue
+		}
+		nodePods[nodeName] = append(nodePods[nodeName], pod)
+	}
+	return nodePods, nil
+}
+
+// getSucceededPod returns a succeeded pod created from the same template as the Job, if any.
+// Pods outlive their Job when it is deleted without cascading, so such a pod tells that the node
+// already ran the current template, even though its Job is gone.
+func getSucceededPod(pods []corev1.Pod, job *batchv1.Job) *corev1.Pod {
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.Phase == corev1.PodSucceeded &&
+			pod.Annotations[djv2.TemplateHashAnnotation] == job.Annotations[djv2.TemplateHashAnnotation] {
+			return pod
+		}
+	}
+	return nil
+}
+
+// updateStatusWithPod accounts the node in the DaemonJob status from a succeeded pod of its deleted Job.
+func updateStatusWithPod(status *djv2.DaemonJobStatus, nodeName string, pod *corev1.Pod) {
+	if pod.Status.StartTime != nil && (status.StartTime == nil || pod.Status.StartTime.Before(status.StartTime)) {
+		status.StartTime = pod.Status.StartTime
+	}
+	status.SucceededNodes++
+	status.Nodes = append(status.Nodes, djv2.NodeStatus{
+		Name:  nodeName,
+		Phase: djv2.NodeSucceeded,
+		Job:   pod.Labels[jobNameLabel],
+	})
+}
+
+// getLatestJobPod returns the most recently created pod of the Job, if any.
+func getLatestJobPod(pods []corev1.Pod, job *batchv1.Job) *corev1.Pod {
+	var latest *corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Labels[jobNameLabel] == job.Name && (latest == nil || latest.CreationTimestamp.Before(&pod.CreationTimestamp)) {
+			latest = pod
+		}
+	}
+	return latest
+}
+
+// updateNodeStatusWithPod adds the state of the pod to the status of its node,
+// so that pods stuck pending, failing to pull images or restarting show up in the DaemonJob status.
+func updateNodeStatusWithPod(nodeStatus *djv2.NodeStatus, pod *corev1.Pod) {
+	if pod == nil {
+		return
+	}
+	nodeStatus.Pod = pod.Name
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, containerStatus := range statuses {
+			nodeStatus.Restarts += containerStatus.RestartCount
+		}
+	}
+	nodeStatus.Reason, nodeStatus.Message = getPodWaitingReason(pod)
+}
+
+// getPodWaitingReason returns why the unfinished pod does not make progress: it cannot be scheduled,
+// or one of its containers waits for a reason other than being created.
+func getPodWaitingReason(pod *corev1.Pod) (string, string) {
+	if pod.Status.Phase != corev1.PodPending && pod.Status.Phase != corev1.PodRunning {
+		return "", ""
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodScheduled && condition.Status == corev1.ConditionFalse {
+			return condition.Reason, condition.Message
+		}
+	}
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, containerStatus := range statuses {
+			waiting := containerStatus.State.Waiting
+			if waiting != nil && waiting.Reason != "" && waiting.Reason != "ContainerCreating" && waiting.Reason != "PodInitializing" {
+				return waiting.Reason, waiting.Message
+			}
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,297 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// getRunPod returns a pod the Job controller would create for the Job.
+func getRunPod(job *batchv1.Job, phase corev1.PodPhase) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   job.Namespace,
+			Name:        job.Name + "-pod",
+			Labels:      mergeStringMaps(job.Spec.Template.Labels, map[string]string{jobNameLabel: job.Name}),
+			Annotations: job.Spec.Template.Annotations,
+		},
+		Spec:   corev1.PodSpec{NodeName: job.Annotations[djv2.NodeNameAnnotation]},
+		Status: corev1.PodStatus{Phase: phase},
+	}
+}
+
+// restartReconciler drops the status of the DaemonJob, as if its last write was lost,
+// and returns a new reconciler that knows nothing about previous reconciles.
+func restartReconciler(t *testing.T, c client.Client, reconciler DaemonJobReconciler) DaemonJobReconciler {
+	instance := getDaemonJob(t, c)
+	instance.Status = djv2.DaemonJobStatus{}
+	require.NoError(t, c.Status().Update(context.Background(), instance))
+	return DaemonJobReconciler{c, ctrl.Log.WithName("controllers").WithName("DaemonJob"), reconciler.Scheme, record.NewFakeRecorder(10)}
+}
+
+func getJobNodes(jobs []batchv1.Job) []string {
+	nodes := []string{}
+	for _, job := range jobs {
+		nodes = append(nodes, job.Annotations[djv2.NodeNameAnnotation])
+	}
+	return nodes
+}
+
+func TestGetSucceededPod(t *testing.T) {
+	job := getJob(daemonjobCR, &daemonjobCR.Spec.JobTemplate.Spec.Template, "node-a", "test-run")
+	staleJob := job.DeepCopy()
+	staleJob.Spec.Template.Annotations[djv2.TemplateHashAnnotation] = "stale"
+
+	assert.Nil(t, getSucceededPod([]corev1.Pod{*getRunPod(job, corev1.PodFailed)}, job))
+	assert.Nil(t, getSucceededPod([]corev1.Pod{*getRunPod(staleJob, corev1.PodSucceeded)}, job))
+	pod := getSucceededPod([]corev1.Pod{*getRunPod(job, corev1.PodFailed), *getRunPod(job, corev1.PodSucceeded)}, job)
+	require.NotNil(t, pod)
+	assert.Equal(t, corev1.PodSucceeded, pod.Status.Phase)
+}
+
+func TestDaemonJobControllerRestart(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	maxParallel := intstr.FromInt(1)
+	instance.Spec.Rollout = &djv2.Rollout{MaxParallel: &maxParallel}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance,
+		getTestNode("node-a", nil), getTestNode("node-b", nil), getTestNode("node-c", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	jobs := getJobs(t, fakeClient)
+	require.Len(t, jobs, 1)
+	firstJob := jobs[0]
+
+	t.Run("should record run on jobs and node and template on pods", func(t *testing.T) {
+		runID := firstJob.Spec.Template.Labels[djv2.DaemonJobRunLabel]
+		assert.NotEmpty(t, runID)
+		assert.Equal(t, runID, firstJob.Labels[djv2.DaemonJobRunLabel])
+		assert.Equal(t, "node-a", firstJob.Spec.Template.Annotations[djv2.NodeNameAnnotation])
+		assert.Equal(t, firstJob.Annotations[djv2.TemplateHashAnnotation], firstJob.Spec.Template.Annotations[djv2.TemplateHashAnnotation])
+	})
+
+	completeJob(t, fakeClient, firstJob)
+	reconciler = restartReconciler(t, fakeClient, reconciler)
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should continue run from jobs after restart", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		assert.ElementsMatch(t, []string{"node-a", "node-b"}, getJobNodes(jobs))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(1), status.SucceededNodes)
+		assert.Equal(t, int32(1), status.ActiveNodes)
+		assert.Equal(t, int32(1), status.PendingNodes)
+	})
+
+	// The Job of node-a is deleted without cascading, leaving its succeeded pod behind.
+	require.NoError(t, fakeClient.Create(context.Background(), getRunPod(&firstJob, corev1.PodSucceeded)))
+	require.NoError(t, fakeClient.Delete(context.Background(), &firstJob))
+	for _, job := range getJobs(t, fakeClient) {
+		completeJob(t, fakeClient, job)
+	}
+	reconciler = restartReconciler(t, fakeClient, reconciler)
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should not run node again when only its succeeded pod is left", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		assert.ElementsMatch(t, []string{"node-b", "node-c"}, getJobNodes(jobs))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(2), status.SucceededNodes)
+		assert.Equal(t, int32(1), status.ActiveNodes)
+		assert.Equal(t, int32(0), status.PendingNodes)
+		require.Len(t, status.Nodes, 3)
+		assert.Equal(t, djv2.NodeStatus{Name: "node-a", Phase: djv2.NodeSucceeded, Job: firstJob.Name}, status.Nodes[0])
+	})
+}
+
+func TestDaemonJobControllerOnlyPodsLeft(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	// Jobs of every node are gone, e.g. deleted without cascading, and only their labeled pods are left.
+	instance := daemonjobCR.DeepCopy()
+	template := &instance.Spec.JobTemplate.Spec.Template
+	runID := getRunID(instance, template)
+	jobA := getJob(instance, template, "node-a", runID)
+	staleJobB := getJob(instance, template, "node-b", runID)
+	staleJobB.Spec.Template.Annotations[djv2.TemplateHashAnnotation] = "stale"
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance,
+		getTestNode("node-a", nil), getTestNode("node-b", nil),
+		getRunPod(jobA, corev1.PodSucceeded), getRunPod(staleJobB, corev1.PodSucceeded))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should not run node whose pod succeeded", func(t *testing.T) {
+		assert.Equal(t, []string{"node-b"}, getJobNodes(getJobs(t, fakeClient)))
+		status := getDaemonJob(t, fakeClient).Status
+		assert.Equal(t, int32(1), status.SucceededNodes)
+		assert.Equal(t, int32(1), status.ActiveNodes)
+		require.Len(t, status.Nodes, 2)
+		assert.Equal(t, djv2.NodeStatus{Name: "node-a", Phase: djv2.NodeSucceeded, Job: jobA.Name}, status.Nodes[0])
+	})
+
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should keep node whose pod succeeded on next reconcile", func(t *testing.T) {
+		assert.Equal(t, []string{"node-b"}, getJobNodes(getJobs(t, fakeClient)))
+		assert.Equal(t, int32(1), getDaemonJob(t, fakeClient).Status.SucceededNodes)
+	})
+}
+
+func TestDaemonJobControllerRecordRunOnExistingJob(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR, getTestNode("node-a", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	// Jobs created before the run was recorded carry it only on their pods.
+	jobs := getJobs(t, fakeClient)
+	require.Len(t, jobs, 1)
+	job := jobs[0]
+	runID := job.Labels[djv2.DaemonJobRunLabel]
+	delete(job.Labels, djv2.DaemonJobRunLabel)
+	job.Spec.Template.Annotations = nil
+	require.NoError(t, fakeClient.Update(context.Background(), &job))
+
+	reconciler = restartReconciler(t, fakeClient, reconciler)
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should keep job and record its run", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, job.UID, jobs[0].UID)
+		assert.Equal(t, runID, jobs[0].Labels[djv2.DaemonJobRunLabel])
+	})
+}
+
+func TestDaemonJobControllerTeardownAfterRestart(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := getDeletedDaemonJob(time.Minute)
+	instance.Status = djv2.DaemonJobStatus{}
+	// Only a pod is left of the Job that ran on node-b.
+	job := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "node-b", "test-run")
+	require.NoError(t, controllerutil.SetControllerReference(instance, job, scheme))
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getRunPod(job, corev1.PodSucceeded),
+		getTestNode("node-a", nil), getTestNode("node-b", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run teardown on nodes known from pods", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, "true", jobs[0].Labels[djv2.TeardownLabel])
+		assert.Equal(t, "node-b", jobs[0].Annotations[djv2.NodeNameAnnotation])
+	})
+}
+
+func TestDaemonJobControllerPodState(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR.DeepCopy(), getTestNode("node-a", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	jobs := getJobs(t, fakeClient)
+	require.Len(t, jobs, 1)
+
+	pod := getRunPod(&jobs[0], corev1.PodPending)
+	pod.Spec.NodeName = ""
+	pod.Status.Conditions = []corev1.PodCondition{{
+		Type: corev1.PodScheduled, Status: corev1.ConditionFalse,
+		Reason: corev1.PodReasonUnschedulable, Message: "0/1 nodes are available: 1 Insufficient memory.",
+	}}
+	require.NoError(t, fakeClient.Create(context.Background(), pod))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should report unschedulable pod", func(t *testing.T) {
+		nodes := getDaemonJob(t, fakeClient).Status.Nodes
+		require.Len(t, nodes, 1)
+		assert.Equal(t, pod.Name, nodes[0].Pod)
+		assert.Equal(t, corev1.PodReasonUnschedulable, nodes[0].Reason)
+		assert.Equal(t, "0/1 nodes are available: 1 Insufficient memory.", nodes[0].Message)
+	})
+
+	pod.Spec.NodeName = "node-a"
+	pod.Status = corev1.PodStatus{
+		Phase:      corev1.PodPending,
+		Conditions: []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionTrue}},
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:         "test-container",
+			RestartCount: 3,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+				Reason: "ImagePullBackOff", Message: "Back-off pulling image \"busybox:missing\"",
+			}},
+		}},
+	}
+	require.NoError(t, fakeClient.Update(context.Background(), pod))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should report waiting container and restarts", func(t *testing.T) {
+		nodes := getDaemonJob(t, fakeClient).Status.Nodes
+		require.Len(t, nodes, 1)
+		assert.Equal(t, "ImagePullBackOff", nodes[0].Reason)
+		assert.Equal(t, "Back-off pulling image \"busybox:missing\"", nodes[0].Message)
+		assert.Equal(t, int32(3), nodes[0].Restarts)
+	})
+
+	completeJob(t, fakeClient, jobs[0])
+	pod.Status.Phase = corev1.PodSucceeded
+	require.NoError(t, fakeClient.Update(context.Background(), pod))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should clear reason once pod finished", func(t *testing.T) {
+		nodes := getDaemonJob(t, fakeClient).Status.Nodes
+		require.Len(t, nodes, 1)
+		assert.Equal(t, djv2.NodeSucceeded, nodes[0].Phase)
+		assert.Empty(t, nodes[0].Reason)
+		assert.Equal(t, int32(3), nodes[0].Restarts)
+	})
+}
+
+func TestGetLatestJobPod(t *testing.T) {
+	job := getJob(daemonjobCR, &daemonjobCR.Spec.JobTemplate.Spec.Template, "node-a", "test-run")
+	first := getRunPod(job, corev1.PodFailed)
+	first.Name = "first"
+	first.CreationTimestamp = metav1.NewTime(time.Unix(100, 0))
+	second := getRunPod(job, corev1.PodRunning)
+	second.Name = "second"
+	second.CreationTimestamp = metav1.NewTime(time.Unix(200, 0))
+	other := getRunPod(job, corev1.PodRunning)
+	other.Name = "other"
+	other.Labels = map[string]string{jobNameLabel: "other-job"}
+	other.CreationTimestamp = metav1.NewTime(time.Unix(300, 0))
+
+	assert.Equal(t, "second", getLatestJobPod([]corev1.Pod{*second, *other, *first}, job).Name)
+	assert.Nil(t, getLatestJobPod([]corev1.Pod{*other}, job))
+}
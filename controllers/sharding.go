@@ -0,0 +1,319 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+const (
+	// shardMemberLabel marks Leases of manager replicas taking part in sharding.
+	shardMemberLabel = "dj.dysproz.io/shard-member"
+
+	// shardLeasePrefix prefixes the names of membership Leases.
+	shardLeasePrefix = "daemonjob-shard-"
+
+	// shardEventsBufferSize is the number of DaemonJobs queued for a rebalance before it waits for the controller.
+	shardEventsBufferSize = 1024
+)
+
+// ShardOptions configure membership of a manager replica in sharding.
+type ShardOptions struct {
+	// Identity of the replica, unique among replicas, e.g. the pod name.
+	Identity string
+
+	// Namespace of the membership Leases.
+	Namespace string
+
+	// LeaseDuration is how long a replica that stopped renewing its Lease still owns its shard.
+	LeaseDuration time.Duration
+
+	// RenewPeriod is how often the replica renews its Lease and checks membership.
+	RenewPeriod time.Duration
+}
+
+// Shard keeps the Lease of a manager replica and tells which DaemonJobs the replica owns.
+// Every replica holds a Lease, and DaemonJobs are spread over replicas with live Leases by rendezvous hashing,
+// so that only DaemonJobs of a replica that joined or left move when membership changes.
+type Shard struct {
+	client    client.Client
+	apiReader client.Reader
+	options   ShardOptions
+	log       logr.Logger
+
+	mu      sync.RWMutex
+	members []string
+	// renewed is when the Lease of the replica was last renewed. The shard is owned until the Lease expires.
+	renewed time.Time
+
+	// membersChanged signals that DaemonJobs have to be enqueued, as their owners may have changed.
+	membersChanged chan struct{}
+	// events enqueues DaemonJobs when membership changes, so that new owners pick them up.
+	events chan event.GenericEvent
+}
+
+// NewShard returns the shard of the replica. Leases are listed with the uncached apiReader.
+func NewShard(c client.Client, apiReader client.Reader, options ShardOptions, log logr.Logger) *Shard {
+	return &Shard{
+		client:    c,
+		apiReader: apiReader,
+		options:   options,
+		log:       log.WithValues("identity", options.Identity),
+
+		membersChanged: make(chan struct{}, 1),
+		events:         make(chan event.GenericEvent, shardEventsBufferSize),
+	}
+}
+
+// Start keeps the Lease of the replica renewed until stop is closed, then releases it
+// so that other replicas take over its DaemonJobs without waiting for the Lease to expire.
+func (s *Shard) Start(stop <-chan struct{}) error {
+	ctx := context.Background()
+	go s.rebalance(ctx, stop)
+	ticker := time.NewTicker(s.options.RenewPeriod)
+	defer ticker.Stop()
+	for {
+		if err := s.sync(ctx, time.Now()); err != nil {
+			s.log.Error(err, "Failed to sync shard membership")
+		}
+		select {
+		case <-stop:
+			return s.release(ctx)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Owns tells whether the replica reconciles the DaemonJob.
+// Nothing is owned until membership is known, or once the Lease of the replica expired
+// because it could not be renewed, as other replicas take over the shard then.
+func (s *Shard) Owns(instance *djv2.DaemonJob) bool {
+	return s.owns(instance, time.Now())
+}
+
+func (s *Shard) owns(instance *djv2.DaemonJob, now time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !now.Before(s.renewed.Add(s.options.LeaseDuration)) {
+		return false
+	}
+	return getShardOwner(getShardKey(instance), s.members) == s.options.Identity
+}
+
+// sync renews the Lease of the replica and updates members.
+// A rebalance is requested when members change or the Lease is renewed after it expired,
+// as owners of DaemonJobs may have changed.
+func (s *Shard) sync(ctx context.Context, now time.Time) error {
+	if err := s.renew(ctx, now); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	expired := !now.Before(s.renewed.Add(s.options.LeaseDuration))
+	s.renewed = now
+	s.mu.Unlock()
+
+	var leases coordinationv1.LeaseList
+	if err := s.apiReader.List(ctx, &leases, client.InNamespace(s.options.Namespace), client.MatchingLabels{shardMemberLabel: "true"}); err != nil {
+		return err
+	}
+	members := []string{s.options.Identity}
+	for _, lease := range leases.Items {
+		if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == s.options.Identity || !isLeaseLive(&lease, now) {
+			continue
+		}
+		members = append(members, *lease.Spec.HolderIdentity)
+	}
+	sort.Strings(members)
+
+	s.mu.Lock()
+	changed := !reflect.DeepEqual(s.members, members)
+	s.members = members
+	s.mu.Unlock()
+	if changed {
+		s.log.Info("Shard members changed", "members", members)
+	}
+	if changed || expired {
+		s.requestRebalance()
+	}
+	return nil
+}
+
+// requestRebalance asks for DaemonJobs to be enqueued without waiting. Requests made while
+// one is already pending are merged into it.
+func (s *Shard) requestRebalance() {
+	select {
+	case s.membersChanged <- struct{}{}:
+	default:
+	}
+}
+
+// rebalance enqueues all DaemonJobs whenever a rebalance is requested, until stop is closed.
+// It runs apart from renewing the Lease, so that a full queue does not let the Lease expire.
+func (s *Shard) rebalance(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-s.membersChanged:
+		}
+		if err := s.enqueueAll(ctx, stop); err != nil {
+			s.log.Error(err, "Failed to enqueue DaemonJobs after shard members changed")
+			select {
+			case <-stop:
+				return
+			case <-time.After(s.options.RenewPeriod):
+			}
+			s.requestRebalance()
+		}
+	}
+}
+
+// enqueueAll enqueues all DaemonJobs, so that their owners pick them up.
+func (s *Shard) enqueueAll(ctx context.Context, stop <-chan struct{}) error {
+	var djObjects djv2.DaemonJobList
+	if err := s.client.List(ctx, &djObjects); err != nil {
+		return err
+	}
+	for i := range djObjects.Items {
+		djObject := &djObjects.Items[i]
+		select {
+		case s.events <- event.GenericEvent{Meta: djObject, Object: djObject}:
+		case <-stop:
+			return nil
+		}
+	}
+	return nil
+}
+
+// renew creates or renews the Lease of the replica.
+func (s *Shard) renew(ctx context.Context, now time.Time) error {
+	renewTime := metav1.NewMicroTime(now)
+	leaseDurationSeconds := int32(s.options.LeaseDuration / time.Second)
+	lease := &coordinationv1.Lease{}
+	key := types.NamespacedName{Namespace: s.options.Namespace, Name: shardLeasePrefix + s.options.Identity}
+	if err := s.apiReader.Get(ctx, key, lease); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: key.Namespace,
+				Name:      key.Name,
+				Labels:    map[string]string{shardMemberLabel: "true"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.options.Identity,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &renewTime,
+				RenewTime:            &renewTime,
+			},
+		}
+		return s.client.Create(ctx, lease)
+	}
+	lease.Spec.HolderIdentity = &s.options.Identity
+	lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+	lease.Spec.RenewTime = &renewTime
+	return s.client.Update(ctx, lease)
+}
+
+// release deletes the Lease of the replica.
+func (s *Shard) release(ctx context.Context) error {
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: s.options.Namespace, Name: shardLeasePrefix + s.options.Identity}}
+	if err := s.client.Delete(ctx, lease); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	s.log.Info("Released shard")
+	return nil
+}
+
+func isLeaseLive(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	return now.Before(lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// getShardKey returns the key a DaemonJob is assigned to a replica by.
+func getShardKey(instance *djv2.DaemonJob) string {
+	if key, ok := instance.Labels[djv2.ShardLabel]; ok {
+		return key
+	}
+	return instance.Namespace + "/" + instance.Name
+}
+
+// getShardOwner returns the member with the highest hash of the member and the key.
+func getShardOwner(key string, members []string) string {
+	var owner string
+	var ownerScore uint64
+	for _, member := range members {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(member + "/" + key))
+		if score := mixHash(hasher.Sum64()); owner == "" || score > ownerScore {
+			owner, ownerScore = member, score
+		}
+	}
+	return owner
+}
+
+// mixHash spreads bits of an FNV hash, whose high bits barely depend on the last bytes hashed.
+// It is the finalizer of MurmurHash3.
+func mixHash(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// shardedReconciler reconciles only DaemonJobs owned by the shard of the replica.
+type shardedReconciler struct {
+	reconcile.Reconciler
+	client client.Client
+	shard  *Shard
+}
+
+// Reconcile implements reconcile.Reconciler.
+func (r *shardedReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	instance := &djv2.DaemonJob{}
+	if err := r.client.Get(context.TODO(), req.NamespacedName, instance); err != nil {
+		if errors.IsNotFound(err) {
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, err
+	}
+	if !r.shard.Owns(instance) {
+		return reconcile.Result{}, nil
+	}
+	return r.Reconciler.Reconcile(req)
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+var testShardOptions = ShardOptions{
+	Identity:      "manager-a",
+	Namespace:     "daemonjob-system",
+	LeaseDuration: 15 * time.Second,
+	RenewPeriod:   5 * time.Second,
+}
+
+func getTestShardLease(identity string, renewTime time.Time) *coordinationv1.Lease {
+	var leaseDurationSeconds int32 = 15
+	renewMicroTime := metav1.NewMicroTime(renewTime)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: testShardOptions.Namespace,
+			Name:      shardLeasePrefix + identity,
+			Labels:    map[string]string{shardMemberLabel: "true"},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: &leaseDurationSeconds,
+			RenewTime:            &renewMicroTime,
+		},
+	}
+}
+
+func getShardTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := getTestScheme(t)
+	require.NoError(t, coordinationv1.AddToScheme(scheme))
+	return scheme
+}
+
+func TestGetShardOwner(t *testing.T) {
+	members := []string{"manager-a", "manager-b", "manager-c"}
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("default/daemonjob-%d", i)
+		owners[key] = getShardOwner(key, members)
+		counts[owners[key]]++
+	}
+
+	t.Run("should spread DaemonJobs over members", func(t *testing.T) {
+		for _, member := range members {
+			assert.Greater(t, counts[member], 50, member)
+		}
+	})
+
+	t.Run("should move only DaemonJobs of member that left", func(t *testing.T) {
+		for key, owner := range owners {
+			newOwner := getShardOwner(key, []string{"manager-a", "manager-c"})
+			if owner != "manager-b" {
+				assert.Equal(t, owner, newOwner, key)
+			}
+		}
+	})
+
+	assert.Empty(t, getShardOwner("default/daemonjob", nil))
+}
+
+func TestGetShardKey(t *testing.T) {
+	instance := daemonjobCR.DeepCopy()
+	assert.Equal(t, "default/test-daemonjob", getShardKey(instance))
+	instance.Labels = map[string]string{djv2.ShardLabel: "team-a"}
+	assert.Equal(t, "team-a", getShardKey(instance))
+}
+
+func TestShardSync(t *testing.T) {
+	scheme := getShardTestScheme(t)
+
+	now := time.Now()
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR,
+		getTestShardLease("manager-b", now.Add(-5*time.Second)),
+		getTestShardLease("manager-c", now.Add(-time.Minute)))
+	shard := NewShard(fakeClient, fakeClient, testShardOptions, ctrl.Log.WithName("shard"))
+	require.NoError(t, shard.sync(context.Background(), now))
+
+	t.Run("should hold lease", func(t *testing.T) {
+		lease := &coordinationv1.Lease{}
+		require.NoError(t, fakeClient.Get(context.Background(), client.ObjectKey{Namespace: testShardOptions.Namespace, Name: "daemonjob-shard-manager-a"}, lease))
+		assert.Equal(t, "manager-a", *lease.Spec.HolderIdentity)
+		assert.Equal(t, int32(15), *lease.Spec.LeaseDurationSeconds)
+	})
+
+	t.Run("should count only members with live leases", func(t *testing.T) {
+		assert.Equal(t, []string{"manager-a", "manager-b"}, shard.members)
+	})
+
+	t.Run("should enqueue DaemonJobs when members changed", func(t *testing.T) {
+		require.Len(t, shard.membersChanged, 1)
+		<-shard.membersChanged
+		require.NoError(t, shard.enqueueAll(context.Background(), make(chan struct{})))
+		require.Len(t, shard.events, 1)
+		assert.Equal(t, daemonjobName.Name, (<-shard.events).Meta.GetName())
+		require.NoError(t, shard.sync(context.Background(), now.Add(time.Second)))
+		assert.Empty(t, shard.membersChanged)
+	})
+
+	t.Run("should rebalance when member died", func(t *testing.T) {
+		require.NoError(t, shard.sync(context.Background(), now.Add(20*time.Second)))
+		assert.Equal(t, []string{"manager-a"}, shard.members)
+		assert.Len(t, shard.membersChanged, 1)
+		assert.True(t, shard.owns(daemonjobCR, now.Add(20*time.Second)))
+	})
+
+	t.Run("should give up shard when lease was not renewed", func(t *testing.T) {
+		assert.True(t, shard.owns(daemonjobCR, now.Add(34*time.Second)))
+		assert.False(t, shard.owns(daemonjobCR, now.Add(35*time.Second)))
+	})
+
+	t.Run("should not wait for events to be consumed", func(t *testing.T) {
+		shard.events = make(chan event.GenericEvent)
+		require.NoError(t, shard.sync(context.Background(), now.Add(time.Minute)))
+		require.NoError(t, shard.sync(context.Background(), now.Add(2*time.Minute)))
+		assert.Len(t, shard.membersChanged, 1)
+		assert.True(t, shard.owns(daemonjobCR, now.Add(2*time.Minute)))
+	})
+
+	t.Run("should release lease", func(t *testing.T) {
+		require.NoError(t, shard.release(context.Background()))
+		var leases coordinationv1.LeaseList
+		require.NoError(t, fakeClient.List(context.Background(), &leases))
+		assert.Len(t, leases.Items, 2)
+	})
+}
+
+func TestShardedReconciler(t *testing.T) {
+	scheme := getShardTestScheme(t)
+
+	owned, other := daemonjobCR.DeepCopy(), daemonjobCR.DeepCopy()
+	other.Name = "other-daemonjob"
+	shard := NewShard(nil, nil, testShardOptions, ctrl.Log.WithName("shard"))
+	shard.members = []string{"manager-a", "manager-b"}
+	shard.renewed = time.Now()
+	// Shard keys decide the owner, so pin both DaemonJobs to keys owned by different members.
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("team-%d", i)
+		switch getShardOwner(key, shard.members) {
+		case "manager-a":
+			owned.Labels = map[string]string{djv2.ShardLabel: key}
+		case "manager-b":
+			other.Labels = map[string]string{djv2.ShardLabel: key}
+		}
+	}
+	require.NotNil(t, owned.Labels)
+	require.NotNil(t, other.Labels)
+	fakeClient := fake.NewFakeClientWithScheme(scheme, owned, other, getTestNode("node-a", nil))
+	reconciler := &shardedReconciler{
+		Reconciler: &DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)},
+		client:     fakeClient,
+		shard:      shard,
+	}
+
+	for _, instance := range []*djv2.DaemonJob{owned, other} {
+		_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: client.ObjectKey{Namespace: instance.Namespace, Name: instance.Name}})
+		require.NoError(t, err)
+	}
+
+	t.Run("should reconcile only owned DaemonJobs", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, owned.Name, jobs[0].Labels[djv2.DaemonJobNameLabel])
+	})
+}
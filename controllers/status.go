@@ -0,0 +1,79 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// optimisticLockPatch is a merge patch that carries the resourceVersion of the object it was computed against,
+// so that the API server rejects it with a conflict if the object has changed since.
+type optimisticLockPatch struct {
+	client.Patch
+	resourceVersion string
+}
+
+// mergeFromWithOptimisticLock returns a merge patch against the object that fails if the object has changed since.
+func mergeFromWithOptimisticLock(obj runtime.Object) (client.Patch, error) {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &optimisticLockPatch{Patch: client.MergeFrom(obj), resourceVersion: accessor.GetResourceVersion()}, nil
+}
+
+// Data implements client.Patch.
+func (p *optimisticLockPatch) Data(obj runtime.Object) ([]byte, error) {
+	data, err := p.Patch.Data(obj)
+	if err != nil {
+		return nil, err
+	}
+	patch := map[string]interface{}{}
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, err
+	}
+	metadata, ok := patch["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = map[string]interface{}{}
+		patch["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = p.resourceVersion
+	return json.Marshal(patch)
+}
+
+// patchStatus writes the status computed in the reconcile loop with a merge patch against the DaemonJob the loop read.
+// The patch fails with a conflict if the DaemonJob has changed since, as the status may have been computed
+// from an outdated spec or may overwrite a newer status, and the DaemonJob is reconciled again.
+func (r *DaemonJobReconciler) patchStatus(ctx context.Context, instance *djv2.DaemonJob, status *djv2.DaemonJobStatus) error {
+	if equality.Semantic.DeepEqual(instance.Status, *status) {
+		return nil
+	}
+	patch, err := mergeFromWithOptimisticLock(instance.DeepCopy())
+	if err != nil {
+		return err
+	}
+	instance.Status = *status
+	return r.Client.Status().Patch(ctx, instance, patch)
+}
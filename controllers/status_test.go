@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// concurrentClient runs beforeStatusWrite before every status write,
+// as if the DaemonJob was changed by someone else meanwhile.
+type concurrentClient struct {
+	client.Client
+	beforeStatusWrite func() error
+}
+
+func (c *concurrentClient) Status() client.StatusWriter {
+	return &concurrentStatusWriter{c.Client.Status(), c.beforeStatusWrite}
+}
+
+type concurrentStatusWriter struct {
+	client.StatusWriter
+	beforeStatusWrite func() error
+}
+
+func (w *concurrentStatusWriter) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if err := w.beforeStatusWrite(); err != nil {
+		return err
+	}
+	return w.StatusWriter.Update(ctx, obj, opts...)
+}
+
+func (w *concurrentStatusWriter) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if err := w.beforeStatusWrite(); err != nil {
+		return err
+	}
+	return w.StatusWriter.Patch(ctx, obj, patch, opts...)
+}
+
+func TestDaemonJobControllerConcurrentUpdate(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR, getTestNode("node-a", nil))
+	writes := 0
+	concurrent := &concurrentClient{Client: fakeClient, beforeStatusWrite: func() error {
+		if writes++; writes > 1 {
+			return nil
+		}
+		instance := getDaemonJob(t, fakeClient)
+		instance.Labels = map[string]string{"team": "platform"}
+		return fakeClient.Update(context.Background(), instance)
+	}}
+	reconciler := DaemonJobReconciler{concurrent, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+
+	t.Run("should not write status computed from outdated DaemonJob", func(t *testing.T) {
+		require.NoError(t, err)
+		assert.True(t, result.Requeue)
+		instance := getDaemonJob(t, fakeClient)
+		assert.Zero(t, instance.Status.ActiveNodes)
+		assert.Equal(t, map[string]string{"team": "platform"}, instance.Labels)
+	})
+
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+
+	t.Run("should write status when reconciled again", func(t *testing.T) {
+		require.NoError(t, err)
+		instance := getDaemonJob(t, fakeClient)
+		assert.Equal(t, int32(1), instance.Status.ActiveNodes)
+		assert.Equal(t, map[string]string{"team": "platform"}, instance.Labels)
+		assert.Equal(t, 2, writes)
+	})
+}
+
+func TestDaemonJobControllerStatusConflict(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR, getTestNode("node-a", nil))
+	conflicts := 1
+	concurrent := &concurrentClient{Client: fakeClient, beforeStatusWrite: func() error {
+		if conflicts > 0 {
+			conflicts--
+			return apierrors.NewConflict(djv2.GroupVersion.WithResource("daemonjobs").GroupResource(), daemonjobName.Name, nil)
+		}
+		return nil
+	}}
+	reconciler := DaemonJobReconciler{concurrent, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+
+	t.Run("should requeue on conflict", func(t *testing.T) {
+		require.NoError(t, err)
+		assert.True(t, result.Requeue)
+		assert.Zero(t, getDaemonJob(t, fakeClient).Status.ActiveNodes)
+	})
+
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+
+	t.Run("should write status when reconciled again", func(t *testing.T) {
+		require.NoError(t, err)
+		assert.Equal(t, int32(1), getDaemonJob(t, fakeClient).Status.ActiveNodes)
+	})
+}
+
+func TestMergeFromWithOptimisticLock(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, daemonjobCR)
+	instance := getDaemonJob(t, fakeClient)
+	patch, err := mergeFromWithOptimisticLock(instance.DeepCopy())
+	require.NoError(t, err)
+	instance.Status.ActiveNodes = 1
+
+	t.Run("should carry resource version", func(t *testing.T) {
+		data, err := patch.Data(instance)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"metadata":{"resourceVersion":"`+instance.ResourceVersion+`"},"status":{"activeNodes":1}}`, string(data))
+	})
+
+	t.Run("should fail if DaemonJob changed", func(t *testing.T) {
+		changed := getDaemonJob(t, fakeClient)
+		changed.Labels = map[string]string{"team": "platform"}
+		require.NoError(t, fakeClient.Update(context.Background(), changed))
+		err := fakeClient.Status().Patch(context.Background(), instance, patch)
+		assert.True(t, apierrors.IsConflict(err))
+	})
+}
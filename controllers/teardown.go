@@ -0,0 +1,186 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+const (
+	// defaultTeardownTimeout is how long deletion waits for teardown when spec.teardown.timeoutSeconds is unset.
+	defaultTeardownTimeout = 600 * time.Second
+
+	// teardownRunID is the run ID of teardown pods.
+	teardownRunID = "teardown"
+)
+
+// updateTeardownFinalizer makes sure the DaemonJob carries the teardown finalizer only when it has a teardown template.
+func (r *DaemonJobReconciler) updateTeardownFinalizer(ctx context.Context, instance *djv2.DaemonJob) error {
+	hasTeardown := instance.Spec.Teardown != nil
+	if hasTeardown == hasFinalizer(instance, djv2.TeardownFinalizer) {
+		return nil
+	}
+	patch, err := mergeFromWithOptimisticLock(instance.DeepCopy())
+	if err != nil {
+		return err
+	}
+	if hasTeardown {
+		controllerutil.AddFinalizer(instance, djv2.TeardownFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(instance, djv2.TeardownFinalizer)
+	}
+	return r.Client.Patch(ctx, instance, patch)
+}
+
+// reconcileTeardown runs the teardown template on every node the DaemonJob ran on
+// and releases the DaemonJob once teardown has finished, timed out or was skipped.
+func (r *DaemonJobReconciler) reconcileTeardown(ctx context.Context, instance *djv2.DaemonJob) (reconcile.Result, error) {
+	if !hasFinalizer(instance, djv2.TeardownFinalizer) {
+		return reconcile.Result{}, nil
+	}
+	log := r.getLogger(ctx).WithValues("runID", teardownRunID)
+	if _, ok := instance.Annotations[djv2.ForceRemoveAnnotation]; ok || instance.Spec.Teardown == nil {
+		r.Recorder.Event(instance, corev1.EventTypeWarning, "TeardownSkipped", "Teardown skipped, DaemonJob removed")
+		return reconcile.Result{}, r.removeTeardownFinalizer(ctx, instance)
+	}
+
+	timeout := defaultTeardownTimeout
+	if instance.Spec.Teardown.TimeoutSeconds != nil {
+		timeout = time.Duration(*instance.Spec.Teardown.TimeoutSeconds) * time.Second
+	}
+	remaining := time.Until(instance.GetDeletionTimestamp().Add(timeout))
+	if remaining <= 0 {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, "TeardownTimedOut", "Teardown did not finish within %s, DaemonJob removed", timeout)
+		return reconcile.Result{}, r.removeTeardownFinalizer(ctx, instance)
+	}
+
+	var jobs batchv1.JobList
+	if err := r.Client.List(ctx, &jobs, client.InNamespace(instance.Namespace), client.MatchingLabels{djv2.DaemonJobNameLabel: instance.Name}); err != nil {
+		return reconcile.Result{}, err
+	}
+	nodeNames := map[string]bool{}
+	teardownJobs := map[string]*batchv1.Job{}
+	for i := range jobs.Items {
+		job := &jobs.Items[i]
+		nodeName := job.Annotations[djv2.NodeNameAnnotation]
+		if job.Labels[djv2.TeardownLabel] == "true" {
+			teardownJobs[nodeName] = job
+			continue
+		}
+		nodeNames[nodeName] = true
+		// The job should not keep running while its node is being torn down.
+		if finished, _ := getFinishedStatus(job); !finished {
+			if err := r.deleteJob(withLogger(ctx, log.WithValues("node", nodeName)), job); err != nil {
+				return reconcile.Result{}, err
+			}
+		}
+	}
+	// Jobs may already be gone, e.g. deleted by hand, possibly leaving their pods behind.
+	for _, node := range instance.Status.Nodes {
+		nodeNames[node.Name] = true
+	}
+	runPods, err := r.getRunPods(ctx, instance)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	for nodeName := range runPods {
+		nodeNames[nodeName] = true
+	}
+
+	unfinished, created := 0, 0
+	for nodeName := range nodeNames {
+		if job, ok := teardownJobs[nodeName]; ok {
+			if finished, _ := getFinishedStatus(job); !finished {
+				unfinished++
+			}
+			continue
+		}
+		if err := r.Client.Get(ctx, types.NamespacedName{Name: nodeName}, &corev1.Node{}); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return reconcile.Result{}, err
+		}
+		job := getTeardownJob(instance, nodeName)
+		if err := controllerutil.SetControllerReference(instance, job, r.Scheme); err != nil {
+			return reconcile.Result{}, err
+		}
+		// The Job may exist already when the cache has not caught up with an earlier pass.
+		if err := r.Client.Create(ctx, job); err == nil {
+			log.Info("Created teardown Job", "node", nodeName, "job", job.Name)
+			created++
+		} else if !errors.IsAlreadyExists(err) {
+			return reconcile.Result{}, err
+		}
+		unfinished++
+	}
+	if created > 0 {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, "TeardownStarted", "Started teardown on %d nodes", created)
+	}
+	if unfinished > 0 {
+		if remaining > requeueInterval {
+			remaining = requeueInterval
+		}
+		return reconcile.Result{RequeueAfter: remaining}, nil
+	}
+
+	r.Recorder.Event(instance, corev1.EventTypeNormal, "TeardownFinished", "Teardown finished, DaemonJob removed")
+	return reconcile.Result{}, r.removeTeardownFinalizer(ctx, instance)
+}
+
+func (r *DaemonJobReconciler) removeTeardownFinalizer(ctx context.Context, instance *djv2.DaemonJob) error {
+	r.getLogger(ctx).Info("Releasing DaemonJob")
+	patch, err := mergeFromWithOptimisticLock(instance.DeepCopy())
+	if err != nil {
+		return err
+	}
+	controllerutil.RemoveFinalizer(instance, djv2.TeardownFinalizer)
+	if err := r.Client.Patch(ctx, instance, patch); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// getTeardownJob returns the Job running the teardown template on the node.
+func getTeardownJob(instance *djv2.DaemonJob, nodeName string) *batchv1.Job {
+	// Teardown runs on every node the job ran on, even when the node is no longer targeted.
+	// Limits of jobTemplate.spec apply to the job, not to its teardown.
+	job := newNodeJob(instance, &instance.Spec.Teardown.Template, nil, getHashedName(instance, "teardown/"+nodeName), nodeName,
+		teardownRunID, nil)
+	job.Labels[djv2.TeardownLabel] = "true"
+	return job
+}
+
+func hasFinalizer(instance *djv2.DaemonJob, finalizer string) bool {
+	for _, f := range instance.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+var teardownTemplate = &corev1.PodTemplateSpec{
+	Spec: corev1.PodSpec{
+		Containers: []corev1.Container{
+			{
+				Image: "teardown-image",
+				Name:  "teardown-container",
+			},
+		},
+	},
+}
+
+func getDeletedDaemonJob(deletedAgo time.Duration) *djv2.DaemonJob {
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Teardown = &djv2.Teardown{Template: *teardownTemplate}
+	instance.Finalizers = []string{djv2.TeardownFinalizer}
+	deletionTimestamp := metav1.NewTime(time.Now().Add(-deletedAgo))
+	instance.DeletionTimestamp = &deletionTimestamp
+	instance.Status = djv2.DaemonJobStatus{
+		Nodes: []djv2.NodeStatus{{Name: "node-a", Phase: djv2.NodeSucceeded, Job: getJobName(daemonjobCR, "node-a", 0)}},
+	}
+	return instance
+}
+
+func TestDaemonJobControllerTeardownFinalizer(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.Teardown = &djv2.Teardown{Template: *teardownTemplate}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should add finalizer when teardown template is set", func(t *testing.T) {
+		assert.Equal(t, []string{djv2.TeardownFinalizer}, getDaemonJob(t, fakeClient).Finalizers)
+	})
+}
+
+func TestDaemonJobControllerTeardown(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := getDeletedDaemonJob(time.Minute)
+	runningJob := getJob(instance, &instance.Spec.JobTemplate.Spec.Template, "node-b", "test-run")
+	require.NoError(t, controllerutil.SetControllerReference(instance, runningJob, scheme))
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, runningJob,
+		getTestNode("node-a", nil), getTestNode("node-b", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+
+	result, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should run teardown on every node the job ran on", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 2)
+		nodes := []string{}
+		for _, job := range jobs {
+			assert.Equal(t, "true", job.Labels[djv2.TeardownLabel])
+			assert.Equal(t, "teardown-image", job.Spec.Template.Spec.Containers[0].Image)
+			nodes = append(nodes, job.Annotations[djv2.NodeNameAnnotation])
+		}
+		assert.ElementsMatch(t, []string{"node-a", "node-b"}, nodes)
+		assert.Equal(t, []string{djv2.TeardownFinalizer}, getDaemonJob(t, fakeClient).Finalizers)
+		assert.Equal(t, requeueInterval, result.RequeueAfter)
+		assert.Equal(t, "Normal TeardownStarted Started teardown on 2 nodes", <-recorder.Events)
+	})
+
+	for _, job := range getJobs(t, fakeClient) {
+		completeJob(t, fakeClient, job)
+	}
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should release finalizer when teardown finished", func(t *testing.T) {
+		assert.Empty(t, getDaemonJob(t, fakeClient).Finalizers)
+		assert.Equal(t, "Normal TeardownFinished Teardown finished, DaemonJob removed", <-recorder.Events)
+	})
+}
+
+// laggingTeardownClient lists Jobs as if the cache has not seen teardown Jobs yet.
+type laggingTeardownClient struct {
+	client.Client
+}
+
+func (c *laggingTeardownClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	if jobs, ok := list.(*batchv1.JobList); ok {
+		var items []batchv1.Job
+		for _, job := range jobs.Items {
+			if job.Labels[djv2.TeardownLabel] != "true" {
+				items = append(items, job)
+			}
+		}
+		jobs.Items = items
+	}
+	return nil
+}
+
+func TestDaemonJobControllerTeardownCacheLag(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, getDeletedDaemonJob(time.Minute), getTestNode("node-a", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{&laggingTeardownClient{fakeClient}, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+	for i := 0; i < 2; i++ {
+		_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+		require.NoError(t, err)
+	}
+
+	t.Run("should report teardown start once", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 1)
+		assert.Equal(t, []string{"Normal TeardownStarted Started teardown on 1 nodes"}, drainEvents(recorder))
+	})
+}
+
+func TestDaemonJobControllerTeardownTimeout(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, getDeletedDaemonJob(time.Hour), getTestNode("node-a", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should release finalizer when teardown timed out", func(t *testing.T) {
+		assert.Empty(t, getJobs(t, fakeClient))
+		assert.Empty(t, getDaemonJob(t, fakeClient).Finalizers)
+		assert.Equal(t, "Warning TeardownTimedOut Teardown did not finish within 10m0s, DaemonJob removed", <-recorder.Events)
+	})
+}
+
+func TestDaemonJobControllerTeardownForceRemove(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := getDeletedDaemonJob(time.Minute)
+	instance.Annotations = map[string]string{djv2.ForceRemoveAnnotation: "true"}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance, getTestNode("node-a", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should release finalizer without teardown when forced", func(t *testing.T) {
+		assert.Empty(t, getJobs(t, fakeClient))
+		assert.Empty(t, getDaemonJob(t, fakeClient).Finalizers)
+	})
+}
+
+func TestGetTeardownJob(t *testing.T) {
+	instance := getDeletedDaemonJob(time.Minute)
+	var deadline int64 = 60
+	var backoffLimit int32 = 1
+	instance.Spec.JobTemplate.Spec.ActiveDeadlineSeconds = &deadline
+	instance.Spec.JobTemplate.Spec.BackoffLimit = &backoffLimit
+	job := getTeardownJob(instance, "node-a")
+	assert.Nil(t, job.Spec.ActiveDeadlineSeconds)
+	assert.Nil(t, job.Spec.BackoffLimit)
+	assert.Equal(t, "teardown-image", job.Spec.Template.Spec.Containers[0].Image)
+}
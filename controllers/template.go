@@ -0,0 +1,219 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+// parameterPattern matches a template parameter placeholder, e.g. {{ .Parameters.image }}.
+var parameterPattern = regexp.MustCompile(`{{\s*\.Parameters\.([A-Za-z_][A-Za-z0-9_]*)\s*}}`)
+
+// nodePlaceholderPattern matches a per-node placeholder: {{ .Node.Name }}, {{ .Node.Labels["<key>"] }} or {{ .RunID }}.
+var nodePlaceholderPattern = regexp.MustCompile(`{{\s*\.(?:(Node\.Name)|Node\.Labels\["([^"]*)"\]|(RunID))\s*}}`)
+
+// getPodTemplate returns the pod template run on every node, rendered from the referenced
+// DaemonJobTemplate when spec.templateRef is set.
+func (r *DaemonJobReconciler) getPodTemplate(ctx context.Context, instance *djv2.DaemonJob) (*corev1.PodTemplateSpec, error) {
+	if instance.Spec.TemplateRef == nil {
+		return instance.Spec.JobTemplate.Spec.Template.DeepCopy(), nil
+	}
+	djTemplate := &djv2.DaemonJobTemplate{}
+	key := types.NamespacedName{Name: instance.Spec.TemplateRef.Name, Namespace: instance.Namespace}
+	if err := r.Client.Get(ctx, key, djTemplate); err != nil {
+		return nil, fmt.Errorf("failed to get DaemonJobTemplate %s: %w", key.Name, err)
+	}
+	template, err := renderPodTemplate(djTemplate, instance.Spec.TemplateRef.Parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render DaemonJobTemplate %s: %w", key.Name, err)
+	}
+	// Labels and annotations set in spec.jobTemplate.spec.template apply on top of the template.
+	metadata := &instance.Spec.JobTemplate.Spec.Template.ObjectMeta
+	template.Labels = mergeStringMaps(template.Labels, metadata.Labels)
+	template.Annotations = mergeStringMaps(template.Annotations, metadata.Annotations)
+	return template, nil
+}
+
+// renderPodTemplate substitutes parameter placeholders in every string of the DaemonJobTemplate pod template.
+// Every parameter without a default has to be set, and only declared parameters may be set or referenced.
+func renderPodTemplate(djTemplate *djv2.DaemonJobTemplate, parameters map[string]string) (*corev1.PodTemplateSpec, error) {
+	values := map[string]string{}
+	var missing []string
+	for _, parameter := range djTemplate.Spec.Parameters {
+		if value, ok := parameters[parameter.Name]; ok {
+			values[parameter.Name] = value
+		} else if parameter.Default != nil {
+			values[parameter.Name] = *parameter.Default
+		} else {
+			missing = append(missing, parameter.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing values of parameters: %s", strings.Join(missing, ", "))
+	}
+	var unknown []string
+	for name := range parameters {
+		if _, ok := values[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown parameters: %s", strings.Join(unknown, ", "))
+	}
+
+	data, err := json.Marshal(djTemplate.Spec.Template)
+	if err != nil {
+		return nil, err
+	}
+	var renderErr error
+	rendered := parameterPattern.ReplaceAllFunc(data, func(placeholder []byte) []byte {
+		name := string(parameterPattern.FindSubmatch(placeholder)[1])
+		value, ok := values[name]
+		if !ok {
+			renderErr = fmt.Errorf("parameter %s is not declared", name)
+			return placeholder
+		}
+		// Values are substituted inside JSON strings, so they have to be escaped.
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+	if renderErr != nil {
+		return nil, renderErr
+	}
+	template := &corev1.PodTemplateSpec{}
+	if err := json.Unmarshal(rendered, template); err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// getRunID returns the identifier of the current run of the DaemonJob.
+// It changes whenever the pod template or the Job fields change, which is when every node runs again.
+func getRunID(instance *djv2.DaemonJob, template *corev1.PodTemplateSpec) string {
+	spec := instance.Spec.JobTemplate.Spec.DeepCopy()
+	spec.Template = *template
+	data, _ := json.Marshal(spec)
+	hasher := fnv.New32a()
+	_, _ = hasher.Write([]byte(instance.UID))
+	_, _ = hasher.Write(data)
+	return rand.SafeEncodeString(fmt.Sprint(hasher.Sum32()))
+}
+
+// renderNodeTemplate returns a copy of the pod template with per-node placeholders substituted
+// in env values, commands, args and volume paths. Labels missing on the node render as empty strings.
+func renderNodeTemplate(template *corev1.PodTemplateSpec, node *corev1.Node, runID string) *corev1.PodTemplateSpec {
+	render := func(value string) string {
+		return nodePlaceholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+			match := nodePlaceholderPattern.FindStringSubmatch(placeholder)
+			switch {
+			case match[1] != "":
+				return node.Name
+			case match[3] != "":
+				return runID
+			default:
+				return node.Labels[match[2]]
+			}
+		})
+	}
+	renderAll := func(values []string) {
+		for i := range values {
+			values[i] = render(values[i])
+		}
+	}
+
+	rendered := template.DeepCopy()
+	spec := &rendered.Spec
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			container := &containers[i]
+			renderAll(container.Command)
+			renderAll(container.Args)
+			for j := range container.Env {
+				container.Env[j].Value = render(container.Env[j].Value)
+			}
+			for j := range container.VolumeMounts {
+				container.VolumeMounts[j].MountPath = render(container.VolumeMounts[j].MountPath)
+				container.VolumeMounts[j].SubPath = render(container.VolumeMounts[j].SubPath)
+			}
+		}
+	}
+	for i := range spec.Volumes {
+		if hostPath := spec.Volumes[i].HostPath; hostPath != nil {
+			hostPath.Path = render(hostPath.Path)
+		}
+	}
+	return rendered
+}
+
+// mergeStringMaps returns a copy of base overridden with values of overrides.
+func mergeStringMaps(base, overrides map[string]string) map[string]string {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(base)+len(overrides))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mapTemplateToDaemonJobs returns a handler enqueueing DaemonJobs that reference a changed DaemonJobTemplate.
+func mapTemplateToDaemonJobs(c client.Client, log logr.Logger) handler.EventHandler {
+	return &handler.EnqueueRequestsFromMapFunc{
+		ToRequests: handler.ToRequestsFunc(func(templateObject handler.MapObject) []reconcile.Request {
+			var djObjects djv2.DaemonJobList
+			if err := c.List(context.TODO(), &djObjects, client.InNamespace(templateObject.Meta.GetNamespace())); err != nil {
+				log.Error(err, "Failed to list DaemonJobs for template event", "template",
+					types.NamespacedName{Namespace: templateObject.Meta.GetNamespace(), Name: templateObject.Meta.GetName()})
+				return nil
+			}
+			var requests = []reconcile.Request{}
+			for _, djObject := range djObjects.Items {
+				if djObject.Spec.TemplateRef == nil || djObject.Spec.TemplateRef.Name != templateObject.Meta.GetName() {
+					continue
+				}
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      djObject.Name,
+						Namespace: djObject.Namespace,
+					},
+				})
+			}
+			return requests
+		}),
+	}
+}
@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
+)
+
+func getTestDaemonJobTemplate() *djv2.DaemonJobTemplate {
+	defaultTag := "latest"
+	return &djv2.DaemonJobTemplate{
+		ObjectMeta: metav1.ObjectMeta{Namespace: daemonjobName.Namespace, Name: "test-template"},
+		Spec: djv2.DaemonJobTemplateSpec{
+			Parameters: []djv2.DaemonJobTemplateParameter{{Name: "image"}, {Name: "tag", Default: &defaultTag}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "test"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "test-container",
+						Image: "{{ .Parameters.image }}:{{.Parameters.tag}}",
+						Args:  []string{"--image={{ .Parameters.image }}"},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func getTemplateRefDaemonJob(parameters map[string]string) *djv2.DaemonJob {
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.JobTemplate.Spec.Template = corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"tier": "batch"}},
+	}
+	instance.Spec.TemplateRef = &djv2.TemplateReference{Name: "test-template", Parameters: parameters}
+	return instance
+}
+
+func TestRenderPodTemplate(t *testing.T) {
+	t.Run("should substitute parameters and defaults", func(t *testing.T) {
+		template, err := renderPodTemplate(getTestDaemonJobTemplate(), map[string]string{"image": "busybox"})
+		require.NoError(t, err)
+		assert.Equal(t, "busybox:latest", template.Spec.Containers[0].Image)
+		assert.Equal(t, []string{"--image=busybox"}, template.Spec.Containers[0].Args)
+		assert.Equal(t, map[string]string{"app": "test"}, template.Labels)
+	})
+
+	t.Run("should keep special characters of values", func(t *testing.T) {
+		template, err := renderPodTemplate(getTestDaemonJobTemplate(), map[string]string{"image": `"quoted"\path`})
+		require.NoError(t, err)
+		assert.Equal(t, []string{`--image="quoted"\path`}, template.Spec.Containers[0].Args)
+	})
+
+	t.Run("should fail when a required parameter is missing", func(t *testing.T) {
+		_, err := renderPodTemplate(getTestDaemonJobTemplate(), nil)
+		assert.EqualError(t, err, "missing values of parameters: image")
+	})
+
+	t.Run("should fail when an unknown parameter is set", func(t *testing.T) {
+		_, err := renderPodTemplate(getTestDaemonJobTemplate(), map[string]string{"image": "busybox", "size": "1"})
+		assert.EqualError(t, err, "unknown parameters: size")
+	})
+
+	t.Run("should fail when an undeclared parameter is referenced", func(t *testing.T) {
+		djTemplate := getTestDaemonJobTemplate()
+		djTemplate.Spec.Template.Spec.Containers[0].Command = []string{"{{ .Parameters.command }}"}
+		_, err := renderPodTemplate(djTemplate, map[string]string{"image": "busybox"})
+		assert.EqualError(t, err, "parameter command is not declared")
+	})
+}
+
+func TestDaemonJobControllerTemplateRef(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	djTemplate := getTestDaemonJobTemplate()
+	fakeClient := fake.NewFakeClientWithScheme(scheme, getTemplateRefDaemonJob(map[string]string{"image": "busybox"}),
+		djTemplate, getTestNode("node-a", nil))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should create job from rendered template", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, "busybox:latest", jobs[0].Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, map[string]string{"app": "test", "tier": "batch", djv2.DaemonJobNameLabel: daemonjobName.Name, djv2.DaemonJobRunLabel: jobs[0].Spec.Template.Labels[djv2.DaemonJobRunLabel]}, jobs[0].Spec.Template.Labels)
+	})
+
+	require.NoError(t, fakeClient.Get(context.Background(), types.NamespacedName{Namespace: djTemplate.Namespace, Name: djTemplate.Name}, djTemplate))
+	djTemplate.Spec.Template.Spec.Containers[0].Image = "registry.local/{{ .Parameters.image }}"
+	require.NoError(t, fakeClient.Update(context.Background(), djTemplate))
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should rerun job when template changed", func(t *testing.T) {
+		jobs := getJobs(t, fakeClient)
+		require.Len(t, jobs, 1)
+		assert.Equal(t, "registry.local/busybox", jobs[0].Spec.Template.Spec.Containers[0].Image)
+	})
+}
+
+func TestDaemonJobControllerTemplateRefInvalid(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	fakeClient := fake.NewFakeClientWithScheme(scheme, getTemplateRefDaemonJob(nil), getTestDaemonJobTemplate(), getTestNode("node-a", nil))
+	recorder := record.NewFakeRecorder(10)
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, recorder}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+
+	t.Run("should report render failure without creating jobs", func(t *testing.T) {
+		assert.Error(t, err)
+		assert.Empty(t, getJobs(t, fakeClient))
+		assert.Equal(t, "Warning TemplateRenderFailed failed to render DaemonJobTemplate test-template: missing values of parameters: image", <-recorder.Events)
+	})
+}
+
+func TestRenderNodeTemplate(t *testing.T) {
+	template := &corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "test-container",
+				Image: "test-image:{{ .RunID }}",
+				Args:  []string{"--node={{ .Node.Name }}", `--zone={{ .Node.Labels["topology.kubernetes.io/zone"] }}`},
+				Env: []corev1.EnvVar{
+					{Name: "RUN_ID", Value: "{{.RunID}}"},
+					{Name: "RACK", Value: `{{ .Node.Labels["rack"] }}`},
+				},
+				VolumeMounts: []corev1.VolumeMount{{Name: "logs", MountPath: "/logs", SubPath: "{{ .Node.Name }}"}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name: "logs",
+				VolumeSource: corev1.VolumeSource{
+					HostPath: &corev1.HostPathVolumeSource{Path: "/var/log/{{ .RunID }}"},
+				},
+			}},
+		},
+	}
+	node := getTestNode("node-a", map[string]string{"topology.kubernetes.io/zone": "zone-1"})
+
+	rendered := renderNodeTemplate(template, node, "run-1")
+
+	t.Run("should render node placeholders in env, args and volume paths", func(t *testing.T) {
+		container := rendered.Spec.Containers[0]
+		assert.Equal(t, []string{"--node=node-a", "--zone=zone-1"}, container.Args)
+		assert.Equal(t, []corev1.EnvVar{{Name: "RUN_ID", Value: "run-1"}, {Name: "RACK", Value: ""}}, container.Env)
+		assert.Equal(t, "node-a", container.VolumeMounts[0].SubPath)
+		assert.Equal(t, "/var/log/run-1", rendered.Spec.Volumes[0].HostPath.Path)
+	})
+
+	t.Run("should leave other fields and the shared template untouched", func(t *testing.T) {
+		assert.Equal(t, "test-image:{{ .RunID }}", rendered.Spec.Containers[0].Image)
+		assert.Equal(t, "--node={{ .Node.Name }}", template.Spec.Containers[0].Args[0])
+	})
+}
+
+func TestDaemonJobControllerNodeTemplate(t *testing.T) {
+	scheme := getTestScheme(t)
+
+	instance := daemonjobCR.DeepCopy()
+	instance.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Args = []string{`--zone={{ .Node.Labels["zone"] }}`, "--run={{ .RunID }}"}
+	fakeClient := fake.NewFakeClientWithScheme(scheme, instance,
+		getTestNode("node-a", map[string]string{"zone": "zone-a"}), getTestNode("node-b", map[string]string{"zone": "zone-b"}))
+	reconciler := DaemonJobReconciler{fakeClient, ctrl.Log.WithName("controllers").WithName("DaemonJob"), scheme, record.NewFakeRecorder(10)}
+	_, err := reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should render pod template for every node", func(t *testing.T) {
+		runID := getRunID(instance, &instance.Spec.JobTemplate.Spec.Template)
+		args := map[string][]string{}
+		for _, job := range getJobs(t, fakeClient) {
+			args[job.Annotations[djv2.NodeNameAnnotation]] = job.Spec.Template.Spec.Containers[0].Args
+		}
+		assert.Equal(t, map[string][]string{
+			"node-a": {"--zone=zone-a", "--run=" + runID},
+			"node-b": {"--zone=zone-b", "--run=" + runID},
+		}, args)
+	})
+
+	_, err = reconciler.Reconcile(reconcile.Request{NamespacedName: daemonjobName})
+	require.NoError(t, err)
+
+	t.Run("should keep jobs of rendered template on next reconcile", func(t *testing.T) {
+		assert.Len(t, getJobs(t, fakeClient), 2)
+		assert.Equal(t, int32(2), getDaemonJob(t, fakeClient).Status.ActiveNodes)
+	})
+}
+
+func TestMapTemplateToDaemonJobs(t *testing.T) {
+	template := getTestDaemonJobTemplate()
+	templateObject := handler.MapObject{Meta: template, Object: template}
+
+	t.Run("should enqueue DaemonJobs referencing the template", func(t *testing.T) {
+		other := getTemplateRefDaemonJob(nil)
+		other.Name = "other"
+		other.Spec.TemplateRef.Name = "other-template"
+		fakeClient := fake.NewFakeClientWithScheme(getTestScheme(t), getTemplateRefDaemonJob(nil), other)
+		mapper := mapTemplateToDaemonJobs(fakeClient, ctrl.Log.WithName("templates")).(*handler.EnqueueRequestsFromMapFunc)
+		assert.Equal(t, []reconcile.Request{{NamespacedName: daemonjobName}}, mapper.ToRequests.Map(templateObject))
+	})
+
+	t.Run("should log failure to list DaemonJobs", func(t *testing.T) {
+		var entries []logEntry
+		fakeClient := fake.NewFakeClientWithScheme(runtime.NewScheme())
+		mapper := mapTemplateToDaemonJobs(fakeClient, testLogger{entries: &entries}).(*handler.EnqueueRequestsFromMapFunc)
+		assert.Empty(t, mapper.ToRequests.Map(templateObject))
+		require.Len(t, entries, 1)
+		assert.Equal(t, "Failed to list DaemonJobs for template event", entries[0].msg)
+		assert.Error(t, entries[0].fields["error"].(error))
+	})
+}
@@ -18,20 +18,35 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 
+	"github.com/go-logr/logr"
+	uberzap "go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/yaml"
 
+	configv1alpha1 "github.com/Dysproz/DaemonJob/api/config/v1alpha1"
 	djv1 "github.com/Dysproz/DaemonJob/api/v1"
+	djv2 "github.com/Dysproz/DaemonJob/api/v2"
 	"github.com/Dysproz/DaemonJob/controllers"
 	// +kubebuilder:scaffold:imports
 )
 
+// serviceAccountNamespaceFile holds the namespace of the manager pod.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -41,40 +56,146 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(djv1.AddToScheme(scheme))
+	utilruntime.Must(djv2.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
+	var configFile string
 	var metricsAddr string
 	var enableLeaderElection bool
+	var defaultsConfig string
+	var watchNamespaces string
+	var maxConcurrentReconciles int
+	var logFormat, logLevel string
+	rateLimiterOptions := controllers.DefaultRateLimiterOptions
+	flag.StringVar(&configFile, "config", "",
+		"Path to the manager configuration file. Flags set explicitly take precedence over it.")
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&defaultsConfig, "defaults-config", "",
+		"Path to a YAML file with defaults applied to every DaemonJob by the defaulting webhook. "+
+			"Deprecated: use daemonJobDefaults in --config.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma-separated list of namespaces the controller manages DaemonJobs in. "+
+			"All namespaces are managed if empty.")
+	flag.StringVar(&logFormat, "log-format", "", "Format of log entries, json or console.")
+	flag.StringVar(&logLevel, "log-level", "",
+		"Lowest level logged: debug, info, error, or a number of verbosity levels above info.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"Maximum number of DaemonJobs reconciled at the same time.")
+	flag.DurationVar(&rateLimiterOptions.BaseDelay, "rate-limiter-base-delay", rateLimiterOptions.BaseDelay,
+		"Delay before a DaemonJob that failed to reconcile is retried. It doubles with every following failure.")
+	flag.DurationVar(&rateLimiterOptions.MaxDelay, "rate-limiter-max-delay", rateLimiterOptions.MaxDelay,
+		"Maximum delay between retries of a DaemonJob that keeps failing to reconcile.")
+	flag.Float64Var(&rateLimiterOptions.QPS, "rate-limiter-qps", rateLimiterOptions.QPS,
+		"Overall number of DaemonJob requeues per second.")
+	flag.IntVar(&rateLimiterOptions.Burst, "rate-limiter-burst", rateLimiterOptions.Burst,
+		"Number of DaemonJob requeues allowed above --rate-limiter-qps at once.")
 	flag.Parse()
 
-	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+	config, err := configv1alpha1.Load(configFile)
+	if err == nil {
+		err = applyFlags(config, metricsAddr, enableLeaderElection, watchNamespaces, defaultsConfig, logFormat, logLevel)
+	}
+	if err == nil && config.Sharding.Enabled {
+		err = defaultShardingFromEnvironment(&config.Sharding)
+	}
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
+		setupLog.Error(err, "invalid manager configuration", "path", configFile)
+		os.Exit(1)
+	}
+
+	ctrl.SetLogger(newLogger(config.Logging))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: metricsAddr,
-		Port:               9443,
-		LeaderElection:     enableLeaderElection,
-		LeaderElectionID:   "2c007cad.dysproz.io",
-	})
+	if maxConcurrentReconciles < 1 {
+		setupLog.Info("invalid --max-concurrent-reconciles, must be at least 1", "value", maxConcurrentReconciles)
+		os.Exit(1)
+	}
+	if err := rateLimiterOptions.Validate(); err != nil {
+		setupLog.Error(err, "invalid rate limiter options")
+		os.Exit(1)
+	}
+
+	options := ctrl.Options{
+		Scheme:                  scheme,
+		MetricsBindAddress:      config.Metrics.BindAddress,
+		HealthProbeBindAddress:  config.Health.BindAddress,
+		LivenessEndpointName:    config.Health.LivenessEndpointName,
+		ReadinessEndpointName:   config.Health.ReadinessEndpointName,
+		Port:                    config.Webhook.Port,
+		CertDir:                 config.Webhook.CertDir,
+		LeaderElection:          config.LeaderElection.LeaderElect,
+		LeaderElectionID:        config.LeaderElection.ResourceName,
+		LeaderElectionNamespace: config.LeaderElection.ResourceNamespace,
+		LeaseDuration:           &config.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline:           &config.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:             &config.LeaderElection.RetryPeriod.Duration,
+	}
+	newCache := cache.New
+	if len(config.Namespaces) > 0 {
+		setupLog.Info("watching namespaces", "namespaces", config.Namespaces)
+		newCache = controllers.NamespacedCacheBuilder(config.Namespaces)
+	}
+	options.NewCache = controllers.PodCacheBuilder(newCache, config.Namespaces)
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	if config.Health.BindAddress != "" {
+		if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+			setupLog.Error(err, "unable to add liveness check")
+			os.Exit(1)
+		}
+		if err := mgr.AddReadyzCheck("ping", healthz.Ping); err != nil {
+			setupLog.Error(err, "unable to add readiness check")
+			os.Exit(1)
+		}
+	}
 
+	var shard *controllers.Shard
+	if config.Sharding.Enabled {
+		setupLog.Info("sharding DaemonJobs", "identity", config.Sharding.Identity)
+		shard = controllers.NewShard(mgr.GetClient(), mgr.GetAPIReader(), controllers.ShardOptions{
+			Identity:      config.Sharding.Identity,
+			Namespace:     config.Sharding.Namespace,
+			LeaseDuration: config.Sharding.LeaseDuration.Duration,
+			RenewPeriod:   config.Sharding.RenewPeriod.Duration,
+		}, ctrl.Log.WithName("shard"))
+	}
 	if err = (&controllers.DaemonJobReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("DaemonJob"),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("DaemonJob"),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("daemonjob-controller"),
+	}).SetupWithManager(mgr, controller.Options{
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		RateLimiter:             controllers.NewRateLimiter(rateLimiterOptions),
+	}, shard); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DaemonJob")
 		os.Exit(1)
 	}
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&djv1.DaemonJob{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DaemonJob", "version", "v1")
+			os.Exit(1)
+		}
+		if err = (&djv2.DaemonJob{}).SetupWebhookWithManager(mgr, config.DaemonJobDefaults); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DaemonJob", "version", "v2")
+			os.Exit(1)
+		}
+		if err = (&djv2.DaemonJobTemplate{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "DaemonJobTemplate")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -83,3 +204,94 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// applyFlags overrides the configuration with flags set explicitly on the command line.
+func applyFlags(config *configv1alpha1.ManagerConfig, metricsAddr string, enableLeaderElection bool,
+	watchNamespaces, defaultsConfig, logFormat, logLevel string) error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "metrics-addr":
+			config.Metrics.BindAddress = metricsAddr
+		case "enable-leader-election":
+			config.LeaderElection.LeaderElect = enableLeaderElection
+		case "watch-namespaces":
+			config.Namespaces = parseNamespaces(watchNamespaces)
+		case "log-format":
+			config.Logging.Format = configv1alpha1.LogFormat(logFormat)
+		case "log-level":
+			config.Logging.Level = logLevel
+		case "defaults-config":
+			if config.DaemonJobDefaults, err = loadDaemonJobDefaults(defaultsConfig); err != nil {
+				err = fmt.Errorf("unable to load DaemonJob defaults from %s: %v", defaultsConfig, err)
+			}
+		}
+	})
+	return err
+}
+
+// newLogger builds the logger of the manager from a validated logging configuration.
+func newLogger(config configv1alpha1.LoggingConfig) logr.Logger {
+	encoderConfig := uberzap.NewProductionEncoderConfig()
+	if *config.Development {
+		encoderConfig = uberzap.NewDevelopmentEncoderConfig()
+	}
+	encoder := zapcore.NewJSONEncoder(encoderConfig)
+	if config.Format == configv1alpha1.ConsoleLogFormat {
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+	level, _ := configv1alpha1.ParseLogLevel(config.Level)
+	return zap.New(
+		zap.UseDevMode(*config.Development),
+		zap.Encoder(encoder),
+		zap.Level(uberzap.NewAtomicLevelAt(level)),
+	)
+}
+
+// defaultShardingFromEnvironment fills in the identity and Lease namespace of the replica when not configured.
+// The identity defaults to the hostname, which is the pod name, and the namespace to POD_NAMESPACE
+// or the namespace of the service account.
+func defaultShardingFromEnvironment(config *configv1alpha1.ShardingConfig) error {
+	if config.Identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("unable to get hostname for sharding identity: %v", err)
+		}
+		config.Identity = hostname
+	}
+	if config.Namespace == "" {
+		config.Namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if config.Namespace == "" {
+		if namespace, err := ioutil.ReadFile(serviceAccountNamespaceFile); err == nil {
+			config.Namespace = strings.TrimSpace(string(namespace))
+		}
+	}
+	return nil
+}
+
+// parseNamespaces splits a comma-separated list of namespaces.
+func parseNamespaces(list string) []string {
+	var namespaces []string
+	for _, namespace := range strings.Split(list, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// loadDaemonJobDefaults reads operator-wide DaemonJob defaults from a YAML file.
+// No path means no defaults.
+func loadDaemonJobDefaults(path string) (djv2.DaemonJobDefaults, error) {
+	var defaults djv2.DaemonJobDefaults
+	if path == "" {
+		return defaults, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return defaults, err
+	}
+	err = yaml.UnmarshalStrict(data, &defaults)
+	return defaults, err
+}